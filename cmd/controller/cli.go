@@ -2,37 +2,199 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/rotisserie/eris"
+
+	"github.com/cybre/yeelight-music-sync/internal/yeelight"
 )
 
 type runtimeOptions struct {
-	bulbAddr    string
-	deviceIndex int
-	sampleRate  float64
-	frameSize   int
-	channels    int
-	latency     time.Duration
-	visualize   bool
-	debug       bool
+	bulbAddrs     []string
+	scan          netip.Prefix
+	deviceIndex   int
+	sampleRate    float64
+	frameSize     int
+	channels      int
+	latency       time.Duration
+	visualize     bool
+	debug         bool
+	background    bool
+	musicPorts    portRange
+	advertise     netip.Addr
+	colorStrategy yeelight.ColorStrategy
+	layout        *layout
+	bulbLatencies map[string]time.Duration
+	lightOffset   time.Duration
+	onExit        exitPolicy
+	timeouts      yeelight.Timeouts
+}
+
+// exitPolicy is what happens to the bulbs when the controller exits.
+type exitPolicy string
+
+const (
+	// exitRestore puts the bulbs back the way they were before the session.
+	exitRestore exitPolicy = "restore"
+	// exitOff switches the bulbs off.
+	exitOff exitPolicy = "off"
+	// exitLeave leaves the bulbs showing the last update.
+	exitLeave exitPolicy = "leave"
+)
+
+func parseExitPolicy(value string) (exitPolicy, error) {
+	policy := exitPolicy(value)
+	switch policy {
+	case exitRestore, exitOff, exitLeave:
+		return policy, nil
+	default:
+		return "", eris.Errorf("invalid exit policy %q, want restore, off or leave", value)
+	}
+}
+
+type portRange struct {
+	min, max uint16
+}
+
+func (r portRange) String() string {
+	if r.min == r.max {
+		return strconv.Itoa(int(r.min))
+	}
+	return fmt.Sprintf("%d-%d", r.min, r.max)
+}
+
+// parsePortRange accepts a single port or an inclusive "min-max" range.
+func parsePortRange(value string) (portRange, error) {
+	lo, hi, isRange := strings.Cut(value, "-")
+	if !isRange {
+		hi = lo
+	}
+
+	minPort, err := strconv.ParseUint(strings.TrimSpace(lo), 10, 16)
+	if err != nil {
+		return portRange{}, eris.Errorf("invalid port %q", lo)
+	}
+	maxPort, err := strconv.ParseUint(strings.TrimSpace(hi), 10, 16)
+	if err != nil {
+		return portRange{}, eris.Errorf("invalid port %q", hi)
+	}
+	if maxPort < minPort {
+		return portRange{}, eris.Errorf("port range %q ends before it starts", value)
+	}
+
+	return portRange{min: uint16(minPort), max: uint16(maxPort)}, nil
 }
 
 func parseCLIFlags() runtimeOptions {
 	var (
-		cfg       runtimeOptions
-		latencyMs int
+		cfg              runtimeOptions
+		latencyMs        int
+		lightOffsetMs    int
+		connectTimeoutMs int
+		commandTimeoutMs int
 	)
 
-	flag.StringVar(&cfg.bulbAddr, "bulb", "", "yeelight bulb address (ip[:port], default port 55443)")
+	cfg.musicPorts = portRange{min: 55000, max: 59999}
+	cfg.colorStrategy = yeelight.ColorStrategyAuto
+	cfg.onExit = exitRestore
+
+	flag.Func("bulb", "yeelight bulb address (ip[:port], default port 55443); repeat or comma-separate to drive several bulbs together", func(value string) error {
+		for _, addr := range strings.Split(value, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				cfg.bulbAddrs = append(cfg.bulbAddrs, addr)
+			}
+		}
+		return nil
+	})
+	flag.Func("scan", "CIDR range to probe for bulbs over TCP instead of SSDP discovery, for networks that block multicast (e.g. 192.168.1.0/24)", func(value string) error {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return eris.Errorf("invalid CIDR range %q", value)
+		}
+		cfg.scan = prefix
+		return nil
+	})
 	flag.IntVar(&cfg.deviceIndex, "device", -1, "audio input device index (leave blank to choose interactively)")
 	flag.Float64Var(&cfg.sampleRate, "sample-rate", 0, "capture sample rate (0 = device default)")
 	flag.IntVar(&cfg.frameSize, "frame-size", 1024, "analysis frame size in samples")
 	flag.IntVar(&cfg.channels, "channels", 2, "number of input channels to capture (<= device max)")
 	flag.IntVar(&latencyMs, "latency-ms", 0, "override input latency in milliseconds (0 = device default)")
+	flag.BoolVar(&cfg.background, "background", false, "drive the background ring of dual-light ceiling lamps separately (follows the bass)")
+	flag.Func("music-ports", "port or min-max range to listen on for the music mode connection (default 55000-59999)", func(value string) error {
+		ports, err := parsePortRange(value)
+		if err != nil {
+			return err
+		}
+		cfg.musicPorts = ports
+		return nil
+	})
+	flag.Func("advertise-addr", "IP the bulb should dial back to for music mode, for NAT or container hosts (default: local address of the bulb connection)", func(value string) error {
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return eris.Errorf("invalid IP address %q", value)
+		}
+		cfg.advertise = addr
+		return nil
+	})
+	flag.Func("color-strategy", "command used for color updates: auto, flow (start_cf), rgb (set_rgb + set_bright), hsv (set_hsv + set_bright) or scene (set_scene) (default auto)", func(value string) error {
+		strategy, err := yeelight.ParseColorStrategy(value)
+		if err != nil {
+			return err
+		}
+		cfg.colorStrategy = strategy
+		return nil
+	})
+	flag.Func("layout", "JSON file assigning bulbs of a group to roles (mix, bass, mids, treble, beat) with per-bulb gain, hue offset and brightness range", func(value string) error {
+		l, err := loadLayout(value)
+		if err != nil {
+			return err
+		}
+		cfg.layout = l
+		return nil
+	})
+	flag.Func("bulb-latency", "bulb=ms pairs overriding the measured latency of a bulb (matched by id, name, ip:port or ip); repeat or comma-separate", func(value string) error {
+		for _, pair := range strings.Split(value, ",") {
+			ref, ms, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || ref == "" {
+				return eris.Errorf("invalid bulb latency %q, want bulb=ms", pair)
+			}
+			latency, err := strconv.ParseUint(strings.TrimSpace(ms), 10, 16)
+			if err != nil {
+				return eris.Errorf("invalid latency %q for bulb %q", ms, ref)
+			}
+			if cfg.bulbLatencies == nil {
+				cfg.bulbLatencies = make(map[string]time.Duration)
+			}
+			cfg.bulbLatencies[ref] = time.Duration(latency) * time.Millisecond
+		}
+		return nil
+	})
+	flag.IntVar(&lightOffsetMs, "light-offset-ms", 0, "delay every light update by this many milliseconds to match speaker delay")
+	flag.Func("on-exit", "what to do with the bulbs on exit: restore (the state before the session), off or leave (default restore)", func(value string) error {
+		policy, err := parseExitPolicy(value)
+		if err != nil {
+			return err
+		}
+		cfg.onExit = policy
+		return nil
+	})
+	flag.IntVar(&connectTimeoutMs, "connect-timeout-ms", 5000, "give up connecting to a bulb after this many milliseconds")
+	flag.IntVar(&commandTimeoutMs, "command-timeout-ms", 3000, "give up on a bulb command that is not written or answered within this many milliseconds")
 	flag.BoolVar(&cfg.debug, "debug", false, "enable debug logging")
 	flag.BoolVar(&cfg.visualize, "visualize", false, "render realtime ASCII visualization (logs go to stderr)")
 	flag.Parse()
 
 	cfg.latency = time.Duration(latencyMs) * time.Millisecond
+	cfg.lightOffset = time.Duration(max(lightOffsetMs, 0)) * time.Millisecond
+	cfg.timeouts = yeelight.Timeouts{
+		Dial:  time.Duration(connectTimeoutMs) * time.Millisecond,
+		Write: time.Duration(commandTimeoutMs) * time.Millisecond,
+		Reply: time.Duration(commandTimeoutMs) * time.Millisecond,
+	}
 
 	return cfg
 }
@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"slices"
+	"sync"
 
 	"github.com/gordonklaus/portaudio"
 	"github.com/rotisserie/eris"
@@ -10,12 +12,15 @@ import (
 	"github.com/cybre/yeelight-music-sync/internal/yeelight"
 )
 
+// selectBulbAndDevice asks for the bulbs and device the flags leave open. Bulbs that
+// arrive on found while the list is shown are added to it.
 func selectBulbAndDevice(
 	bulbs []*yeelight.Bulb,
+	found <-chan *yeelight.Bulb,
 	devices []*portaudio.DeviceInfo,
 	defaultDeviceIndex int,
 	opts runtimeOptions,
-) (*yeelight.Bulb, *portaudio.DeviceInfo, error) {
+) ([]*yeelight.Bulb, *portaudio.DeviceInfo, error) {
 	if len(bulbs) == 0 {
 		return nil, nil, eris.New("no bulbs available")
 	}
@@ -24,13 +29,13 @@ func selectBulbAndDevice(
 	}
 
 	var (
-		selectedBulb   *yeelight.Bulb
+		selectedBulbs  []*yeelight.Bulb
 		selectedDevice *portaudio.DeviceInfo
 		deviceIndex    = -1
 	)
 
-	if opts.bulbAddr != "" {
-		selectedBulb = bulbs[0]
+	if len(opts.bulbAddrs) > 0 {
+		selectedBulbs = bulbs
 	}
 	if opts.deviceIndex >= 0 {
 		if opts.deviceIndex >= len(devices) {
@@ -40,11 +45,11 @@ func selectBulbAndDevice(
 		deviceIndex = opts.deviceIndex
 	}
 
-	needBulb := selectedBulb == nil
+	needBulb := selectedBulbs == nil
 	needDevice := selectedDevice == nil
 
 	if !needBulb && !needDevice {
-		return selectedBulb, selectedDevice, nil
+		return selectedBulbs, selectedDevice, nil
 	}
 
 	initialBulb := 0
@@ -53,6 +58,15 @@ func selectBulbAndDevice(
 	bulbOptions := buildBulbOptions(bulbs)
 	deviceOptions := buildDeviceOptions(devices)
 
+	offers := &bulbOffers{bulbs: slices.Clone(bulbs)}
+	var moreBulbs chan ui.Option
+	if needBulb && found != nil {
+		moreBulbs = make(chan ui.Option)
+		done := make(chan struct{})
+		defer close(done)
+		go offers.forward(found, moreBulbs, done)
+	}
+
 	result, err := ui.RunSetup(
 		bulbOptions,
 		deviceOptions,
@@ -61,27 +75,89 @@ func selectBulbAndDevice(
 			RequireDevice: needDevice,
 			InitialBulb:   0,
 			InitialDevice: initialDevice,
+			MoreBulbs:     moreBulbs,
 		},
 	)
 	if err != nil {
 		if eris.Is(err, ui.ErrNoInteractiveTTY) {
 			if needBulb {
-				selectedBulb = bulbs[initialBulb]
+				selectedBulbs = bulbs[initialBulb : initialBulb+1]
 			}
 			if needDevice {
 				selectedDevice = devices[initialDevice]
 			}
-			return selectedBulb, selectedDevice, nil
+			return selectedBulbs, selectedDevice, nil
 		}
 		return nil, nil, err
 	}
 
-	selectedBulb = bulbs[result.BulbIndex]
+	if needBulb {
+		for _, i := range result.BulbIndexes {
+			selectedBulbs = append(selectedBulbs, offers.bulb(i))
+		}
+	}
 	if needDevice {
 		selectedDevice = devices[result.DeviceIndex]
 	}
 
-	return selectedBulb, selectedDevice, nil
+	return selectedBulbs, selectedDevice, nil
+}
+
+// bulbOffers is the list of bulbs shown for selection, growing as more are found.
+type bulbOffers struct {
+	mu    sync.Mutex
+	bulbs []*yeelight.Bulb
+}
+
+// forward offers the bulbs from found that are not listed yet, in the order they
+// arrive, until found is closed or done is. Once done, discovery is left to finish
+// without anyone waiting for it.
+func (o *bulbOffers) forward(found <-chan *yeelight.Bulb, options chan<- ui.Option, done <-chan struct{}) {
+	defer func() {
+		close(options)
+		for range found {
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		case bulb, ok := <-found:
+			if !ok {
+				return
+			}
+			if !o.add(bulb) {
+				continue
+			}
+			select {
+			case options <- ui.Option{Label: describeBulb(bulb)}:
+			case <-done:
+				return
+			}
+		}
+	}
+}
+
+// add lists bulb unless a bulb with its ID already is.
+func (o *bulbOffers) add(bulb *yeelight.Bulb) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for _, offered := range o.bulbs {
+		if offered.ID() != "" && offered.ID() == bulb.ID() {
+			return false
+		}
+	}
+	o.bulbs = append(o.bulbs, bulb)
+	return true
+}
+
+func (o *bulbOffers) bulb(i int) *yeelight.Bulb {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.bulbs[i]
 }
 
 func buildBulbOptions(bulbs []*yeelight.Bulb) []ui.Option {
@@ -151,15 +227,27 @@ func effectiveInitialDeviceIndex(requested, fallback, length int) int {
 	return 0
 }
 
-func buildLoopConfig(bulb *yeelight.Bulb, device *portaudio.DeviceInfo, opts runtimeOptions) loopConfig {
+func buildLoopConfig(bulbs []*yeelight.Bulb, device *portaudio.DeviceInfo, opts runtimeOptions) loopConfig {
 	return loopConfig{
-		Bulb:       bulb,
+		Bulbs:      bulbs,
 		Device:     device,
 		SampleRate: effectiveSampleRate(opts.sampleRate, device.DefaultSampleRate),
 		FrameSize:  effectiveFrameSize(opts.frameSize),
 		Channels:   sanitizeChannelCount(opts.channels, int(device.MaxInputChannels)),
 		Latency:    opts.latency,
 		Visualize:  opts.visualize,
+		Background: opts.background,
+		MusicMode: yeelight.MusicModeOptions{
+			MinPort:          opts.musicPorts.min,
+			MaxPort:          opts.musicPorts.max,
+			AdvertiseAddress: opts.advertise,
+		},
+		ColorStrategy: opts.colorStrategy,
+		Layout:        opts.layout,
+		BulbLatencies: opts.bulbLatencies,
+		LightOffset:   opts.lightOffset,
+		OnExit:        opts.onExit,
+		Timeouts:      opts.timeouts,
 	}
 }
 
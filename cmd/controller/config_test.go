@@ -0,0 +1,71 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cybre/yeelight-music-sync/internal/ui"
+	"github.com/cybre/yeelight-music-sync/internal/yeelight"
+)
+
+func rememberedBulbs(t *testing.T) []*yeelight.Bulb {
+	t.Helper()
+
+	inventory, err := yeelight.LoadInventory(writeFile(t, "bulbs.json", `{"version": 1, "bulbs": {
+		"0x01": {"addr": "10.0.0.1:55443", "name": "desk"},
+		"0x02": {"addr": "10.0.0.2:55443", "name": "shelf"},
+		"0x03": {"addr": "10.0.0.3:55443", "name": "hall"}
+	}}`))
+	require.NoError(t, err)
+
+	bulbs := inventory.Bulbs()
+	require.Len(t, bulbs, 3)
+	return bulbs
+}
+
+func TestBulbOffersAddsNewBulbs(t *testing.T) {
+	bulbs := rememberedBulbs(t)
+	offers := &bulbOffers{bulbs: slices.Clone(bulbs[:1])}
+
+	found := make(chan *yeelight.Bulb, 3)
+	found <- bulbs[0]
+	found <- bulbs[2]
+	found <- bulbs[1]
+	close(found)
+
+	options := make(chan ui.Option)
+	go offers.forward(found, options, make(chan struct{}))
+
+	var labels []string
+	for option := range options {
+		labels = append(labels, option.Label)
+	}
+
+	assert.Equal(t, []string{describeBulb(bulbs[2]), describeBulb(bulbs[1])}, labels)
+	assert.Same(t, bulbs[0], offers.bulb(0))
+	assert.Same(t, bulbs[2], offers.bulb(1))
+	assert.Same(t, bulbs[1], offers.bulb(2))
+}
+
+func TestBulbOffersStopWhenSelectionIsDone(t *testing.T) {
+	bulbs := rememberedBulbs(t)
+	offers := &bulbOffers{bulbs: slices.Clone(bulbs[:1])}
+
+	found := make(chan *yeelight.Bulb)
+	options := make(chan ui.Option)
+	done := make(chan struct{})
+	go offers.forward(found, options, done)
+
+	found <- bulbs[1]
+	close(done)
+
+	// discovery can still hand over what it found, and nobody has to read the options
+	found <- bulbs[2]
+	close(found)
+
+	_, open := <-options
+	assert.False(t, open)
+}
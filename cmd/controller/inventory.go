@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/rotisserie/eris"
+
+	"github.com/cybre/yeelight-music-sync/internal/yeelight"
+)
+
+// openInventory loads the remembered bulbs. It returns nil, and bulbs are not
+// remembered, when the user config directory is unavailable.
+func openInventory(logger *slog.Logger) *yeelight.Inventory {
+	path, err := yeelight.DefaultInventoryPath()
+	if err != nil {
+		logger.Warn("not remembering bulbs", slog.Any("error", err))
+		return nil
+	}
+
+	inventory, err := yeelight.LoadInventory(path)
+	if err != nil {
+		logger.Warn("ignoring remembered bulbs", slog.Any("error", err))
+	}
+
+	return inventory
+}
+
+// refreshInventory discovers bulbs in the background and records them, flagging
+// remembered bulbs that changed address. Every bulb found is then sent on found, which
+// is closed when discovery is over.
+func refreshInventory(ctx context.Context, logger *slog.Logger, inventory *yeelight.Inventory, found chan<- *yeelight.Bulb) {
+	defer close(found)
+
+	bulbs, err := yeelight.Discover(ctx, yeelight.DiscoverOptions{})
+	if err != nil {
+		if !eris.Is(err, context.Canceled) {
+			logger.Warn("failed to refresh remembered bulbs", slog.Any("error", err))
+		}
+		return
+	}
+
+	rememberBulbs(logger, inventory, bulbs)
+
+	for _, bulb := range bulbs {
+		select {
+		case found <- bulb:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func rememberBulbs(logger *slog.Logger, inventory *yeelight.Inventory, bulbs []*yeelight.Bulb) {
+	if inventory == nil {
+		return
+	}
+
+	for _, change := range inventory.Update(bulbs...) {
+		logger.Warn("remembered bulb changed address",
+			slog.String("id", change.ID),
+			slog.String("name", change.Bulb.Name()),
+			slog.String("previous", change.Previous.String()),
+			slog.String("addr", change.Bulb.Addr().String()),
+		)
+	}
+
+	if err := inventory.Save(); err != nil {
+		logger.Warn("failed to remember bulbs", slog.Any("error", err))
+	}
+}
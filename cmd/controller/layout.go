@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+
+	"github.com/rotisserie/eris"
+
+	"github.com/cybre/yeelight-music-sync/internal/controller"
+	"github.com/cybre/yeelight-music-sync/internal/yeelight"
+)
+
+// layout assigns bulbs of a group to parts of the music. It is read from the JSON file
+// passed with --layout.
+type layout struct {
+	Bulbs []layoutEntry `json:"bulbs"`
+}
+
+type layoutEntry struct {
+	// Bulb matches a bulb by ID, name, ip:port or ip.
+	Bulb          string  `json:"bulb"`
+	Role          string  `json:"role"`
+	Gain          float64 `json:"gain"`
+	HueOffset     float64 `json:"hue_offset"`
+	MinBrightness float64 `json:"min_brightness"`
+	MaxBrightness float64 `json:"max_brightness"`
+}
+
+func loadLayout(path string) (*layout, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, eris.Wrap(err, "read layout")
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	var l layout
+	if err := decoder.Decode(&l); err != nil {
+		return nil, eris.Wrapf(err, "parse layout %s", path)
+	}
+
+	for i, entry := range l.Bulbs {
+		if entry.Bulb == "" {
+			return nil, eris.Errorf("layout entry %d has no bulb", i)
+		}
+		if entry.Role != "" {
+			if _, err := controller.ParseRole(entry.Role); err != nil {
+				return nil, eris.Wrapf(err, "layout entry for %q", entry.Bulb)
+			}
+		}
+	}
+
+	return &l, nil
+}
+
+func (e layoutEntry) matches(bulb *yeelight.Bulb) bool {
+	return matchesBulb(e.Bulb, bulb)
+}
+
+// matchesBulb reports whether ref names bulb by ID, name, ip:port or ip.
+func matchesBulb(ref string, bulb *yeelight.Bulb) bool {
+	switch ref {
+	case bulb.ID(), bulb.Name(), bulb.Addr().String(), bulb.Addr().Addr().String():
+		return true
+	default:
+		return false
+	}
+}
+
+// zones gives every bulb of light its own zone. Bulbs the layout does not mention follow
+// the full mix.
+func (l *layout) zones(logger *slog.Logger, bulbs []*yeelight.Bulb, light *yeelight.GroupLight) []controller.Zone {
+	used := make([]bool, len(l.Bulbs))
+	zones := make([]controller.Zone, 0, len(bulbs))
+
+	for _, bulb := range bulbs {
+		member := light.Member(bulb)
+		if member == nil {
+			continue
+		}
+
+		zone := controller.Zone{
+			Light:   member,
+			Role:    controller.RoleMix,
+			Palette: controller.PaletteFor(bulb.Info()),
+		}
+		for i, entry := range l.Bulbs {
+			if !entry.matches(bulb) {
+				continue
+			}
+			used[i] = true
+			if entry.Role != "" {
+				zone.Role = controller.Role(entry.Role)
+			}
+			zone.Params = controller.MapperParams{
+				Gain:          entry.Gain,
+				HueOffset:     entry.HueOffset,
+				MinBrightness: entry.MinBrightness,
+				MaxBrightness: entry.MaxBrightness,
+			}
+			break
+		}
+
+		logger.Info("assigned bulb to zone",
+			slog.String("addr", bulb.Addr().String()),
+			slog.String("role", string(zone.Role)),
+			slog.String("palette", zone.Palette.String()),
+		)
+		zones = append(zones, zone)
+	}
+
+	for i, entry := range l.Bulbs {
+		if !used[i] {
+			logger.Warn("layout entry matches no connected bulb", slog.String("bulb", entry.Bulb))
+		}
+	}
+
+	return zones
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cybre/yeelight-music-sync/internal/controller"
+	"github.com/cybre/yeelight-music-sync/internal/yeelight"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoadLayout(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    *layout
+		wantErr error
+	}{
+		{
+			name:    "roles and params",
+			content: `{"bulbs": [{"bulb": "desk", "role": "bass", "gain": 1.5, "max_brightness": 80}, {"bulb": "10.0.0.3"}]}`,
+			want: &layout{Bulbs: []layoutEntry{
+				{Bulb: "desk", Role: "bass", Gain: 1.5, MaxBrightness: 80},
+				{Bulb: "10.0.0.3"},
+			}},
+		},
+		{name: "empty", content: `{}`, want: &layout{}},
+		{name: "unknown role", content: `{"bulbs": [{"bulb": "desk", "role": "drums"}]}`, wantErr: controller.ErrRoleInvalid},
+		{name: "missing bulb", content: `{"bulbs": [{"role": "bass"}]}`},
+		{name: "unknown field", content: `{"bulbs": [{"bulb": "desk", "colour": "red"}]}`},
+		{name: "not json", content: `bulbs: desk`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := loadLayout(writeFile(t, "layout.json", tt.content))
+			if tt.want == nil {
+				require.Error(t, err)
+				if tt.wantErr != nil {
+					assert.ErrorIs(t, err, tt.wantErr)
+				}
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestLoadLayoutMissingFile(t *testing.T) {
+	_, err := loadLayout(filepath.Join(t.TempDir(), "layout.json"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestLayoutZones(t *testing.T) {
+	inventory, err := yeelight.LoadInventory(writeFile(t, "bulbs.json", `{"version": 1, "bulbs": {
+		"0x01": {"addr": "10.0.0.1:55443", "name": "desk", "model": "color", "support": ["set_hsv", "set_ct_abx", "set_bright"]},
+		"0x02": {"addr": "10.0.0.2:55443", "name": "shelf", "model": "ceiling", "support": ["set_ct_abx", "set_bright"]},
+		"0x03": {"addr": "10.0.0.3:55443", "name": "hall", "model": "mono", "support": ["set_bright"]},
+		"0x04": {"addr": "10.0.0.4:55443", "name": "sofa", "model": "color", "support": ["set_hsv", "set_bright"]}
+	}}`))
+	require.NoError(t, err)
+	bulbs := inventory.Bulbs()
+	require.Len(t, bulbs, 4)
+
+	l := &layout{Bulbs: []layoutEntry{
+		{Bulb: "desk", Role: "bass", Gain: 2, HueOffset: 30},
+		{Bulb: "0x02", Role: "treble", MinBrightness: 10, MaxBrightness: 60},
+		{Bulb: "10.0.0.3", Role: "beat"},
+		{Bulb: "ghost", Role: "mids"},
+	}}
+	light := yeelight.NewGroup(bulbs...).Light(t.Context())
+	zones := l.zones(slog.New(slog.NewTextHandler(io.Discard, nil)), bulbs, light)
+
+	tests := []struct {
+		name    string
+		role    controller.Role
+		params  controller.MapperParams
+		palette controller.Palette
+	}{
+		{name: "desk", role: controller.RoleBass, params: controller.MapperParams{Gain: 2, HueOffset: 30}, palette: controller.PaletteColor},
+		{name: "shelf", role: controller.RoleTreble, params: controller.MapperParams{MinBrightness: 10, MaxBrightness: 60}, palette: controller.PaletteWhite},
+		{name: "hall", role: controller.RoleBeat, palette: controller.PaletteBrightness},
+		{name: "sofa", role: controller.RoleMix, palette: controller.PaletteColor},
+	}
+
+	require.Len(t, zones, len(tests))
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.name, bulbs[i].Name())
+			assert.Equal(t, light.Member(bulbs[i]), zones[i].Light)
+			assert.Equal(t, tt.role, zones[i].Role)
+			assert.Equal(t, tt.params, zones[i].Params)
+			assert.Equal(t, tt.palette, zones[i].Palette)
+		})
+	}
+}
+
+func TestMatchesBulb(t *testing.T) {
+	bulb, err := yeelight.NewBulbFromAddress("10.0.0.1:55443")
+	require.NoError(t, err)
+
+	assert.True(t, matchesBulb("10.0.0.1:55443", bulb))
+	assert.True(t, matchesBulb("10.0.0.1", bulb))
+	assert.False(t, matchesBulb("10.0.0.1:1982", bulb))
+	assert.False(t, matchesBulb("desk", bulb))
+}
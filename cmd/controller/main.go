@@ -4,9 +4,9 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
-	"math/rand"
 	"os"
 	"os/signal"
+	"slices"
 	"syscall"
 	"time"
 
@@ -22,17 +22,23 @@ import (
 )
 
 type loopConfig struct {
-	Bulb       *yeelight.Bulb
-	Device     *portaudio.DeviceInfo
-	SampleRate float64
-	FrameSize  int
-	Channels   int
-	Latency    time.Duration
-	Visualize  bool
+	Bulbs         []*yeelight.Bulb
+	Device        *portaudio.DeviceInfo
+	SampleRate    float64
+	FrameSize     int
+	Channels      int
+	Latency       time.Duration
+	Visualize     bool
+	Background    bool
+	MusicMode     yeelight.MusicModeOptions
+	ColorStrategy yeelight.ColorStrategy
+	Layout        *layout
+	BulbLatencies map[string]time.Duration
+	LightOffset   time.Duration
+	OnExit        exitPolicy
+	Timeouts      yeelight.Timeouts
 }
 
-var rng = rand.New(rand.NewSource(time.Now().UnixNano()))
-
 func main() {
 	cfg := parseCLIFlags()
 
@@ -46,7 +52,10 @@ func main() {
 }
 
 func runController(ctx context.Context, cfg runtimeOptions) error {
-	bulbs, err := resolveBulbs(ctx, cfg)
+	logger := setupLogger(cfg.debug, cfg.visualize)
+	inventory := openInventory(logger)
+
+	bulbs, found, err := resolveBulbs(ctx, logger, cfg, inventory)
 	if err != nil {
 		return err
 	}
@@ -66,17 +75,25 @@ func runController(ctx context.Context, cfg runtimeOptions) error {
 		return eris.Wrap(err, "resolve default audio input device")
 	}
 
-	logger := setupLogger(cfg.debug, cfg.visualize)
+	registry := yeelight.NewRegistry()
+	registry.Seed(bulbs...)
+	go watchBulbs(ctx, logger, registry)
 
-	bulb, device, err := selectBulbAndDevice(bulbs, devices, defaultDevice.Index, cfg)
+	selected, device, err := selectBulbAndDevice(bulbs, found, devices, defaultDevice.Index, cfg)
 	if err != nil {
 		return eris.Wrap(err, "select bulb/device")
 	}
 	if device.MaxInputChannels < 1 {
 		return eris.Errorf("device %s has no input channels; select a loopback/monitor device", device.Name)
 	}
+	if len(cfg.bulbAddrs) == 0 && !cfg.scan.IsValid() && inventory != nil {
+		// the background refresh may have found remembered bulbs at new addresses
+		for i, bulb := range selected {
+			selected[i] = inventory.Latest(bulb)
+		}
+	}
 
-	loopCfg := buildLoopConfig(bulb, device, cfg)
+	loopCfg := buildLoopConfig(selected, device, cfg)
 
 	if cfg.channels > 0 && cfg.channels > int(device.MaxInputChannels) {
 		logger.Warn("requested channels exceed device capabilities",
@@ -114,44 +131,119 @@ func setupLogger(debug, visualize bool) *slog.Logger {
 }
 
 func run(ctx context.Context, logger *slog.Logger, cfg loopConfig) error {
-	logger.Info(
-		"using yeelight bulb",
-		slog.String("id", cfg.Bulb.ID()),
-		slog.String("name", cfg.Bulb.Name()),
-		slog.String("model", cfg.Bulb.Model()),
-		slog.String("firmware_version", cfg.Bulb.FirmwareVersion()),
-	)
+	for _, bulb := range cfg.Bulbs {
+		logger.Info(
+			"using yeelight bulb",
+			slog.String("id", bulb.ID()),
+			slog.String("name", bulb.Name()),
+			slog.String("model", bulb.Model()),
+			slog.String("firmware_version", bulb.FirmwareVersion()),
+		)
+	}
 
-	if err := cfg.Bulb.Connect(ctx); err != nil {
-		return err
+	if cfg.Background && !slices.ContainsFunc(cfg.Bulbs, mayHaveBackground) {
+		logger.Warn("no bulb has a background light, driving the main lights only")
+		cfg.Background = false
+	}
+
+	for _, bulb := range cfg.Bulbs {
+		bulb.SetTimeouts(cfg.Timeouts)
+	}
+
+	// Ctrl+C abandons connecting, but once connected the bulbs stay connected until
+	// they have been put back on exit
+	connectCtx, cancelConnect := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelConnect()
+	stopCancelling := context.AfterFunc(ctx, cancelConnect)
+
+	group := yeelight.NewGroup(cfg.Bulbs...)
+	connectErr := group.Connect(connectCtx)
+	if !stopCancelling() {
+		return ctx.Err()
+	}
+	if connectErr != nil {
+		return connectErr
 	}
+	snapshots := make(map[*yeelight.Bulb]yeelight.Snapshot)
 	defer func(ctx context.Context) {
-		if err := cfg.Bulb.TurnOff(ctx, yeelight.Smooth, 100); err != nil {
-			logger.Warn("failed to turn off bulb", slog.Any("error", err))
-		} else {
-			logger.Info("bulb turned off")
+		// a bulb that stopped answering must not hold up the exit, and a session that
+		// used up the command quota must not keep the bulbs from being put back
+		ctx, cancel := context.WithTimeout(yeelight.WithReservedQuota(ctx), exitTimeout)
+		defer cancel()
+
+		for _, bulb := range group.Bulbs() {
+			finishBulb(ctx, logger, bulb, cfg, snapshots)
 		}
 		time.Sleep(500 * time.Millisecond)
-		if err := cfg.Bulb.Disconnect(); err != nil {
+		if err := group.Disconnect(); err != nil {
 			logger.Warn("faield to disconnect from bulb", slog.Any("error", err))
 		} else {
-			logger.Info("bulb disconnected")
+			logger.Info("bulbs disconnected")
 		}
 	}(context.WithoutCancel(ctx))
 
-	if cfg.Bulb.Power() != yeelight.PowerOn {
-		if err := cfg.Bulb.TurnOn(ctx, yeelight.Smooth, 250); err != nil {
-			logger.Warn("failed to turn on bulb", slog.Any("error", err))
-		} else {
-			logger.Info("bulb turned on")
+	if cfg.OnExit == exitRestore {
+		for _, bulb := range group.Bulbs() {
+			snapshot, err := bulb.Snapshot(ctx)
+			if err != nil {
+				logger.Warn("failed to snapshot bulb, it will be switched off on exit", slog.String("addr", bulb.Addr().String()), slog.Any("error", err))
+				continue
+			}
+			snapshots[bulb] = snapshot
+		}
+	}
+
+	infos := make([]yeelight.BulbInfo, 0, len(group.Bulbs()))
+	for _, bulb := range group.Bulbs() {
+		prepareBulb(ctx, logger, bulb, cfg)
+		infos = append(infos, bulb.Info())
+	}
+	for ref := range cfg.BulbLatencies {
+		if !slices.ContainsFunc(group.Bulbs(), func(bulb *yeelight.Bulb) bool { return matchesBulb(ref, bulb) }) {
+			logger.Warn("bulb latency matches no connected bulb", slog.String("bulb", ref))
 		}
 	}
+	group.SetOffset(cfg.LightOffset)
+
+	palette := controller.PaletteFor(infos...)
+	if len(infos) > 1 && palette != controller.PaletteColor {
+		logger.Info("not every bulb can show color, driving the group alike", slog.String("palette", palette.String()))
+	}
+
+	logger.Info("starting music mode",
+		slog.Int("min_port", int(cfg.MusicMode.MinPort)),
+		slog.Int("max_port", int(cfg.MusicMode.MaxPort)),
+	)
 
-	musicPort := randomMusicModePort()
-	logger.Info("starting music mode", slog.Int("port", int(musicPort)))
-	if err := cfg.Bulb.EnableMusicMode(ctx, musicPort, func(loopCtx context.Context, musicBulb *yeelight.MusicModeBulb) error {
-		return runReactiveLoop(loopCtx, logger, musicBulb, cfg)
-	}); err != nil {
+	musicModeStarted := false
+	err := group.EnableMusicMode(ctx, cfg.MusicMode, func(loopCtx context.Context, light *yeelight.GroupLight) error {
+		musicModeStarted = true
+		opts := controller.Options{Palette: palette}
+		if cfg.Background {
+			opts.Background = light.BackgroundLight()
+		}
+		if cfg.Layout != nil {
+			opts.Zones = cfg.Layout.zones(logger, group.Bulbs(), light)
+		}
+		return runReactiveLoop(loopCtx, logger, light, opts, cfg)
+	})
+	if err != nil && !musicModeStarted && !eris.Is(err, context.Canceled) {
+		opts := controller.QuotaOptions(group.Quota(), group.CommandsPerUpdate())
+		opts.Palette = palette
+		light := group.Light(ctx)
+		if cfg.Background {
+			opts.Background = light.BackgroundLight()
+		}
+		if cfg.Layout != nil {
+			opts.Zones = cfg.Layout.zones(logger, group.Bulbs(), light)
+		}
+		logger.Warn("music mode unavailable, falling back to rate-limited control connection",
+			slog.Any("error", err),
+			slog.Duration("command_spacing", opts.MinCommandSpacing),
+		)
+		err = runReactiveLoop(ctx, logger, light, opts, cfg)
+	}
+	if err != nil {
 		if eris.Is(err, context.Canceled) {
 			return nil
 		}
@@ -161,26 +253,184 @@ func run(ctx context.Context, logger *slog.Logger, cfg loopConfig) error {
 	return nil
 }
 
-func resolveBulbs(ctx context.Context, cfg runtimeOptions) ([]*yeelight.Bulb, error) {
-	if cfg.bulbAddr != "" {
-		bulb, err := yeelight.NewBulbFromAddress(cfg.bulbAddr)
+const (
+	// latencySamples is how many round trips are timed to estimate a bulb's latency.
+	latencySamples = 5
+	// exitTimeout bounds putting the bulbs back on exit.
+	exitTimeout = 5 * time.Second
+)
+
+// prepareBulb switches a connected bulb on, applies the color strategy and settles its
+// latency.
+func prepareBulb(ctx context.Context, logger *slog.Logger, bulb *yeelight.Bulb, cfg loopConfig) {
+	addr := slog.String("addr", bulb.Addr().String())
+
+	if bulb.Power() != yeelight.PowerOn {
+		if err := bulb.TurnOn(ctx, yeelight.Smooth, 250); err != nil {
+			logger.Warn("failed to turn on bulb", addr, slog.Any("error", err))
+		} else {
+			logger.Info("bulb turned on", addr)
+		}
+	}
+	if cfg.Background && mayHaveBackground(bulb) && bulb.Background().Power() != yeelight.PowerOn {
+		if err := bulb.BackgroundLight().TurnOn(ctx, yeelight.Smooth, 250); err != nil {
+			logger.Warn("failed to turn on background light", addr, slog.Any("error", err))
+		}
+	}
+
+	if err := bulb.SetColorStrategy(cfg.ColorStrategy); err != nil {
+		logger.Warn("failed to set color strategy", addr, slog.Any("error", err))
+	}
+
+	configured := false
+	for ref, latency := range cfg.BulbLatencies {
+		if matchesBulb(ref, bulb) {
+			bulb.SetLatency(latency)
+			configured = true
+		}
+	}
+	if configured {
+		logger.Info("using configured bulb latency", addr, slog.Duration("latency", bulb.Latency()))
+	} else if latency, err := bulb.MeasureLatency(ctx, latencySamples); err != nil {
+		logger.Warn("failed to measure bulb latency", addr, slog.Any("error", err))
+	} else {
+		logger.Info("measured bulb latency", addr, slog.Duration("latency", latency))
+	}
+
+	switch controller.PaletteFor(bulb.Info()) {
+	case controller.PaletteColor:
+		logger.Info("sending colors",
+			addr,
+			slog.String("strategy", string(bulb.ColorStrategy())),
+			slog.Duration("response_time", bulb.ResponseTime()),
+		)
+	case controller.PaletteWhite:
+		logger.Info("bulb cannot show color, driving white color temperature",
+			addr,
+			slog.String("model", bulb.Model()),
+			slog.String("strategy", string(bulb.WhiteStrategy())),
+		)
+	default:
+		logger.Info("bulb cannot show color, pulsing brightness only", addr, slog.String("model", bulb.Model()))
+	}
+}
+
+// finishBulb leaves a bulb the way the exit policy asks: back in the state it was in
+// before the session, switched off, or as it is. Bulbs without a snapshot are switched
+// off.
+func finishBulb(ctx context.Context, logger *slog.Logger, bulb *yeelight.Bulb, cfg loopConfig, snapshots map[*yeelight.Bulb]yeelight.Snapshot) {
+	addr := slog.String("addr", bulb.Addr().String())
+
+	switch cfg.OnExit {
+	case exitLeave:
+		return
+	case exitRestore:
+		if snapshot, ok := snapshots[bulb]; ok {
+			if err := bulb.Restore(ctx, snapshot); err != nil {
+				logger.Warn("failed to restore bulb", addr, slog.Any("error", err))
+			} else {
+				logger.Info("bulb restored", addr, slog.String("power", string(snapshot.Main().Power())))
+			}
+			return
+		}
+	}
+
+	if err := bulb.TurnOff(ctx, yeelight.Smooth, 100); err != nil {
+		logger.Warn("failed to turn off bulb", addr, slog.Any("error", err))
+	} else {
+		logger.Info("bulb turned off", addr)
+	}
+	if cfg.Background && mayHaveBackground(bulb) {
+		if err := bulb.BackgroundLight().TurnOff(ctx, yeelight.Smooth, 100); err != nil {
+			logger.Warn("failed to turn off background light", addr, slog.Any("error", err))
+		}
+	}
+}
+
+// mayHaveBackground reports whether the bulb has a background light, or might have one
+// because its support list is unknown.
+func mayHaveBackground(bulb *yeelight.Bulb) bool {
+	return len(bulb.Support()) == 0 || bulb.HasBackground()
+}
+
+// resolveBulbs returns the bulbs given with --bulb or found by --scan, otherwise the
+// remembered bulbs, otherwise the discovered bulbs. With remembered bulbs, discovery
+// refreshes them in the background and sends every bulb it finds on found, which is
+// nil otherwise.
+func resolveBulbs(ctx context.Context, logger *slog.Logger, cfg runtimeOptions, inventory *yeelight.Inventory) (bulbs []*yeelight.Bulb, found <-chan *yeelight.Bulb, err error) {
+	if len(cfg.bulbAddrs) > 0 {
+		bulbs := make([]*yeelight.Bulb, 0, len(cfg.bulbAddrs))
+		for _, addr := range cfg.bulbAddrs {
+			bulb, err := newBulbAt(inventory, addr)
+			if err != nil {
+				return nil, nil, eris.Wrapf(err, "parse bulb address %q", addr)
+			}
+			bulbs = append(bulbs, bulb)
+		}
+		return bulbs, nil, nil
+	}
+
+	if cfg.scan.IsValid() {
+		logger.Info("scanning for bulbs", slog.String("range", cfg.scan.String()))
+		bulbs, err := yeelight.Scan(ctx, cfg.scan, yeelight.ScanOptions{})
 		if err != nil {
-			return nil, eris.Wrap(err, "parse bulb address")
+			return nil, nil, err
+		}
+		if len(bulbs) == 0 {
+			return nil, nil, eris.Errorf("no bulbs found in %s", cfg.scan)
 		}
-		return []*yeelight.Bulb{bulb}, nil
+		return bulbs, nil, nil
 	}
 
-	bulbs, err := yeelight.Discover(ctx)
+	if inventory != nil {
+		if remembered := inventory.Bulbs(); len(remembered) > 0 {
+			logger.Info("offering remembered bulbs while discovery refreshes them", slog.Int("count", len(remembered)))
+			discovered := make(chan *yeelight.Bulb)
+			go refreshInventory(ctx, logger, inventory, discovered)
+			return remembered, discovered, nil
+		}
+	}
+
+	bulbs, err = yeelight.Discover(ctx, yeelight.DiscoverOptions{})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if len(bulbs) == 0 {
-		return nil, eris.New("no bulbs available")
+		return nil, nil, eris.New("no bulbs available")
 	}
-	return bulbs, nil
+	rememberBulbs(logger, inventory, bulbs)
+	return bulbs, nil, nil
 }
 
-func runReactiveLoop(ctx context.Context, logger *slog.Logger, bulb *yeelight.MusicModeBulb, cfg loopConfig) error {
+func newBulbAt(inventory *yeelight.Inventory, addr string) (*yeelight.Bulb, error) {
+	if inventory == nil {
+		return yeelight.NewBulbFromAddress(addr)
+	}
+	return inventory.BulbAt(addr)
+}
+
+func watchBulbs(ctx context.Context, logger *slog.Logger, registry *yeelight.Registry) {
+	go func() {
+		if err := registry.Watch(ctx); err != nil && !eris.Is(err, context.Canceled) {
+			logger.Warn("bulb advertisement listener stopped", slog.Any("error", err))
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-registry.Events():
+			logger.Info("bulb "+event.Type.String(),
+				slog.String("id", event.ID),
+				slog.String("name", event.Bulb.Name()),
+				slog.String("addr", event.Bulb.Addr().String()),
+			)
+		}
+	}
+}
+
+func runReactiveLoop(ctx context.Context, logger *slog.Logger, bulb controller.Light, opts controller.Options, cfg loopConfig) error {
 	loopCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
@@ -195,7 +445,7 @@ func runReactiveLoop(ctx context.Context, logger *slog.Logger, bulb *yeelight.Mu
 		defer viz.Close()
 	}
 
-	ledCtrl := controller.NewLEDController(bulb, logger, viz)
+	ledCtrl := controller.NewLEDController(bulb, logger, viz, opts)
 
 	g, gctx := errgroup.WithContext(loopCtx)
 
@@ -294,9 +544,3 @@ func captureAudio(ctx context.Context, logger *slog.Logger, out chan []float32,
 	<-ctx.Done()
 	return ctx.Err()
 }
-
-func randomMusicModePort() uint16 {
-	const base = 55000
-	const span = 5000
-	return uint16(base + rng.Intn(span))
-}
@@ -0,0 +1,262 @@
+package controller
+
+import (
+	"context"
+	"math"
+
+	"github.com/rotisserie/eris"
+
+	"github.com/cybre/yeelight-music-sync/internal/dsp"
+	"github.com/cybre/yeelight-music-sync/internal/patterns"
+	"github.com/cybre/yeelight-music-sync/internal/utils"
+	"github.com/cybre/yeelight-music-sync/internal/yeelight"
+)
+
+// Role is the part of the music a zone follows.
+type Role string
+
+const (
+	// RoleMix follows the full mix, like a single lamp does.
+	RoleMix Role = "mix"
+	// RoleBass glows warm with the low band.
+	RoleBass Role = "bass"
+	// RoleMids follows the mid band in greens and yellows.
+	RoleMids Role = "mids"
+	// RoleTreble follows the high band in cool blues.
+	RoleTreble Role = "treble"
+	// RoleBeat stays dim and flashes on beats, opposite the mix hue.
+	RoleBeat Role = "beat"
+)
+
+var ErrRoleInvalid = eris.New("role must be mix, bass, mids, treble or beat")
+
+// ParseRole parses the name of a role.
+func ParseRole(name string) (Role, error) {
+	role := Role(name)
+	switch role {
+	case RoleMix, RoleBass, RoleMids, RoleTreble, RoleBeat:
+		return role, nil
+	default:
+		return "", eris.Wrapf(ErrRoleInvalid, "%q", name)
+	}
+}
+
+// MapperParams tune how a zone turns its role into light. Zero values use the defaults.
+type MapperParams struct {
+	// Gain scales the energy the zone reacts to. Defaults to 1.
+	Gain float64
+	// HueOffset rotates the zone's hue, in degrees.
+	HueOffset float64
+	// MinBrightness and MaxBrightness bound the zone's brightness, in percent. They
+	// default to 1 and 100.
+	MinBrightness float64
+	MaxBrightness float64
+}
+
+func (p MapperParams) withDefaults() MapperParams {
+	if p.Gain <= 0 {
+		p.Gain = 1
+	}
+	if p.MinBrightness <= 0 {
+		p.MinBrightness = 1
+	}
+	if p.MaxBrightness <= 0 || p.MaxBrightness > 100 {
+		p.MaxBrightness = 100
+	}
+	p.MinBrightness = min(p.MinBrightness, p.MaxBrightness)
+
+	return p
+}
+
+// Zone is a light placed in the room with its own role, such as one bulb of a group.
+type Zone struct {
+	Light   Output
+	Role    Role
+	Params  MapperParams
+	Palette Palette
+}
+
+// zoneTarget is the light a zone should show for the current frame.
+type zoneTarget struct {
+	hue         float64
+	saturation  float64
+	brightness  float64
+	temperature float64
+}
+
+// zone holds the smoothing state and the last command of one Zone.
+type zone struct {
+	Zone
+
+	current        zoneTarget
+	initialized    bool
+	brightSmoother *dsp.Smoother
+	satSmoother    *dsp.Smoother
+	tempSmoother   *dsp.Smoother
+
+	lastHue        int
+	lastSat        int
+	lastBrightness int
+	lastTemp       int
+}
+
+func newZone(z Zone) *zone {
+	z.Params = z.Params.withDefaults()
+	if z.Role == "" {
+		z.Role = RoleMix
+	}
+
+	return &zone{
+		Zone:           z,
+		brightSmoother: dsp.NewSmoother(0.3),
+		satSmoother:    dsp.NewSmoother(0.16),
+		tempSmoother:   dsp.NewSmoother(0.18),
+	}
+}
+
+// target maps the frame onto the zone's role. mix is what a single lamp would show.
+func (z *zone) target(mix zoneTarget, bands [3]float64, beatPulse float64, state patterns.Output) zoneTarget {
+	gain := z.Params.Gain
+	energy := func(band float64) float64 {
+		return utils.Clamp(band*gain, 0.0, 1.0)
+	}
+
+	var t zoneTarget
+	switch z.Role {
+	case RoleBass:
+		e := energy(bands[0])
+		t = zoneTarget{
+			hue:         350 + 40*e,
+			saturation:  85 + 15*e,
+			brightness:  100 * utils.Clamp(e+0.3*beatPulse, 0.0, 1.0),
+			temperature: 1700 + 1300*e,
+		}
+	case RoleMids:
+		e := energy(bands[1])
+		t = zoneTarget{
+			hue:         60 + 90*e,
+			saturation:  60 + 35*e,
+			brightness:  100 * e,
+			temperature: 3200 + 1300*e,
+		}
+	case RoleTreble:
+		e := energy(bands[2])
+		t = zoneTarget{
+			hue:         180 + 90*e,
+			saturation:  50 + 50*e,
+			brightness:  100 * e,
+			temperature: 4800 + 1700*e,
+		}
+	case RoleBeat:
+		e := utils.Clamp(beatPulse*gain, 0.0, 1.0)
+		t = zoneTarget{
+			hue:         mix.hue + 180,
+			saturation:  100,
+			brightness:  100 * utils.Clamp(e+0.1*state.BeatDensity, 0.0, 1.0),
+			temperature: mix.temperature,
+		}
+	default:
+		t = mix
+		t.brightness = utils.Clamp(mix.brightness*gain, 0.0, 100.0)
+	}
+
+	t.hue = math.Mod(t.hue+z.Params.HueOffset+720, 360)
+	t.brightness = z.Params.MinBrightness + (z.Params.MaxBrightness-z.Params.MinBrightness)*utils.Clamp(t.brightness/100, 0.0, 1.0)
+	t.temperature = utils.Clamp(t.temperature, minWhiteTemperature, maxWhiteTemperature)
+
+	return t
+}
+
+// step smooths towards target. Beat zones skip brightness smoothing so flashes stay
+// sharp.
+func (z *zone) step(target zoneTarget) {
+	if !z.initialized {
+		z.current = target
+		z.initialized = true
+		return
+	}
+
+	z.current.hue = smoothHue(z.current.hue, target.hue, 0.25)
+	z.current.saturation = z.satSmoother.Step(target.saturation)
+	z.current.temperature = z.tempSmoother.Step(target.temperature)
+	if z.Role == RoleBeat {
+		z.current.brightness = target.brightness
+	} else {
+		z.current.brightness = z.brightSmoother.Step(target.brightness)
+	}
+}
+
+// levels quantizes the zone's current light the way it is sent to the bulb.
+func (z *zone) levels() (hue, sat, bright, temp int) {
+	hue = wrapHue(z.current.hue)
+	sat = utils.Clamp(int(math.Round(z.current.saturation)), 0, 100)
+	bright = utils.Clamp(int(math.Round(z.current.brightness)), 1, 100)
+	temp = utils.Clamp(int(math.Round(z.current.temperature/whiteTemperatureStep))*whiteTemperatureStep, minWhiteTemperature, maxWhiteTemperature)
+	return hue, sat, bright, temp
+}
+
+// pending reports whether the lamp shows something other than the zone's current light.
+func (z *zone) pending() bool {
+	hue, sat, bright, temp := z.levels()
+
+	switch z.Palette {
+	case PaletteColor:
+		return bright != z.lastBrightness || hue != z.lastHue || sat != z.lastSat
+	case PaletteWhite:
+		return bright != z.lastBrightness || temp != z.lastTemp
+	default:
+		return bright != z.lastBrightness
+	}
+}
+
+func (z *zone) send(ctx context.Context, effect yeelight.Effect, duration int) error {
+	hue, sat, bright, temp := z.levels()
+
+	var err error
+	switch z.Palette {
+	case PaletteBrightness:
+		err = z.Light.SetBrightness(ctx, uint8(bright), effect, duration)
+	case PaletteWhite:
+		err = z.Light.SetWhite(ctx, uint16(temp), uint8(bright), effect, duration)
+	default:
+		err = z.Light.SetHSV(ctx, uint16(hue), uint8(sat), uint8(bright), effect, duration)
+	}
+	if err != nil {
+		return err
+	}
+
+	z.lastHue, z.lastSat, z.lastBrightness, z.lastTemp = hue, sat, bright, temp
+
+	return nil
+}
+
+func zonesPending(zones []*zone) bool {
+	for _, z := range zones {
+		if z.pending() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sendZones updates every zone that changed and stops at the first error.
+func sendZones(ctx context.Context, zones []*zone, effect yeelight.Effect, duration int) error {
+	for _, z := range zones {
+		if !z.pending() {
+			continue
+		}
+		if err := z.send(ctx, effect, duration); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resetZones forces a fresh command to every zone, after output was paused.
+func resetZones(zones []*zone) {
+	for _, z := range zones {
+		z.lastBrightness = -1
+	}
+}
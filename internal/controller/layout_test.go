@@ -0,0 +1,151 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cybre/yeelight-music-sync/internal/patterns"
+	"github.com/cybre/yeelight-music-sync/internal/yeelight"
+)
+
+// recordingOutput records the last command sent to it.
+type recordingOutput struct {
+	command string
+}
+
+func (o *recordingOutput) SetHSV(_ context.Context, hue uint16, saturation, value uint8, _ yeelight.Effect, _ int) error {
+	o.command = fmt.Sprintf("hsv %d %d %d", hue, saturation, value)
+	return nil
+}
+
+func (o *recordingOutput) SetBrightness(_ context.Context, brightness uint8, _ yeelight.Effect, _ int) error {
+	o.command = fmt.Sprintf("bright %d", brightness)
+	return nil
+}
+
+func (o *recordingOutput) SetWhite(_ context.Context, temperature uint16, brightness uint8, _ yeelight.Effect, _ int) error {
+	o.command = fmt.Sprintf("white %d %d", temperature, brightness)
+	return nil
+}
+
+func TestParseRole(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    Role
+		wantErr bool
+	}{
+		{name: "mix", want: RoleMix},
+		{name: "bass", want: RoleBass},
+		{name: "mids", want: RoleMids},
+		{name: "treble", want: RoleTreble},
+		{name: "beat", want: RoleBeat},
+		{name: "Bass", wantErr: true},
+		{name: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			role, err := ParseRole(tt.name)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrRoleInvalid)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, role)
+		})
+	}
+}
+
+func TestMapperParamsDefaults(t *testing.T) {
+	tests := []struct {
+		name   string
+		params MapperParams
+		want   MapperParams
+	}{
+		{name: "zero", want: MapperParams{Gain: 1, MinBrightness: 1, MaxBrightness: 100}},
+		{
+			name:   "kept",
+			params: MapperParams{Gain: 2, HueOffset: 90, MinBrightness: 10, MaxBrightness: 60},
+			want:   MapperParams{Gain: 2, HueOffset: 90, MinBrightness: 10, MaxBrightness: 60},
+		},
+		{
+			name:   "out of range",
+			params: MapperParams{Gain: -1, MinBrightness: 80, MaxBrightness: 150},
+			want:   MapperParams{Gain: 1, MinBrightness: 80, MaxBrightness: 100},
+		},
+		{
+			name:   "min above max",
+			params: MapperParams{MinBrightness: 70, MaxBrightness: 40},
+			want:   MapperParams{Gain: 1, MinBrightness: 40, MaxBrightness: 40},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.params.withDefaults())
+		})
+	}
+}
+
+func TestZoneTarget(t *testing.T) {
+	mix := zoneTarget{hue: 200, saturation: 70, brightness: 50, temperature: 4000}
+	bands := [3]float64{1, 0.5, 0}
+
+	tests := []struct {
+		name string
+		zone Zone
+		want zoneTarget
+	}{
+		{name: "default role follows the mix", zone: Zone{}, want: zoneTarget{hue: 200, saturation: 70, brightness: 50.5, temperature: 4000}},
+		{name: "mix gain", zone: Zone{Role: RoleMix, Params: MapperParams{Gain: 2}}, want: zoneTarget{hue: 200, saturation: 70, brightness: 100, temperature: 4000}},
+		{name: "bass", zone: Zone{Role: RoleBass}, want: zoneTarget{hue: 30, saturation: 100, brightness: 100, temperature: 3000}},
+		{name: "mids", zone: Zone{Role: RoleMids}, want: zoneTarget{hue: 105, saturation: 77.5, brightness: 50.5, temperature: 3850}},
+		{name: "treble", zone: Zone{Role: RoleTreble}, want: zoneTarget{hue: 180, saturation: 50, brightness: 1, temperature: 4800}},
+		{name: "beat", zone: Zone{Role: RoleBeat}, want: zoneTarget{hue: 20, saturation: 100, brightness: 1, temperature: 4000}},
+		{
+			name: "bass with params",
+			zone: Zone{Role: RoleBass, Params: MapperParams{Gain: 0.5, HueOffset: 30, MaxBrightness: 60}},
+			want: zoneTarget{hue: 40, saturation: 92.5, brightness: 30.5, temperature: 2350},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := newZone(tt.zone).target(mix, bands, 0, patterns.Output{})
+			assert.InDelta(t, tt.want.hue, got.hue, 1e-9)
+			assert.InDelta(t, tt.want.saturation, got.saturation, 1e-9)
+			assert.InDelta(t, tt.want.brightness, got.brightness, 1e-9)
+			assert.InDelta(t, tt.want.temperature, got.temperature, 1e-9)
+		})
+	}
+}
+
+func TestZoneSendsItsPalette(t *testing.T) {
+	target := zoneTarget{hue: 120, saturation: 80, brightness: 40, temperature: 2720}
+
+	tests := []struct {
+		palette Palette
+		want    string
+	}{
+		{palette: PaletteColor, want: "hsv 120 80 40"},
+		{palette: PaletteWhite, want: "white 2700 40"},
+		{palette: PaletteBrightness, want: "bright 40"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.palette.String(), func(t *testing.T) {
+			output := &recordingOutput{}
+			z := newZone(Zone{Light: output, Palette: tt.palette})
+			z.step(target)
+
+			assert.True(t, z.pending())
+			require.NoError(t, sendZones(t.Context(), []*zone{z}, yeelight.Sudden, 0))
+			assert.Equal(t, tt.want, output.command)
+			assert.False(t, z.pending())
+		})
+	}
+}
@@ -2,10 +2,13 @@ package controller
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
 	"math"
 	"time"
 
+	"github.com/rotisserie/eris"
+
 	"github.com/cybre/yeelight-music-sync/internal/dsp"
 	"github.com/cybre/yeelight-music-sync/internal/patterns"
 	"github.com/cybre/yeelight-music-sync/internal/ui"
@@ -13,28 +16,150 @@ import (
 	"github.com/cybre/yeelight-music-sync/internal/yeelight"
 )
 
-// LEDController drives the Yeelight music mode using analyzed audio features.
+// ColorLight is a single light the controller can color, such as the background ring of
+// a dual-light ceiling lamp.
+type ColorLight interface {
+	SetHSV(ctx context.Context, hue uint16, saturation uint8, value uint8, effect yeelight.Effect, duration int) error
+}
+
+// Output is a light the controller can drive in any palette, such as one zone of a
+// multi-bulb layout.
+type Output interface {
+	ColorLight
+	SetBrightness(ctx context.Context, brightness uint8, effect yeelight.Effect, duration int) error
+	SetWhite(ctx context.Context, colorTemperature uint16, brightness uint8, effect yeelight.Effect, duration int) error
+}
+
+// Light is the part of a Yeelight connection the controller drives. Both the music
+// mode connection and the plain control connection satisfy it.
+type Light interface {
+	Output
+	ConnectionStates(ctx context.Context) <-chan yeelight.ConnectionState
+	Subscribe(ctx context.Context) <-chan yeelight.PropertyChange
+	Info() yeelight.BulbInfo
+}
+
+// Palette is what the controller asks the main light to show.
+type Palette int
+
+const (
+	// PaletteColor drives hue, saturation and brightness.
+	PaletteColor Palette = iota
+	// PaletteBrightness only pulses brightness, for bulbs that cannot show color.
+	PaletteBrightness
+	// PaletteWhite drives brightness and color temperature, for white-spectrum bulbs:
+	// warmer on bass, cooler on treble.
+	PaletteWhite
+)
+
+const (
+	minWhiteTemperature = 1700
+	maxWhiteTemperature = 6500
+	// whiteTemperatureStep is the smallest temperature change worth a command.
+	whiteTemperatureStep = 50
+)
+
+func (p Palette) String() string {
+	switch p {
+	case PaletteColor:
+		return "color"
+	case PaletteBrightness:
+		return "brightness"
+	case PaletteWhite:
+		return "white"
+	default:
+		return "unknown"
+	}
+}
+
+// PaletteFor picks the richest palette the advertised methods of every given bulb can
+// show, so a group looks alike.
+func PaletteFor(infos ...yeelight.BulbInfo) Palette {
+	palette := PaletteColor
+	for _, info := range infos {
+		switch {
+		case info.HasColor():
+		case info.HasColorTemperature():
+			palette = PaletteWhite
+		default:
+			return PaletteBrightness
+		}
+	}
+
+	return palette
+}
+
+// Options tunes how often and how the controller sends updates to the bulb.
+type Options struct {
+	// MinCommandSpacing is the minimum time between two commands.
+	MinCommandSpacing time.Duration
+	// Effect is the transition effect used for every update.
+	Effect yeelight.Effect
+	// TransitionDuration is how long a smooth transition takes.
+	TransitionDuration time.Duration
+	// Palette selects what the main light shows. The zero value drives full color.
+	Palette Palette
+	// Background, when set, is driven independently of the main light: it pulses with
+	// the bass while the main light follows the full mix. Both lights share
+	// MinCommandSpacing and take turns when both need an update.
+	Background ColorLight
+	// Zones, when set, replace the main light: each zone follows its own role and is
+	// updated together with the others whenever the main light would be.
+	Zones []Zone
+}
+
+// QuotaOptions returns options for driving a bulb over its plain control connection.
+// Updates are spaced slightly wider than the quota refill rate times the commands each
+// update takes, and each one fades smoothly into the next, so the lamp still follows the
+// music at a coarser granularity.
+func QuotaOptions(quota yeelight.QuotaStatus, commandsPerUpdate int) Options {
+	perCommand := quota.RefillInterval + quota.RefillInterval/10
+	spacing := time.Duration(max(commandsPerUpdate, 1)) * perCommand
+
+	return Options{
+		MinCommandSpacing:  spacing,
+		Effect:             yeelight.Smooth,
+		TransitionDuration: spacing,
+	}
+}
+
+// LEDController drives a Yeelight bulb using analyzed audio features.
 type LEDController struct {
-	bulb   *yeelight.MusicModeBulb
+	bulb   Light
 	logger *slog.Logger
 	viz    *ui.Visualizer
+	opts   Options
 
 	hue          float64
 	saturation   float64
 	brightness   float64
 	beatPulse    float64
 	sparkleLevel float64
+	ringHue      float64
+	ringBright   float64
+	temperature  float64
+
+	initialized    bool
+	paused         bool
+	switchedOff    bool
+	lastCommand    time.Time
+	lastHue        int
+	lastSat        int
+	lastBrightness int
+	lastTemp       int
+
+	lastRingHue        int
+	lastRingSat        int
+	lastRingBrightness int
+	ringTurn           bool
 
-	initialized       bool
-	lastCommand       time.Time
-	minCommandSpacing time.Duration
-	lastHue           int
-	lastSat           int
-	lastBrightness    int
+	zones []*zone
 
 	satSmoother      *dsp.Smoother
 	brightSmoother   *dsp.Smoother
 	sparkleSmoother  *dsp.Smoother
+	ringSmoother     *dsp.Smoother
+	tempSmoother     *dsp.Smoother
 	bandSmoothers    [3]*dsp.Smoother
 	smoothedBands    [3]float64
 	centroidSmoother *dsp.Smoother
@@ -43,24 +168,40 @@ type LEDController struct {
 	rolloffValue     float64
 }
 
-// NewLEDController constructs a controller with smoothing defaults.
-func NewLEDController(bulb *yeelight.MusicModeBulb, logger *slog.Logger, viz *ui.Visualizer) *LEDController {
+// NewLEDController constructs a controller with smoothing defaults. Zero options suit
+// music mode: sudden changes at most every 25ms.
+func NewLEDController(bulb Light, logger *slog.Logger, viz *ui.Visualizer, opts Options) *LEDController {
+	if opts.MinCommandSpacing <= 0 {
+		opts.MinCommandSpacing = 25 * time.Millisecond
+	}
+	if opts.Effect == "" {
+		opts.Effect = yeelight.Sudden
+	}
+
 	var bandSmoothers [3]*dsp.Smoother
 	for i := range bandSmoothers {
 		bandSmoothers[i] = dsp.NewSmoother(0.14)
 	}
 
+	zones := make([]*zone, len(opts.Zones))
+	for i, z := range opts.Zones {
+		zones[i] = newZone(z)
+	}
+
 	return &LEDController{
-		bulb:              bulb,
-		logger:            logger,
-		viz:               viz,
-		minCommandSpacing: 25 * time.Millisecond,
-		satSmoother:       dsp.NewSmoother(0.16),
-		brightSmoother:    dsp.NewSmoother(0.22),
-		sparkleSmoother:   dsp.NewSmoother(0.14),
-		bandSmoothers:     bandSmoothers,
-		centroidSmoother:  dsp.NewSmoother(0.12),
-		rolloffSmoother:   dsp.NewSmoother(0.1),
+		bulb:             bulb,
+		logger:           logger,
+		viz:              viz,
+		opts:             opts,
+		satSmoother:      dsp.NewSmoother(0.16),
+		brightSmoother:   dsp.NewSmoother(0.22),
+		sparkleSmoother:  dsp.NewSmoother(0.14),
+		ringSmoother:     dsp.NewSmoother(0.3),
+		tempSmoother:     dsp.NewSmoother(0.18),
+		bandSmoothers:    bandSmoothers,
+		centroidSmoother: dsp.NewSmoother(0.12),
+		rolloffSmoother:  dsp.NewSmoother(0.1),
+		zones:            zones,
 	}
 }
 
@@ -69,10 +210,25 @@ func (c *LEDController) Run(ctx context.Context, in <-chan dsp.Features, analyze
 	debugTicker := time.NewTicker(2 * time.Second)
 	defer debugTicker.Stop()
 
+	states := c.bulb.ConnectionStates(ctx)
+	changes := c.bulb.Subscribe(ctx)
+
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
+		case state, ok := <-states:
+			if !ok {
+				states = nil
+				continue
+			}
+			c.setConnectionState(state)
+		case change, ok := <-changes:
+			if !ok {
+				changes = nil
+				continue
+			}
+			c.handlePropertyChange(change)
 		case features, ok := <-in:
 			if !ok {
 				return nil
@@ -86,6 +242,7 @@ func (c *LEDController) Run(ctx context.Context, in <-chan dsp.Features, analyze
 				slog.Float64("hue", c.hue),
 				slog.Float64("sat", c.saturation),
 				slog.Float64("brightness", c.brightness),
+				slog.Float64("temperature", c.temperature),
 				slog.Float64("sparkle", c.sparkleLevel))
 		}
 	}
@@ -120,15 +277,30 @@ func (c *LEDController) apply(ctx context.Context, features dsp.Features, state
 		targetBright = energyPulseBrightness(state.Intensity, c.beatPulse, c.sparkleLevel)
 	}
 
+	ringTargetHue := bassRingHue(targetHue, c.smoothedBands[0])
+	ringTargetBright := bassRingBrightness(c.smoothedBands[0], c.beatPulse)
+	targetTemp := whiteTemperature(c.smoothedBands[0], c.smoothedBands[2], c.centroidValue)
+
 	if !c.initialized {
 		c.hue = targetHue
 		c.saturation = targetSat
 		c.brightness = targetBright
+		c.ringHue = ringTargetHue
+		c.ringBright = ringTargetBright
+		c.temperature = targetTemp
 		c.initialized = true
 	} else {
 		c.hue = smoothHue(c.hue, targetHue, 0.22)
 		c.saturation = c.satSmoother.Step(targetSat)
 		c.brightness = c.brightSmoother.Step(targetBright)
+		c.ringHue = smoothHue(c.ringHue, ringTargetHue, 0.3)
+		c.ringBright = c.ringSmoother.Step(ringTargetBright)
+		c.temperature = c.tempSmoother.Step(targetTemp)
+	}
+
+	mix := zoneTarget{hue: c.hue, saturation: c.saturation, brightness: c.brightness, temperature: c.temperature}
+	for _, z := range c.zones {
+		z.step(z.target(mix, c.smoothedBands, c.beatPulse, state))
 	}
 
 	if c.viz != nil {
@@ -148,32 +320,165 @@ func (c *LEDController) apply(ctx context.Context, features dsp.Features, state
 			Centroid:     c.centroidValue,
 			Rolloff:      c.rolloffValue,
 			Mode:         state.Mode.String(),
+			Lamp:         c.describeLamp(),
 		})
 	}
 
-	hueInt := int(math.Round(c.hue)) % 360
-	if hueInt < 0 {
-		hueInt += 360
-	}
+	hueInt := wrapHue(c.hue)
 	satInt := utils.Clamp(int(math.Round(c.saturation)), 0, 100)
 	brightInt := utils.Clamp(int(math.Round(c.brightness)), 1, 100)
+	tempInt := utils.Clamp(int(math.Round(c.temperature/whiteTemperatureStep))*whiteTemperatureStep, minWhiteTemperature, maxWhiteTemperature)
+
+	ringHueInt := wrapHue(c.ringHue)
+	ringSatInt := utils.Clamp(int(math.Round(bassRingSaturation(c.smoothedBands[0]))), 0, 100)
+	ringBrightInt := utils.Clamp(int(math.Round(c.ringBright)), 1, 100)
 
-	if time.Since(c.lastCommand) < c.minCommandSpacing {
+	if c.paused || c.switchedOff {
 		return nil
 	}
-	if hueInt == c.lastHue && satInt == c.lastSat && brightInt == c.lastBrightness {
+	if time.Since(c.lastCommand) < c.opts.MinCommandSpacing {
 		return nil
 	}
 
-	if err := c.bulb.SetHSV(ctx, uint16(hueInt), uint8(satInt), uint8(brightInt), yeelight.Sudden, 0); err != nil {
+	mainChanged := brightInt != c.lastBrightness
+	switch c.opts.Palette {
+	case PaletteColor:
+		mainChanged = mainChanged || hueInt != c.lastHue || satInt != c.lastSat
+	case PaletteWhite:
+		mainChanged = mainChanged || tempInt != c.lastTemp
+	}
+	if len(c.zones) > 0 {
+		mainChanged = zonesPending(c.zones)
+	}
+	ringChanged := c.opts.Background != nil &&
+		(ringHueInt != c.lastRingHue || ringSatInt != c.lastRingSat || ringBrightInt != c.lastRingBrightness)
+
+	if ringChanged && (!mainChanged || c.ringTurn) {
+		c.ringTurn = false
+		sent, err := c.send(func(duration int) error {
+			return c.opts.Background.SetHSV(ctx, uint16(ringHueInt), uint8(ringSatInt), uint8(ringBrightInt), c.opts.Effect, duration)
+		})
+		if sent {
+			c.lastRingHue = ringHueInt
+			c.lastRingSat = ringSatInt
+			c.lastRingBrightness = ringBrightInt
+		}
 		return err
 	}
+	if !mainChanged {
+		return nil
+	}
+
+	c.ringTurn = true
+	sent, err := c.send(func(duration int) error {
+		if len(c.zones) > 0 {
+			return sendZones(ctx, c.zones, c.opts.Effect, duration)
+		}
+
+		switch c.opts.Palette {
+		case PaletteBrightness:
+			return c.bulb.SetBrightness(ctx, uint8(brightInt), c.opts.Effect, duration)
+		case PaletteWhite:
+			return c.bulb.SetWhite(ctx, uint16(tempInt), uint8(brightInt), c.opts.Effect, duration)
+		default:
+			return c.bulb.SetHSV(ctx, uint16(hueInt), uint8(satInt), uint8(brightInt), c.opts.Effect, duration)
+		}
+	})
+	if sent {
+		c.lastHue = hueInt
+		c.lastSat = satInt
+		c.lastBrightness = brightInt
+		c.lastTemp = tempInt
+	}
+	return err
+}
 
-	c.lastHue = hueInt
-	c.lastSat = satInt
-	c.lastBrightness = brightInt
+// send issues one command with the configured transition duration. It reports whether
+// the bulb took the command; losing the connection, running out of quota or a reply
+// that is late is not an error.
+func (c *LEDController) send(command func(duration int) error) (bool, error) {
+	err := command(int(c.opts.TransitionDuration.Milliseconds()))
 	c.lastCommand = time.Now()
-	return nil
+	if err != nil {
+		if eris.Is(err, yeelight.ErrConnectionLost) {
+			c.setConnectionState(yeelight.StateReconnecting)
+			return false, nil
+		}
+		if eris.Is(err, yeelight.ErrQuotaExceeded) {
+			c.logger.Debug("bulb command quota exhausted, skipping update", slog.Any("error", err))
+			return false, nil
+		}
+		if eris.Is(err, yeelight.ErrTimeout) {
+			c.logger.Debug("bulb did not answer in time, skipping update", slog.Any("error", err))
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// handlePropertyChange pauses output while someone else has switched the lamp off, for
+// example from the phone app, and resumes once it is switched back on.
+func (c *LEDController) handlePropertyChange(change yeelight.PropertyChange) {
+	if change.Property != yeelight.PropertyPower || change.Background {
+		return
+	}
+
+	switchedOff := change.Info.Power() == yeelight.PowerOff
+	if switchedOff == c.switchedOff {
+		return
+	}
+
+	c.switchedOff = switchedOff
+	if switchedOff {
+		c.logger.Warn("bulb was switched off, pausing light output")
+		return
+	}
+
+	c.logger.Info("bulb was switched on, resuming light output")
+	c.lastBrightness = -1
+	c.lastRingBrightness = -1
+	resetZones(c.zones)
+}
+
+// setConnectionState pauses output while the bulb connection is down and forces a
+// fresh command once it is back.
+func (c *LEDController) setConnectionState(state yeelight.ConnectionState) {
+	paused := state != yeelight.StateConnected
+	if paused == c.paused {
+		return
+	}
+
+	c.paused = paused
+	if paused {
+		c.logger.Warn("bulb connection unavailable, pausing light output", slog.String("state", state.String()))
+		return
+	}
+
+	c.logger.Info("bulb connection restored, resuming light output")
+	c.lastBrightness = -1
+	c.lastRingBrightness = -1
+	resetZones(c.zones)
+}
+
+// describeLamp summarizes the state the bulb last reported, which can differ from what
+// the controller is sending while output is paused.
+func (c *LEDController) describeLamp() string {
+	info := c.bulb.Info()
+
+	switch {
+	case c.paused:
+		return "reconnecting"
+	case info.Power() == yeelight.PowerOff:
+		return "off"
+	case info.Power() == yeelight.PowerOn && info.ColorMode() == yeelight.ColorModeTemperature:
+		return fmt.Sprintf("on %d%% %dK", info.Brightness(), info.ColorTemperature())
+	case info.Power() == yeelight.PowerOn:
+		return fmt.Sprintf("on %d%%", info.Brightness())
+	default:
+		return "unknown"
+	}
 }
 
 func energyPulseHue(bands [3]float64, centroid float64, lowMidBalance float64, beatPulse float64) float64 {
@@ -208,6 +513,35 @@ func spectrumFlowBrightness(high, intensity, beatPulse, sparkle float64) float64
 	return utils.Clamp(34+56*intensity+22*high+12*beatPulse+20*sparkle, 10.0, 100.0)
 }
 
+// bassRingHue keeps the background light opposite the main hue, warming as the bass
+// gets stronger.
+func bassRingHue(mainHue, bass float64) float64 {
+	return math.Mod(mainHue+180-90*bass, 360)
+}
+
+func bassRingSaturation(bass float64) float64 {
+	return utils.Clamp(70+30*bass, 0.0, 100.0)
+}
+
+func bassRingBrightness(bass, beatPulse float64) float64 {
+	return utils.Clamp(6+70*bass+40*beatPulse, 1.0, 100.0)
+}
+
+// whiteTemperature maps the mix onto white light: bass pulls towards warm candlelight,
+// treble and a bright spectrum towards cool daylight.
+func whiteTemperature(bass, treble, centroid float64) float64 {
+	coolness := utils.Clamp(0.45-0.55*bass+0.5*treble+0.25*(centroid-0.5), 0.0, 1.0)
+	return minWhiteTemperature + coolness*(maxWhiteTemperature-minWhiteTemperature)
+}
+
+func wrapHue(hue float64) int {
+	h := int(math.Round(hue)) % 360
+	if h < 0 {
+		h += 360
+	}
+	return h
+}
+
 func smoothHue(current, target, alpha float64) float64 {
 	delta := math.Mod(target-current+540, 360) - 180
 	return math.Mod(current+alpha*delta+360, 360)
@@ -0,0 +1,25 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cybre/yeelight-music-sync/internal/yeelight"
+)
+
+func TestQuotaOptionsSpacesEveryCommand(t *testing.T) {
+	quota := yeelight.QuotaStatus{Available: 10, Burst: 10, RefillInterval: time.Second}
+
+	single := QuotaOptions(quota, yeelight.ColorStrategyFlow.Commands())
+	assert.Equal(t, 1100*time.Millisecond, single.MinCommandSpacing)
+	assert.Equal(t, single.MinCommandSpacing, single.TransitionDuration)
+	assert.Equal(t, yeelight.Smooth, single.Effect)
+
+	double := QuotaOptions(quota, yeelight.ColorStrategyRGB.Commands())
+	assert.Equal(t, 2200*time.Millisecond, double.MinCommandSpacing)
+	assert.Equal(t, double.MinCommandSpacing, double.TransitionDuration)
+
+	assert.Equal(t, single, QuotaOptions(quota, 0))
+}
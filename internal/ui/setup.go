@@ -2,6 +2,7 @@ package ui
 
 import (
 	"os"
+	"slices"
 	"strings"
 
 	tea "github.com/charmbracelet/bubbletea"
@@ -58,17 +59,21 @@ type SetupConfig struct {
 	RequireDevice bool
 	InitialBulb   int
 	InitialDevice int
+	// MoreBulbs, when set, delivers bulbs found while the list is shown. They are
+	// appended to it, so indexes into the original list stay valid.
+	MoreBulbs <-chan Option
 }
 
 type SetupResult struct {
-	BulbIndex   int
+	// BulbIndexes are the selected bulbs in list order. There is always at least one.
+	BulbIndexes []int
 	DeviceIndex int
 }
 
 func RunSetup(bulbs []Option, devices []Option, cfg SetupConfig) (SetupResult, error) {
 	if !cfg.RequireBulb && !cfg.RequireDevice {
 		return SetupResult{
-			BulbIndex:   utils.ClampIndex(cfg.InitialBulb, len(bulbs)),
+			BulbIndexes: []int{utils.ClampIndex(cfg.InitialBulb, len(bulbs))},
 			DeviceIndex: utils.ClampIndex(cfg.InitialDevice, len(devices)),
 		}, nil
 	}
@@ -89,11 +94,26 @@ func RunSetup(bulbs []Option, devices []Option, cfg SetupConfig) (SetupResult, e
 	}
 
 	return SetupResult{
-		BulbIndex:   utils.ClampIndex(result.bulbIndex, len(bulbs)),
+		BulbIndexes: result.selectedBulbs(),
 		DeviceIndex: utils.ClampIndex(result.deviceIndex, len(devices)),
 	}, nil
 }
 
+// bulbFoundMsg carries a bulb that arrived on SetupConfig.MoreBulbs.
+type bulbFoundMsg Option
+
+// waitForBulb receives the next bulb from more. It yields no message once more is
+// closed.
+func waitForBulb(more <-chan Option) tea.Cmd {
+	return func() tea.Msg {
+		bulb, ok := <-more
+		if !ok {
+			return nil
+		}
+		return bulbFoundMsg(bulb)
+	}
+}
+
 type setupStep int
 
 const (
@@ -112,7 +132,10 @@ type setupModel struct {
 	cursor      int
 	bulbIndex   int
 	deviceIndex int
-	err         error
+	// checked marks the bulbs picked with space. When none are, the bulb under the
+	// cursor is used.
+	checked []bool
+	err     error
 }
 
 func newSetupModel(bulbs []Option, devices []Option, cfg SetupConfig) setupModel {
@@ -122,6 +145,7 @@ func newSetupModel(bulbs []Option, devices []Option, cfg SetupConfig) setupModel
 		cfg:         cfg,
 		bulbIndex:   utils.ClampIndex(cfg.InitialBulb, len(bulbs)),
 		deviceIndex: utils.ClampIndex(cfg.InitialDevice, len(devices)),
+		checked:     make([]bool, len(bulbs)),
 	}
 
 	switch {
@@ -139,7 +163,10 @@ func newSetupModel(bulbs []Option, devices []Option, cfg SetupConfig) setupModel
 }
 
 func (m setupModel) Init() tea.Cmd {
-	return nil
+	if m.cfg.MoreBulbs == nil {
+		return nil
+	}
+	return waitForBulb(m.cfg.MoreBulbs)
 }
 
 func (m setupModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
@@ -148,6 +175,10 @@ func (m setupModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	}
 
 	switch msg := msg.(type) {
+	case bulbFoundMsg:
+		m.bulbs = append(m.bulbs, Option(msg))
+		m.checked = append(m.checked, false)
+		return m, waitForBulb(m.cfg.MoreBulbs)
 	case tea.KeyMsg:
 		switch msg.String() {
 		case "ctrl+c", "esc", "q":
@@ -163,6 +194,17 @@ func (m setupModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			if len(items) > 0 {
 				m.cursor = wrapIndex(m.cursor+1, len(items))
 			}
+		case " ", "x":
+			if m.step == stepSelectBulb && len(m.bulbs) > 0 {
+				m.checked[m.cursor] = !m.checked[m.cursor]
+			}
+		case "a":
+			if m.step == stepSelectBulb {
+				all := !slices.Contains(m.checked, false)
+				for i := range m.checked {
+					m.checked[i] = !all
+				}
+			}
 		case "tab", "right", "l":
 			switch m.step {
 			case stepSelectBulb:
@@ -253,7 +295,7 @@ func (m setupModel) currentItems() []Option {
 }
 
 func renderBulbView(m setupModel) string {
-	instructions := []string{"↑/k ↓/j move", "enter confirm"}
+	instructions := []string{"↑/k ↓/j move", "space/x pick", "a all", "enter confirm"}
 	if m.cfg.RequireDevice {
 		instructions = append(instructions, "tab/right continue")
 	}
@@ -261,9 +303,10 @@ func renderBulbView(m setupModel) string {
 
 	lines := []string{
 		"",
-		titleStyle.Render("Select a Yeelight bulb"),
+		titleStyle.Render("Select Yeelight bulbs"),
+		subtitleStyle.Render("Pick several to drive them together"),
 		"",
-		renderOptionList(m.bulbs, m.cursor),
+		renderOptionList(m.bulbs, m.cursor, m.checked),
 		"",
 		renderInstructions(instructions),
 		"",
@@ -284,15 +327,13 @@ func renderDeviceView(m setupModel) string {
 	}
 
 	if m.cfg.RequireBulb {
-		lines = append(lines,
-			"",
-			renderSummaryRow("Bulb", m.selectedBulbLabel()),
-		)
+		lines = append(lines, "")
+		lines = append(lines, m.renderBulbSummary()...)
 	}
 
 	lines = append(lines,
 		"",
-		renderOptionList(m.devices, m.cursor),
+		renderOptionList(m.devices, m.cursor, nil),
 		"",
 		renderInstructions(instructions),
 		"",
@@ -308,20 +349,41 @@ func renderSummaryView(m setupModel) string {
 		"",
 		titleStyle.Render("Ready to start"),
 		"",
-		renderSummaryRow("Bulb", m.selectedBulbLabel()),
+	}
+	lines = append(lines, m.renderBulbSummary()...)
+	lines = append(lines,
 		renderSummaryRow("Device", m.selectedDeviceLabel()),
 		"",
 		renderInstructions(instructions),
 		"",
-	}
+	)
 	return strings.Join(lines, "\n")
 }
 
-func (m setupModel) selectedBulbLabel() string {
-	if m.bulbIndex >= 0 && m.bulbIndex < len(m.bulbs) {
-		return m.bulbs[m.bulbIndex].Label
+// selectedBulbs returns the checked bulbs, or the last one confirmed if none are.
+func (m setupModel) selectedBulbs() []int {
+	var selected []int
+	for i, checked := range m.checked {
+		if checked {
+			selected = append(selected, i)
+		}
 	}
-	return "not selected"
+	if len(selected) == 0 {
+		selected = []int{utils.ClampIndex(m.bulbIndex, len(m.bulbs))}
+	}
+	return selected
+}
+
+func (m setupModel) renderBulbSummary() []string {
+	if len(m.bulbs) == 0 {
+		return []string{renderSummaryRow("Bulb", "not selected")}
+	}
+
+	var rows []string
+	for _, i := range m.selectedBulbs() {
+		rows = append(rows, renderSummaryRow("Bulb", m.bulbs[i].Label))
+	}
+	return rows
 }
 
 func (m setupModel) selectedDeviceLabel() string {
@@ -338,6 +400,13 @@ func renderPointer(active bool) string {
 	return inactivePointerStyle.Render(" ")
 }
 
+func renderCheckbox(checked bool) string {
+	if checked {
+		return "[x]"
+	}
+	return "[ ]"
+}
+
 func renderOptionLabel(text string, active bool) string {
 	if active {
 		return selectedItemStyle.Render(text)
@@ -345,17 +414,22 @@ func renderOptionLabel(text string, active bool) string {
 	return itemStyle.Render(text)
 }
 
-func renderOptionList(items []Option, cursor int) string {
+// renderOptionList draws items with the cursor. checked is nil for single-choice lists.
+func renderOptionList(items []Option, cursor int, checked []bool) string {
 	if len(items) == 0 {
 		return emptyStateStyle.Render("No options detected")
 	}
 
 	rows := make([]string, len(items))
 	for i, item := range items {
+		label := item.Label
+		if checked != nil {
+			label = renderCheckbox(checked[i]) + " " + label
+		}
 		rows[i] = lipgloss.JoinHorizontal(lipgloss.Left,
 			renderPointer(cursor == i),
 			" ",
-			renderOptionLabel(item.Label, cursor == i),
+			renderOptionLabel(label, cursor == i),
 		)
 	}
 	return lipgloss.JoinVertical(lipgloss.Left, rows...)
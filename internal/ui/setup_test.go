@@ -0,0 +1,26 @@
+package ui
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetupModelAppendsFoundBulbs(t *testing.T) {
+	more := make(chan Option, 1)
+	m := newSetupModel([]Option{{Label: "desk"}}, []Option{{Label: "mic"}}, SetupConfig{RequireBulb: true, MoreBulbs: more})
+
+	more <- Option{Label: "shelf"}
+	msg := m.Init()()
+	require.Equal(t, bulbFoundMsg{Label: "shelf"}, msg)
+
+	updated, cmd := m.Update(msg)
+	m = updated.(setupModel)
+	assert.Equal(t, []Option{{Label: "desk"}, {Label: "shelf"}}, m.bulbs)
+	assert.Len(t, m.checked, 2)
+	require.NotNil(t, cmd)
+
+	close(more)
+	assert.Nil(t, cmd())
+}
@@ -29,6 +29,7 @@ type VisualizerFrame struct {
 	Centroid     float64
 	Rolloff      float64
 	Mode         string
+	Lamp         string
 }
 
 type Visualizer struct {
@@ -183,6 +184,7 @@ func renderMetrics(frame VisualizerFrame) string {
 	mode := renderMetric("Mode", normalizeMode(frame.Mode))
 	intensity := renderMetric("Intensity", fmt.Sprintf("%4.2f", utils.Clamp(frame.Intensity, 0.0, 1.0)))
 	energy := renderMetric("Energy", fmt.Sprintf("%4.2f", utils.Clamp(frame.Energy, 0.0, 1.0)))
+	lamp := renderMetric("Lamp", normalizeLamp(frame.Lamp))
 
 	hsv := renderMetric("HSV", fmt.Sprintf("%3.0f°/%3.0f%%/%3.0f%%",
 		utils.Clamp(frame.Hue, 0.0, 359.0),
@@ -192,7 +194,7 @@ func renderMetrics(frame VisualizerFrame) string {
 	beat := renderBeatMetric(frame)
 	pulse := renderMetric("Beat Pulse", fmt.Sprintf("%4.2f", utils.Clamp(frame.BeatPulse, 0.0, 1.0)))
 
-	top := lipgloss.JoinHorizontal(lipgloss.Left, mode, "   ", intensity, "   ", energy)
+	top := lipgloss.JoinHorizontal(lipgloss.Left, mode, "   ", intensity, "   ", energy, "   ", lamp)
 	bottom := lipgloss.JoinHorizontal(lipgloss.Left, hsv, "   ", beat, "   ", pulse)
 
 	return lipgloss.JoinVertical(lipgloss.Left, top, bottom)
@@ -471,3 +473,11 @@ func (m *visualizerModel) invokeExit() {
 		}
 	})
 }
+
+func normalizeLamp(lamp string) string {
+	lamp = strings.TrimSpace(lamp)
+	if lamp == "" {
+		return "n/a"
+	}
+	return lamp
+}
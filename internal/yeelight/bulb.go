@@ -2,13 +2,12 @@ package yeelight
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log/slog"
 	"net"
-	"net/netip"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/rotisserie/eris"
@@ -19,95 +18,200 @@ const (
 	commandResponseTimeout = 3 * time.Second
 )
 
-type commandError struct {
-	Code    int    `json:"code"`
-	Message string `json:"message"`
-}
-
-func (e *commandError) Error() string {
-	return fmt.Sprintf("%s (%d)", e.Message, e.Code)
-}
-
-type commandResult struct {
-	ID     int           `json:"id"`
-	Result []string      `json:"result"`
-	Error  *commandError `json:"error"`
-}
-
-type notification struct {
-	Method string         `json:"method"`
-	Params map[string]any `json:"params"`
-}
-
 type Bulb struct {
 	bulbBase
-	results            chan commandResult
+
+	mu                 sync.Mutex
+	stopSupervisor     context.CancelFunc
 	musicContextCancel context.CancelFunc
 }
 
-func newBulb(addr netip.AddrPort) *Bulb {
-	results := make(chan commandResult)
-	return &Bulb{
+func newBulb(info BulbInfo) *Bulb {
+	bulb := &Bulb{
 		bulbBase: bulbBase{
-			bulbInfo: &bulbInfo{
-				addr: addr,
-			},
-			commandCallback: getCommandExecutionCallback(results, commandResponseTimeout),
+			bulbState: newBulbState(info),
+			states:    newConnectionStates(),
+			limiter:   newCommandLimiter(defaultQuotaBurst, restoreQuotaReserve(info), defaultQuotaRefillInterval),
 		},
-		results: results,
 	}
+	bulb.initLights()
+
+	return bulb
 }
 
+// Quota reports the remaining command budget of the control connection. Music mode is
+// not subject to the quota.
+func (bb *Bulb) Quota() QuotaStatus {
+	return bb.limiter.status()
+}
+
+// Connect opens the control connection. If it drops later, it is re-established with
+// exponential backoff until ctx is done or Disconnect is called; ConnectionStates
+// reports the transitions. The connection is closed once ctx is done.
 func (bb *Bulb) Connect(ctx context.Context) error {
-	conn, err := net.Dial("tcp", bb.Addr().String())
+	conn, err := dialBulb(ctx, bb.Addr().String(), bb.Timeouts().Dial)
 	if err != nil {
 		return eris.Wrap(err, "failed to connect connect to bulb")
 	}
 
-	bb.conn = conn
+	superviseCtx, stop := context.WithCancel(ctx)
+	bb.mu.Lock()
+	bb.stopSupervisor = stop
+	bb.mu.Unlock()
+
+	bb.attach(conn)
 
-	bb.listen(ctx)
+	go bb.supervise(superviseCtx)
+	go bb.pollProperties(superviseCtx)
 
 	return nil
 }
 
-func (bb *Bulb) EnableMusicMode(ctx context.Context, port uint16, callback func(context.Context, *MusicModeBulb) error) error {
-	localAddr := bb.conn.LocalAddr()
-	if localAddr == nil {
-		return eris.New("bulb is not connected")
+func (bb *Bulb) Disconnect() error {
+	bb.mu.Lock()
+	if bb.stopSupervisor != nil {
+		bb.stopSupervisor()
+		bb.stopSupervisor = nil
+	}
+	bb.mu.Unlock()
+
+	return bb.bulbBase.Disconnect()
+}
+
+func (bb *Bulb) attach(conn net.Conn) {
+	bb.conn.Store(bb.newControlConnection(conn))
+	bb.states.set(StateConnected)
+}
+
+// reattach replaces the dropped connection prev. It reports false, and closes conn, if
+// the bulb was disconnected in the meantime.
+func (bb *Bulb) reattach(prev *connection, conn net.Conn) bool {
+	next := bb.newControlConnection(conn)
+	if !bb.conn.CompareAndSwap(prev, next) {
+		next.close()
+		return false
+	}
+
+	bb.states.set(StateConnected)
+
+	return true
+}
+
+func (bb *Bulb) newControlConnection(conn net.Conn) *connection {
+	timeouts := bb.Timeouts()
+	return newConnection(conn, newPendingRequests(timeouts.Reply), timeouts.Write, bb.handleNotification)
+}
+
+func (bb *Bulb) supervise(ctx context.Context) {
+	addr := bb.Addr().String()
+
+	for {
+		conn, err := bb.connection()
+		if err != nil {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-conn.closed():
+		}
+
+		if ctx.Err() != nil {
+			bb.release(conn)
+			return
+		}
+		if bb.conn.Load() != conn {
+			return
+		}
+
+		bb.states.set(StateReconnecting)
+		slog.Warn("bulb connection lost, reconnecting", slog.String("addr", addr))
+
+		if !bb.reconnect(ctx, conn, addr) {
+			bb.release(conn)
+			return
+		}
 	}
+}
 
-	splitAddr := strings.Split(localAddr.String(), ":")
-	if len(splitAddr) != 2 {
-		return eris.New("invalid local address")
+// release closes conn if it is still the bulb's connection. The supervisor calls it when
+// the context passed to Connect ends, so the socket and its goroutines go with it even
+// if Disconnect is never called.
+func (bb *Bulb) release(conn *connection) {
+	if !bb.conn.CompareAndSwap(conn, nil) {
+		return
 	}
 
-	ip := splitAddr[0]
+	bb.states.set(StateDisconnected)
+	conn.close()
+}
+
+func (bb *Bulb) reconnect(ctx context.Context, prev *connection, addr string) bool {
+	retry := newBackoff()
 
-	ln, err := net.Listen("tcp", fmt.Sprintf("%s:%d", ip, port))
+	for attempt := 1; ; attempt++ {
+		if !sleepContext(ctx, retry.next()) {
+			return false
+		}
+
+		conn, err := dialBulb(ctx, addr, bb.Timeouts().Dial)
+		if err != nil {
+			slog.Warn("failed to reconnect to bulb",
+				slog.String("addr", addr),
+				slog.Int("attempt", attempt),
+				slog.Any("error", err),
+			)
+			continue
+		}
+
+		if !bb.reattach(prev, conn) {
+			return false
+		}
+
+		slog.Info("bulb reconnected", slog.String("addr", addr), slog.Int("attempts", attempt))
+
+		return true
+	}
+}
+
+// EnableMusicMode asks the bulb to dial back to a local listener and hands the resulting
+// connection to callback. If the music connection drops, set_music is re-issued with
+// backoff while the MusicModeBulb reports StateReconnecting.
+func (bb *Bulb) EnableMusicMode(ctx context.Context, opts MusicModeOptions, callback func(context.Context, *MusicModeBulb) error) error {
+	control, err := bb.connection()
 	if err != nil {
-		return eris.Wrap(err, "failed to start music mode listener")
+		return err
+	}
+
+	localAddr := control.localAddr()
+	if localAddr == nil {
+		return ErrNotConnected
 	}
-	defer ln.Close()
 
-	if _, err = bb.executeCommand(ctx, "set_music", 1, ip, port); err != nil {
+	ln, err := listenMusic(localAddr, bb.Addr().Addr(), opts)
+	if err != nil {
 		return err
 	}
+	defer ln.close()
+
+	slog.Info("waiting for bulb to connect for music mode", slog.String("listen", ln.advertise.String()))
 
-	conn, err := ln.Accept()
+	conn, err := bb.startMusic(ctx, ln)
 	if err != nil {
-		return eris.Wrap(err, "failed to accept connection from bulb")
+		return err
 	}
 
 	musicContext, musicContextCancel := context.WithCancel(ctx)
+	bb.mu.Lock()
 	bb.musicContextCancel = musicContextCancel
+	bb.mu.Unlock()
+
+	bulb := newMusicModeBulb(bb.bulbState, conn)
+	go bb.superviseMusic(musicContext, bulb, ln)
 
-	bulb := newMusicModeBulb(bb.bulbInfo, conn)
 	defer func() {
-		if bb.musicContextCancel != nil {
-			bb.musicContextCancel()
-			bb.musicContextCancel = nil
-		}
+		musicContextCancel()
+		bulb.Disconnect()
 		if err := bb.DisableMusicMode(context.Background()); err != nil {
 			slog.Error("failed to disable music mode", slog.Any("error", err))
 		} else {
@@ -118,25 +222,76 @@ func (bb *Bulb) EnableMusicMode(ctx context.Context, port uint16, callback func(
 	return callback(musicContext, bulb)
 }
 
+func (bb *Bulb) startMusic(ctx context.Context, ln *musicListener) (net.Conn, error) {
+	if _, err := bb.executeCommand(ctx, "set_music", 1, ln.advertise.Addr().String(), ln.advertise.Port()); err != nil {
+		return nil, err
+	}
+
+	return ln.accept(ctx)
+}
+
+func (bb *Bulb) superviseMusic(ctx context.Context, bulb *MusicModeBulb, ln *musicListener) {
+	addr := bb.Addr().String()
+
+	for {
+		conn, err := bulb.connection()
+		if err != nil {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-conn.closed():
+		}
+
+		if ctx.Err() != nil || bulb.conn.Load() != conn {
+			return
+		}
+
+		bulb.states.set(StateReconnecting)
+		slog.Warn("music mode connection lost, re-enabling music mode", slog.String("addr", addr))
+
+		retry := newBackoff()
+		for attempt := 1; ; attempt++ {
+			if !sleepContext(ctx, retry.next()) {
+				return
+			}
+
+			musicConn, err := bb.startMusic(ctx, ln)
+			if err != nil {
+				slog.Warn("failed to re-enable music mode",
+					slog.String("addr", addr),
+					slog.Int("attempt", attempt),
+					slog.Any("error", err),
+				)
+				continue
+			}
+
+			if !bulb.reattach(conn, musicConn) {
+				return
+			}
+
+			slog.Info("music mode re-enabled", slog.String("addr", addr), slog.Int("attempts", attempt))
+			break
+		}
+	}
+}
+
 func (bb *Bulb) DisableMusicMode(ctx context.Context) error {
+	bb.mu.Lock()
 	if bb.musicContextCancel != nil {
 		bb.musicContextCancel()
 		bb.musicContextCancel = nil
 	}
+	bb.mu.Unlock()
 
 	_, err := bb.executeCommand(ctx, "set_music", 0)
 
 	return err
 }
 
-func (bb *Bulb) listen(ctx context.Context) {
-	addr := bb.Addr().String()
-
-	go bb.pollProperties(ctx, addr)
-	go bb.readMessages(ctx, addr)
-}
-
-func (bb *Bulb) pollProperties(ctx context.Context, addr string) {
+func (bb *Bulb) pollProperties(ctx context.Context) {
 	ticker := time.NewTicker(propertyPollInterval)
 	defer ticker.Stop()
 
@@ -145,199 +300,174 @@ func (bb *Bulb) pollProperties(ctx context.Context, addr string) {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			bb.refreshProperties(ctx, addr)
+			// skip polls rather than queue them when commands are scarce
+			if bb.ConnectionState() == StateConnected && bb.Quota().Available >= pollQuotaReserve {
+				bb.refreshProperties(ctx)
+			}
 		}
 	}
 }
 
-func (bb *Bulb) refreshProperties(ctx context.Context, addr string) {
-	props, err := bb.executeCommand(ctx, "get_prop", "power", "bright", "color_mode", "ct", "rgb", "hue", "sat", "name")
+func (bb *Bulb) refreshProperties(ctx context.Context) {
+	props, err := bb.executeCommand(ctx, "get_prop", bb.polledProperties()...)
 	if err != nil {
-		if !eris.Is(err, context.Canceled) {
+		if !eris.Is(err, context.Canceled) && !eris.Is(err, ErrConnectionLost) {
 			slog.Error("failed to get bulb props",
-				slog.String("addr", addr),
+				slog.String("addr", bb.Addr().String()),
 				slog.Any("error", err),
 			)
 		}
 		return
 	}
 
-	bb.updatePropertiesFromSlice(props, addr)
+	bb.updatePropertiesFromSlice(props)
 }
 
-func (bb *Bulb) readMessages(ctx context.Context, addr string) {
-	buf := make([]byte, 1024)
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
+// MeasureLatency times samples get_prop round trips on the control connection and
+// returns the updated latency estimate.
+func (bb *Bulb) MeasureLatency(ctx context.Context, samples int) (time.Duration, error) {
+	for range samples {
+		if _, err := bb.executeCommand(ctx, "get_prop", "power"); err != nil {
+			return 0, eris.Wrap(err, "failed to measure latency")
 		}
-
-		n, err := bb.conn.Read(buf)
-		if err != nil {
-			if eris.Is(err, net.ErrClosed) {
-				return
-			}
-
-			slog.Error("failed to read data from bulb connection",
-				slog.String("addr", addr),
-				slog.Any("error", err),
-			)
-			return
-		}
-
-		bb.handleIncomingPayload(string(buf[:n]), addr)
 	}
-}
-
-func (bb *Bulb) handleIncomingPayload(payload, addr string) {
-	slog.Debug("received response from bulb",
-		slog.String("addr", addr),
-		slog.String("response", payload),
-	)
-
-	for raw := range strings.SplitSeq(payload, lineEnding) {
-		line := strings.TrimSpace(raw)
-		if line == "" {
-			continue
-		}
 
-		bb.handleMessageLine(line, addr)
-	}
+	return bb.Latency(), nil
 }
 
-func (bb *Bulb) handleMessageLine(line, addr string) {
-	switch {
-	case strings.HasPrefix(line, "{\"id\":"):
-		bb.decodeCommandResult(line, addr)
-	case strings.HasPrefix(line, "{\"method\":"):
-		bb.decodeNotification(line, addr)
+func (bb *Bulb) handleNotification(note notification) {
+	switch note.Method {
+	case "props":
+		bb.applyPropertyNotification(note.Params)
 	}
 }
 
-func (bb *Bulb) decodeCommandResult(line, addr string) {
-	var result commandResult
-	if err := json.Unmarshal([]byte(line), &result); err != nil {
-		slog.Error("failed to unmarshal command result",
-			slog.String("addr", addr),
-			slog.String("json", line),
-			slog.Any("error", err),
-		)
-		return
-	}
+func (bb *Bulb) applyPropertyNotification(params map[string]any) {
+	addr := bb.Addr().String()
+
+	bb.report(func(info *BulbInfo) {
+		for key, value := range params {
+			light := &info.LightInfo
+			prop := key
+			if trimmed, ok := strings.CutPrefix(key, backgroundMethodPrefix); ok {
+				light = &info.background
+				prop = trimmed
+			}
 
-	bb.results <- result
+			switch prop {
+			case "power":
+				if s, ok := value.(string); ok {
+					light.power = PowerStatus(s)
+				} else {
+					bb.logUnexpectedType(key, value, addr)
+				}
+			case "bright":
+				if v, ok := asFloat64(value); ok {
+					light.brightness = uint8(v)
+				} else {
+					bb.logUnexpectedType(key, value, addr)
+				}
+			// the background light reports its color mode as bg_lmode
+			case "color_mode", "lmode":
+				if v, ok := asFloat64(value); ok {
+					light.colorMode = ColorMode(int(v))
+				} else {
+					bb.logUnexpectedType(key, value, addr)
+				}
+			case "ct":
+				if v, ok := asFloat64(value); ok {
+					light.colorTemperature = uint16(v)
+				} else {
+					bb.logUnexpectedType(key, value, addr)
+				}
+			case "rgb":
+				if v, ok := asFloat64(value); ok {
+					light.rgb = uint(v)
+				} else {
+					bb.logUnexpectedType(key, value, addr)
+				}
+			case "hue":
+				if v, ok := asFloat64(value); ok {
+					light.hue = uint16(v)
+				} else {
+					bb.logUnexpectedType(key, value, addr)
+				}
+			case "sat":
+				if v, ok := asFloat64(value); ok {
+					light.saturation = uint8(v)
+				} else {
+					bb.logUnexpectedType(key, value, addr)
+				}
+			case "name":
+				if s, ok := value.(string); ok {
+					info.name = s
+				} else {
+					bb.logUnexpectedType(key, value, addr)
+				}
+			}
+		}
+	})
 }
 
-func (bb *Bulb) decodeNotification(line, addr string) {
-	var note notification
-	if err := json.Unmarshal([]byte(line), &note); err != nil {
-		slog.Error("failed to unmarshal notification",
-			slog.String("addr", addr),
-			slog.String("json", line),
-			slog.Any("error", err),
-		)
-		return
+// polledProperties lists the properties requested by get_prop, in the order
+// updatePropertiesFromSlice expects them: the main light, the name, and then the
+// background light if the bulb has one.
+func (bb *Bulb) polledProperties() []any {
+	props := []any{"power", "bright", "color_mode", "ct", "rgb", "hue", "sat", "name"}
+	if bb.HasBackground() {
+		props = append(props, "bg_power", "bg_bright", "bg_lmode", "bg_ct", "bg_rgb", "bg_hue", "bg_sat")
 	}
 
-	bb.handleNotification(note, addr)
+	return props
 }
 
-func (bb *Bulb) handleNotification(note notification, addr string) {
-	switch note.Method {
-	case "props":
-		bb.applyPropertyNotification(note.Params, addr)
-	}
-}
+func (bb *Bulb) updatePropertiesFromSlice(props []string) {
+	addr := bb.Addr().String()
 
-func (bb *Bulb) applyPropertyNotification(params map[string]any, addr string) {
-	for key, value := range params {
-		switch key {
-		case "power":
-			if s, ok := value.(string); ok {
-				bb.power = PowerStatus(s)
-			} else {
-				bb.logUnexpectedType("power", value, addr)
-			}
-		case "bright":
-			if v, ok := asFloat64(value); ok {
-				bb.brightness = uint8(v)
-			} else {
-				bb.logUnexpectedType("bright", value, addr)
-			}
-		case "color_mode":
-			if v, ok := asFloat64(value); ok {
-				bb.colorMode = ColorMode(int(v))
-			} else {
-				bb.logUnexpectedType("color_mode", value, addr)
-			}
-		case "ct":
-			if v, ok := asFloat64(value); ok {
-				bb.colorTemperature = uint16(v)
-			} else {
-				bb.logUnexpectedType("ct", value, addr)
-			}
-		case "rgb":
-			if v, ok := asFloat64(value); ok {
-				bb.rgb = uint(v)
-			} else {
-				bb.logUnexpectedType("rgb", value, addr)
-			}
-		case "hue":
-			if v, ok := asFloat64(value); ok {
-				bb.hue = uint16(v)
-			} else {
-				bb.logUnexpectedType("hue", value, addr)
-			}
-		case "sat":
-			if v, ok := asFloat64(value); ok {
-				bb.saturation = uint8(v)
-			} else {
-				bb.logUnexpectedType("sat", value, addr)
-			}
-		case "name":
-			if s, ok := value.(string); ok {
-				bb.name = s
-			} else {
-				bb.logUnexpectedType("name", value, addr)
+	bb.report(func(info *BulbInfo) {
+		for i, prop := range props {
+			switch {
+			case i < lightPropertyCount:
+				updateLightProperty(&info.LightInfo, i, prop, addr)
+			case i == lightPropertyCount:
+				info.name = prop
+			default:
+				updateLightProperty(&info.background, i-lightPropertyCount-1, prop, addr)
 			}
 		}
-	}
+	})
 }
 
-func (bb *Bulb) updatePropertiesFromSlice(props []string, addr string) {
-	for i, prop := range props {
-		switch i {
-		case 0:
-			bb.power = PowerStatus(prop)
-		case 1:
-			if v, ok := parseUint(prop, 10, 8, "brightness", addr); ok {
-				bb.brightness = uint8(v)
-			}
-		case 2:
-			if v, ok := parseUint(prop, 10, 8, "color mode", addr); ok {
-				bb.colorMode = ColorMode(v)
-			}
-		case 3:
-			if v, ok := parseUint(prop, 10, 16, "color temperature", addr); ok {
-				bb.colorTemperature = uint16(v)
-			}
-		case 4:
-			if v, ok := parseUint(prop, 10, 32, "RGB", addr); ok {
-				bb.rgb = uint(v)
-			}
-		case 5:
-			if v, ok := parseUint(prop, 10, 16, "hue", addr); ok {
-				bb.hue = uint16(v)
-			}
-		case 6:
-			if v, ok := parseUint(prop, 10, 8, "saturation", addr); ok {
-				bb.saturation = uint8(v)
-			}
-		case 7:
-			bb.name = prop
+// lightPropertyCount is the number of per-light properties in a get_prop reply.
+const lightPropertyCount = 7
+
+func updateLightProperty(light *LightInfo, i int, prop string, addr string) {
+	switch i {
+	case 0:
+		light.power = PowerStatus(prop)
+	case 1:
+		if v, ok := parseUint(prop, 10, 8, "brightness", addr); ok {
+			light.brightness = uint8(v)
+		}
+	case 2:
+		if v, ok := parseUint(prop, 10, 8, "color mode", addr); ok {
+			light.colorMode = ColorMode(v)
+		}
+	case 3:
+		if v, ok := parseUint(prop, 10, 16, "color temperature", addr); ok {
+			light.colorTemperature = uint16(v)
+		}
+	case 4:
+		if v, ok := parseUint(prop, 10, 32, "RGB", addr); ok {
+			light.rgb = uint(v)
+		}
+	case 5:
+		if v, ok := parseUint(prop, 10, 16, "hue", addr); ok {
+			light.hue = uint16(v)
+		}
+	case 6:
+		if v, ok := parseUint(prop, 10, 8, "saturation", addr); ok {
+			light.saturation = uint8(v)
 		}
 	}
 }
@@ -385,28 +515,3 @@ func asFloat64(value any) (float64, bool) {
 		return 0, false
 	}
 }
-
-func getCommandExecutionCallback(results <-chan commandResult, wait time.Duration) func(context.Context, command) ([]string, error) {
-	return func(ctx context.Context, cmd command) ([]string, error) {
-		select {
-		case result := <-results:
-			if result.ID == cmd.ID {
-				if result.Error != nil {
-					return nil, eris.Wrapf(result.Error, "failed to execute command %s (%v)", cmd.Method, cmd.Params)
-				}
-
-				if len(result.Result) == 1 && result.Result[0] == "ok" {
-					return nil, nil
-				}
-
-				return result.Result, nil
-			}
-		case <-time.After(wait):
-			return nil, eris.New("command timed out")
-		case <-ctx.Done():
-			return nil, eris.Wrapf(ctx.Err(), "failed to execute command %s (%v)", cmd.Method, cmd.Params)
-		}
-
-		return nil, nil
-	}
-}
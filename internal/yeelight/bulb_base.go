@@ -2,160 +2,157 @@ package yeelight
 
 import (
 	"context"
-	"fmt"
-	"log/slog"
-	"net"
+	"encoding/json"
+	"sync/atomic"
+	"time"
 
-	"github.com/crazy3lf/colorconv"
-	"github.com/cybre/yeelight-music-sync/internal/utils"
 	"github.com/rotisserie/eris"
 )
 
 type bulbBase struct {
-	*bulbInfo
+	*bulbState
+	// light makes the main light's commands methods of the bulb itself.
+	light
+	background *BackgroundLight
 
-	conn          net.Conn
-	lastCommandID int
+	conn   atomic.Pointer[connection]
+	states *connectionStates
 
-	commandCallback func(context.Context, command) ([]string, error)
+	// limiter is nil for connections without a command quota (music mode).
+	limiter *commandLimiter
 }
 
-func (bb *bulbBase) Disconnect() error {
-	return bb.conn.Close()
+func (bb *bulbBase) initLights() {
+	bb.light = light{bb: bb}
+	bb.background = &BackgroundLight{light{bb: bb, background: true}}
 }
 
-func (bb *bulbBase) TurnOn(ctx context.Context, effect Effect, duration int) error {
-	if _, err := bb.executeCommand(ctx, "set_power", "on", effect, duration); err != nil {
-		return err
-	}
-
-	bb.power = PowerOn
-
-	return nil
+// BackgroundLight controls the background ring of dual-light ceiling lamps. Check
+// HasBackground first; bulbs without one reject its commands.
+func (bb *bulbBase) BackgroundLight() *BackgroundLight {
+	return bb.background
 }
 
-func (bb *bulbBase) TurnOff(ctx context.Context, effect Effect, duration int) error {
-	if _, err := bb.executeCommandBase(ctx, "set_power", "off", effect, duration); err != nil {
-		return err
+func (bb *bulbBase) Disconnect() error {
+	conn := bb.conn.Swap(nil)
+	if conn == nil {
+		return nil
 	}
 
-	bb.power = PowerOff
+	bb.states.set(StateDisconnected)
 
-	return nil
+	return conn.close()
 }
 
-func (bb *bulbBase) Toggle(ctx context.Context, effect Effect, duration int) error {
-	power := bb.power
-
-	if _, err := bb.executeCommand(ctx, "toggle", effect, duration); err != nil {
-		return err
-	}
-
-	if power == PowerOn {
-		bb.power = PowerOff
-	} else {
-		bb.power = PowerOn
-	}
+// ConnectionState reports whether commands are currently being delivered.
+func (bb *bulbBase) ConnectionState() ConnectionState {
+	return bb.states.get()
+}
 
-	return nil
+// ConnectionStates delivers the current connection state and every later change until
+// ctx is done. Only the latest state is buffered.
+func (bb *bulbBase) ConnectionStates(ctx context.Context) <-chan ConnectionState {
+	return bb.states.subscribe(ctx)
 }
 
-func (bb *bulbBase) SetBrightness(ctx context.Context, brightness uint8, effect Effect, duration int) error {
-	if brightness < 1 || brightness > 100 {
-		return eris.Wrap(ErrBrightnessInvalid, "failed to set brightness")
+func (bb *bulbBase) SetName(ctx context.Context, name string) error {
+	if err := validateName(name); err != nil {
+		return eris.Wrap(err, "failed to set name")
 	}
 
-	if _, err := bb.executeCommand(ctx, "set_bright", brightness, effect, duration); err != nil {
+	if _, err := bb.executeCommand(ctx, "set_name", name); err != nil {
 		return err
 	}
 
-	bb.brightness = brightness
+	bb.update(func(info *BulbInfo) {
+		info.name = name
+	})
 
 	return nil
 }
 
-func (bb *bulbBase) SetRGB(ctx context.Context, r, g, b uint8, effect Effect, duration int) error {
-	rgb := utils.RGBToInt(r, g, b)
-
-	if _, err := bb.executeCommand(ctx, "set_rgb", rgb, effect, duration); err != nil {
-		return err
+// AddCron schedules a bulb-side timer that fires after the given number of minutes.
+func (bb *bulbBase) AddCron(ctx context.Context, cronType CronType, minutes int) error {
+	if minutes < 1 {
+		return eris.Wrap(ErrCronDelayInvalid, "failed to add timer")
 	}
 
-	bb.rgb = rgb
-
-	return nil
+	_, err := bb.executeCommand(ctx, "cron_add", cronType, minutes)
+	return err
 }
 
-func (bb *bulbBase) SetHSV(ctx context.Context, hue uint16, saturation uint8, value uint8, effect Effect, duration int) error {
-	red, green, blue, err := colorconv.HSVToRGB(float64(hue), float64(saturation)/100.0, 1)
+// GetCron returns the timers of the given type currently set on the bulb.
+func (bb *bulbBase) GetCron(ctx context.Context, cronType CronType) ([]CronJob, error) {
+	result, err := bb.executeCommand(ctx, "cron_get", cronType)
 	if err != nil {
-		return eris.Wrap(err, "failed to convert HSV to RGB")
+		return nil, err
 	}
 
-	rgb := utils.RGBToInt(red, green, blue)
-
-	// Since set_hsv doesn't actually let you set the brightness (value), we have to use start_cf
-	if _, err = bb.executeCommand(ctx, "start_cf", 1, 1, fmt.Sprintf("%d, 1, %d, %d", duration, rgb, value)); err != nil {
-		return err
+	jobs := make([]CronJob, 0, len(result))
+	for _, raw := range result {
+		var job CronJob
+		if err := json.Unmarshal([]byte(raw), &job); err != nil {
+			return nil, eris.Wrapf(err, "failed to decode timer %q", raw)
+		}
+		jobs = append(jobs, job)
 	}
 
-	bb.hue = hue
-	bb.saturation = saturation
-	bb.brightness = value
-	bb.rgb = rgb
-
-	return nil
+	return jobs, nil
 }
 
-func (bb *bulbBase) StartColorFlow(ctx context.Context, count int, action int, expression string) error {
-	_, err := bb.executeCommand(ctx, "start_cf", count, action, expression)
+func (bb *bulbBase) DeleteCron(ctx context.Context, cronType CronType) error {
+	_, err := bb.executeCommand(ctx, "cron_del", cronType)
 	return err
 }
 
-func (bb *bulbBase) StopColorFlow(ctx context.Context) error {
-	_, err := bb.executeCommand(ctx, "stop_cf")
+// DevToggle toggles the main and background lights together.
+func (bb *bulbBase) DevToggle(ctx context.Context) error {
+	_, err := bb.executeCommand(ctx, "dev_toggle")
 	return err
 }
 
+// executeCommand sends a command and waits for the reply. It returns errCommandCoalesced,
+// without sending anything, when a newer command queued for the quota superseded it.
 func (bb *bulbBase) executeCommand(ctx context.Context, method string, params ...any) ([]string, error) {
-	command, err := bb.executeCommandBase(ctx, method, params...)
+	if !bb.Supports(method) {
+		return nil, &UnsupportedError{Method: method}
+	}
+
+	conn, err := bb.connection()
 	if err != nil {
 		return nil, err
 	}
 
-	return bb.commandCallback(ctx, command)
-}
-
-func (bb *bulbBase) executeCommandBase(ctx context.Context, method string, params ...any) (command, error) {
-	select {
-	case <-ctx.Done():
-		return command{}, eris.Wrap(ctx.Err(), "failed to execute command")
-	default:
+	if err := bb.acquireQuota(ctx, method, params); err != nil {
+		return nil, err
 	}
 
-	cmd := newCommand(bb.getCommandID(), method, params...)
-	comandText, err := cmd.String()
-	if err != nil {
-		return command{}, err
+	start := time.Now()
+	result, err := conn.execute(ctx, method, params...)
+	if err != nil && bb.limiter != nil && eris.Is(err, ErrQuotaExceeded) {
+		bb.limiter.exhaust()
+	}
+	// music mode connections are never answered, so there is nothing to time
+	if err == nil && conn.pending != nil {
+		bb.observeResponseTime(time.Since(start))
 	}
 
-	slog.Debug("executing command",
-		slog.String("addr", bb.Addr().String()),
-		slog.Int("id", cmd.ID),
-		slog.String("method", method),
-		slog.Any("params", cmd.Params),
-		slog.String("command", comandText),
-	)
+	return result, err
+}
 
-	if _, err = bb.conn.Write([]byte(comandText)); err != nil {
-		return command{}, eris.Wrap(err, "failed to write command to connection")
+func (bb *bulbBase) acquireQuota(ctx context.Context, method string, params []any) error {
+	if bb.limiter == nil {
+		return nil
 	}
 
-	return cmd, nil
+	return bb.limiter.acquire(ctx, method, params)
 }
 
-func (bb *bulbBase) getCommandID() int {
-	bb.lastCommandID++
+func (bb *bulbBase) connection() (*connection, error) {
+	conn := bb.conn.Load()
+	if conn == nil {
+		return nil, ErrNotConnected
+	}
 
-	return bb.lastCommandID
+	return conn, nil
 }
@@ -2,14 +2,26 @@ package yeelight
 
 import (
 	"net/netip"
+	"slices"
 
 	"github.com/cybre/yeelight-music-sync/internal/utils"
 	"github.com/rotisserie/eris"
 )
 
 var (
-	ErrPoweredOff        = eris.New("tried to execute command on a bulb that is powered off")
-	ErrBrightnessInvalid = eris.New("brightness must be between 1 and 100")
+	ErrPoweredOff              = eris.New("tried to execute command on a bulb that is powered off")
+	ErrBrightnessInvalid       = newInvalidParameter("brightness must be between 1 and 100")
+	ErrColorTemperatureInvalid = newInvalidParameter("color temperature must be between 1700 and 6500")
+	ErrHueInvalid              = newInvalidParameter("hue must be between 0 and 359")
+	ErrSaturationInvalid       = newInvalidParameter("saturation must be between 0 and 100")
+	ErrPercentageInvalid       = newInvalidParameter("adjustment percentage must be between -100 and 100")
+	ErrDurationInvalid         = newInvalidParameter("smooth transitions must last at least 30ms")
+	ErrEffectInvalid           = newInvalidParameter("effect must be sudden or smooth")
+	ErrAdjustInvalid           = newInvalidParameter("invalid adjustment")
+	ErrNameInvalid             = newInvalidParameter("name must be a non-empty single line")
+	ErrCronDelayInvalid        = newInvalidParameter("timer delay must be at least one minute")
+	ErrNotConnected            = eris.New("bulb is not connected")
+	ErrConnectionLost          = eris.New("bulb connection lost")
 )
 
 type ColorMode uint8
@@ -34,13 +46,9 @@ const (
 	Smooth Effect = "smooth"
 )
 
-type bulbInfo struct {
-	addr             netip.AddrPort
-	id               string
-	name             string
-	model            string
-	firmwareVersion  string
-	support          []string
+// LightInfo is the last known state of one light of a bulb. Dual-light ceiling lamps
+// report one for the main light and one for the background ring.
+type LightInfo struct {
 	power            PowerStatus
 	brightness       uint8
 	colorMode        ColorMode
@@ -50,54 +58,101 @@ type bulbInfo struct {
 	saturation       uint8
 }
 
-func (bi bulbInfo) Addr() netip.AddrPort {
-	return bi.addr
+func (li LightInfo) Power() PowerStatus {
+	return li.power
 }
 
-func (bi bulbInfo) ID() string {
-	return bi.id
+func (li LightInfo) Brightness() uint8 {
+	return li.brightness
 }
 
-func (bi bulbInfo) Name() string {
-	return bi.name
+func (li LightInfo) ColorMode() ColorMode {
+	return li.colorMode
 }
 
-func (bi bulbInfo) Model() string {
-	return bi.model
+func (li LightInfo) ColorTemperature() uint16 {
+	return li.colorTemperature
 }
 
-func (bi bulbInfo) FirmwareVersion() string {
-	return bi.firmwareVersion
+func (li LightInfo) RGB() (uint8, uint8, uint8) {
+	return utils.IntToRGB(li.rgb)
 }
 
-func (bi bulbInfo) Support() []string {
-	return bi.support
+func (li LightInfo) Hue() uint16 {
+	return li.hue
+}
+
+func (li LightInfo) Saturation() uint8 {
+	return li.saturation
+}
+
+// BulbInfo is an immutable snapshot of a bulb's identity and last known state. The
+// embedded LightInfo describes the main light.
+type BulbInfo struct {
+	LightInfo
+
+	addr            netip.AddrPort
+	id              string
+	name            string
+	model           string
+	firmwareVersion string
+	support         []string
+	background      LightInfo
+}
+
+func (bi BulbInfo) Addr() netip.AddrPort {
+	return bi.addr
 }
 
-func (bi bulbInfo) Power() PowerStatus {
-	return bi.power
+func (bi BulbInfo) ID() string {
+	return bi.id
 }
 
-func (bi bulbInfo) Brightness() uint8 {
-	return bi.brightness
+func (bi BulbInfo) Name() string {
+	return bi.name
 }
 
-func (bi bulbInfo) ColorMode() ColorMode {
-	return bi.colorMode
+func (bi BulbInfo) Model() string {
+	return bi.model
+}
+
+func (bi BulbInfo) FirmwareVersion() string {
+	return bi.firmwareVersion
+}
+
+func (bi BulbInfo) Support() []string {
+	return bi.support
 }
 
-func (bi bulbInfo) ColorTemperature() uint16 {
-	return bi.colorTemperature
+// Background returns the state of the background light. It is zero for bulbs without
+// one.
+func (bi BulbInfo) Background() LightInfo {
+	return bi.background
 }
 
-func (bi bulbInfo) RGB() (uint8, uint8, uint8) {
-	return utils.IntToRGB(bi.rgb)
+// HasBackground reports whether the bulb advertises a background light. Bulbs created
+// from an address alone advertise nothing.
+func (bi BulbInfo) HasBackground() bool {
+	return slices.Contains(bi.support, "bg_set_power")
 }
 
-func (bi bulbInfo) Hue() uint16 {
-	return bi.hue
+// sameIdentity reports whether other advertises the same bulb at the same address.
+// Live state is left out because nearly every advertisement carries a different one.
+func (bi BulbInfo) sameIdentity(other BulbInfo) bool {
+	return bi.addr == other.addr &&
+		bi.id == other.id &&
+		bi.name == other.name &&
+		bi.model == other.model &&
+		bi.firmwareVersion == other.firmwareVersion &&
+		slices.Equal(bi.support, other.support)
 }
 
-func (bi bulbInfo) Saturation() uint8 {
-	return bi.saturation
+// setIdentity copies the identity and address fields of other, leaving state alone.
+func (bi *BulbInfo) setIdentity(other BulbInfo) {
+	bi.addr = other.addr
+	bi.id = other.id
+	bi.name = other.name
+	bi.model = other.model
+	bi.firmwareVersion = other.firmwareVersion
+	bi.support = other.support
 }
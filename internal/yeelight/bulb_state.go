@@ -0,0 +1,170 @@
+package yeelight
+
+import (
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bulbState publishes BulbInfo snapshots. Readers always get a consistent snapshot and
+// writers replace it wholesale, so the state can be shared between the control and
+// music mode connections without readers taking a lock.
+type bulbState struct {
+	mu          sync.Mutex
+	snapshot    atomic.Pointer[BulbInfo]
+	subscribers map[chan PropertyChange]struct{}
+
+	// colorStrategy, responseTime and latency are shared with the music mode bulb,
+	// which cannot measure replies itself.
+	colorStrategy atomic.Pointer[ColorStrategy]
+	responseTime  atomic.Int64
+	latency       atomic.Int64
+	timeouts      atomic.Pointer[Timeouts]
+}
+
+func newBulbState(info BulbInfo) *bulbState {
+	s := &bulbState{}
+	s.snapshot.Store(&info)
+
+	return s
+}
+
+// Info returns the current snapshot.
+func (s *bulbState) Info() BulbInfo {
+	return *s.snapshot.Load()
+}
+
+// update applies fn to a copy of the current snapshot and publishes the result.
+func (s *bulbState) update(fn func(*BulbInfo)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := *s.snapshot.Load()
+	fn(&next)
+	s.snapshot.Store(&next)
+}
+
+// ResponseTime is a moving average of how long the bulb takes to answer a command on
+// its control connection, or zero before the first reply.
+func (s *bulbState) ResponseTime() time.Duration {
+	return time.Duration(s.responseTime.Load())
+}
+
+// observeResponseTime folds one reply time into the moving average.
+func (s *bulbState) observeResponseTime(sample time.Duration) {
+	for {
+		prev := s.responseTime.Load()
+		next := int64(sample)
+		if prev != 0 {
+			next = prev + (int64(sample)-prev)/4
+		}
+		if s.responseTime.CompareAndSwap(prev, next) {
+			return
+		}
+	}
+}
+
+// Latency estimates how long a command takes to show on the lamp: the configured
+// latency if one was set, otherwise half the measured response time.
+func (s *bulbState) Latency() time.Duration {
+	if configured := s.latency.Load(); configured > 0 {
+		return time.Duration(configured)
+	}
+
+	return s.ResponseTime() / 2
+}
+
+// SetLatency overrides the measured latency, for models whose reply time says little
+// about how fast they change. Zero goes back to the measured latency.
+func (s *bulbState) SetLatency(latency time.Duration) {
+	s.latency.Store(int64(max(latency, 0)))
+}
+
+// Timeouts returns the bounds on the bulb's network I/O, with defaults filled in.
+func (s *bulbState) Timeouts() Timeouts {
+	if t := s.timeouts.Load(); t != nil {
+		return *t
+	}
+
+	return Timeouts{}.withDefaults()
+}
+
+// SetTimeouts changes the bounds on the bulb's network I/O. Dial and Reply apply to
+// connections opened afterwards, so call it before Connect.
+func (s *bulbState) SetTimeouts(timeouts Timeouts) {
+	timeouts = timeouts.withDefaults()
+	s.timeouts.Store(&timeouts)
+}
+
+func (s *bulbState) Addr() netip.AddrPort {
+	return s.Info().Addr()
+}
+
+func (s *bulbState) ID() string {
+	return s.Info().ID()
+}
+
+func (s *bulbState) Name() string {
+	return s.Info().Name()
+}
+
+func (s *bulbState) Model() string {
+	return s.Info().Model()
+}
+
+func (s *bulbState) FirmwareVersion() string {
+	return s.Info().FirmwareVersion()
+}
+
+func (s *bulbState) Support() []string {
+	return s.Info().Support()
+}
+
+func (s *bulbState) Background() LightInfo {
+	return s.Info().Background()
+}
+
+func (s *bulbState) HasBackground() bool {
+	return s.Info().HasBackground()
+}
+
+func (s *bulbState) Supports(method string) bool {
+	return s.Info().Supports(method)
+}
+
+func (s *bulbState) HasColor() bool {
+	return s.Info().HasColor()
+}
+
+func (s *bulbState) HasColorTemperature() bool {
+	return s.Info().HasColorTemperature()
+}
+
+func (s *bulbState) Power() PowerStatus {
+	return s.Info().Power()
+}
+
+func (s *bulbState) Brightness() uint8 {
+	return s.Info().Brightness()
+}
+
+func (s *bulbState) ColorMode() ColorMode {
+	return s.Info().ColorMode()
+}
+
+func (s *bulbState) ColorTemperature() uint16 {
+	return s.Info().ColorTemperature()
+}
+
+func (s *bulbState) RGB() (uint8, uint8, uint8) {
+	return s.Info().RGB()
+}
+
+func (s *bulbState) Hue() uint16 {
+	return s.Info().Hue()
+}
+
+func (s *bulbState) Saturation() uint8 {
+	return s.Info().Saturation()
+}
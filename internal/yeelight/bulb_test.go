@@ -1,43 +1,238 @@
 package yeelight
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
-func TestGetCommandExecutionCallbackSuccess(t *testing.T) {
-	results := make(chan commandResult, 1)
-	callback := getCommandExecutionCallback(results, 50*time.Millisecond)
+// serveTestBulb answers every command on conn with "ok", except get_prop, and pushes a
+// props notification after each reply.
+func serveTestBulb(t *testing.T, conn net.Conn) {
+	t.Helper()
 
-	cmd := command{ID: 1}
-	results <- commandResult{ID: 1, Result: []string{"value"}}
+	go func() {
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			var cmd command
+			if err := json.Unmarshal(scanner.Bytes(), &cmd); err != nil {
+				return
+			}
 
-	resp, err := callback(context.Background(), cmd)
-	assert.NoError(t, err)
-	assert.Equal(t, []string{"value"}, resp)
+			result := `["ok"]`
+			switch cmd.Method {
+			case "get_prop":
+				result = `["on","42","1","4000","16711680","120","80","desk"]`
+			case "cron_get":
+				result = `[{"type":0,"delay":15,"mix":0}]`
+			}
+
+			reply := fmt.Sprintf(`{"id":%d,"result":%s}`+lineEnding, cmd.ID, result)
+			note := fmt.Sprintf(`{"method":"props","params":{"bright":%d}}`+lineEnding, cmd.ID%100+1)
+			if _, err := conn.Write([]byte(reply + note)); err != nil {
+				return
+			}
+		}
+	}()
 }
 
-func TestGetCommandExecutionCallbackError(t *testing.T) {
-	results := make(chan commandResult, 1)
-	callback := getCommandExecutionCallback(results, 50*time.Millisecond)
+func newTestBulb(t *testing.T) *Bulb {
+	t.Helper()
+
+	client, server := net.Pipe()
+	serveTestBulb(t, server)
+
+	bulb := newBulb(BulbInfo{addr: netip.MustParseAddrPort("127.0.0.1:55443")})
+	bulb.limiter = newCommandLimiter(100, 0, time.Millisecond)
+	bulb.attach(client)
+	t.Cleanup(func() {
+		bulb.Disconnect()
+		server.Close()
+	})
+
+	return bulb
+}
 
-	cmd := command{ID: 2, Method: "test", Params: []any{"a"}}
-	results <- commandResult{
-		ID:    2,
-		Error: &commandError{Code: 500, Message: "boom"},
+func TestBulbConcurrentCommands(t *testing.T) {
+	bulb := newTestBulb(t)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, bulb.SetBrightness(ctx, uint8(i+1), Sudden, 0))
+		}()
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, bulb.SetRGB(ctx, uint8(i), 0, 0, Smooth, 100))
+		}()
+		go func() {
+			defer wg.Done()
+			_ = bulb.Info()
+			_ = bulb.Brightness()
+			_, _, _ = bulb.RGB()
+		}()
 	}
+	wg.Wait()
+}
+
+func TestBulbRefreshProperties(t *testing.T) {
+	bulb := newTestBulb(t)
+
+	bulb.refreshProperties(context.Background())
+
+	info := bulb.Info()
+	assert.Equal(t, PowerOn, info.Power())
+	assert.Equal(t, ColorModeRGB, info.ColorMode())
+	assert.Equal(t, uint16(4000), info.ColorTemperature())
+	assert.Equal(t, uint16(120), info.Hue())
+	assert.Equal(t, uint8(80), info.Saturation())
+	assert.Equal(t, "desk", info.Name())
+}
+
+func TestBulbSnapshotIsImmutable(t *testing.T) {
+	bulb := newTestBulb(t)
+
+	before := bulb.Info()
+	require.NoError(t, bulb.SetBrightness(context.Background(), 77, Sudden, 0))
+
+	assert.Equal(t, uint8(0), before.Brightness())
+	assert.NotZero(t, bulb.Brightness())
+}
+
+func TestMusicModeBulbDoesNotWaitForReplies(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(server).ReadString('\n')
+		received <- line
+	}()
+
+	bulb := newMusicModeBulb(newBulbState(BulbInfo{}), client)
+	defer bulb.Disconnect()
+
+	require.NoError(t, bulb.SetBrightness(context.Background(), 50, Sudden, 0))
+	assert.Contains(t, <-received, `"set_bright"`)
+	assert.Equal(t, uint8(50), bulb.Brightness())
+}
+
+func TestBulbReconnectsAfterConnectionLoss(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			serveTestBulb(t, conn)
+			accepted <- conn
+		}
+	}()
+
+	bulb := newBulb(BulbInfo{addr: netip.MustParseAddrPort(ln.Addr().String())})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	require.NoError(t, bulb.Connect(ctx))
+	defer bulb.Disconnect()
+
+	states := bulb.ConnectionStates(ctx)
+	assert.Equal(t, StateConnected, <-states)
+
+	first := <-accepted
+	first.Close()
+
+	assert.Equal(t, StateReconnecting, <-states)
+	assert.Equal(t, StateConnected, <-states)
+	assert.NoError(t, bulb.SetBrightness(ctx, 10, Sudden, 0))
+
+	require.NoError(t, bulb.Disconnect())
+	assert.Equal(t, StateDisconnected, <-states)
+	assert.ErrorIs(t, bulb.SetBrightness(ctx, 10, Sudden, 0), ErrNotConnected)
+}
+
+func TestBulbClosesConnectionWhenContextEnds(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn
+	}()
+
+	bulb := newBulb(BulbInfo{addr: netip.MustParseAddrPort(ln.Addr().String())})
+	ctx, cancel := context.WithCancel(context.Background())
+	require.NoError(t, bulb.Connect(ctx))
+
+	server := <-accepted
+	defer server.Close()
+
+	assert.Equal(t, StateConnected, bulb.ConnectionState())
+
+	cancel()
+	assert.Eventually(t, func() bool {
+		return bulb.ConnectionState() == StateDisconnected
+	}, time.Second, 5*time.Millisecond)
+
+	// the bulb's end is closed, so the server reads to EOF instead of hitting the deadline
+	require.NoError(t, server.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = io.ReadAll(server)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, bulb.SetBrightness(context.Background(), 10, Sudden, 0), ErrNotConnected)
+}
+
+func TestBulbGetCron(t *testing.T) {
+	bulb := newTestBulb(t)
+
+	jobs, err := bulb.GetCron(context.Background(), CronPowerOff)
+	require.NoError(t, err)
+	assert.Equal(t, []CronJob{{Type: CronPowerOff, Delay: 15}}, jobs)
+}
+
+func TestBulbSetSceneUpdatesState(t *testing.T) {
+	bulb := newTestBulb(t)
+
+	require.NoError(t, bulb.SetScene(context.Background(), SceneColorTemperature(2700, 40)))
 
-	_, err := callback(context.Background(), cmd)
-	assert.Error(t, err)
+	info := bulb.Info()
+	assert.Equal(t, PowerOn, info.Power())
+	assert.Equal(t, ColorModeTemperature, info.ColorMode())
+	assert.Equal(t, uint16(2700), info.ColorTemperature())
 }
 
-func TestGetCommandExecutionCallbackTimeout(t *testing.T) {
-	results := make(chan commandResult)
-	callback := getCommandExecutionCallback(results, 30*time.Millisecond)
+func TestBulbValidatesBeforeSending(t *testing.T) {
+	bulb := newBulb(BulbInfo{})
+	ctx := context.Background()
 
-	_, err := callback(context.Background(), command{ID: 3})
-	assert.Error(t, err)
+	assert.ErrorIs(t, bulb.SetColorTemperature(ctx, 1000, Sudden, 0), ErrColorTemperatureInvalid)
+	assert.ErrorIs(t, bulb.SetHueSaturation(ctx, 360, 50, Sudden, 0), ErrHueInvalid)
+	assert.ErrorIs(t, bulb.SetBrightness(ctx, 50, Smooth, 10), ErrDurationInvalid)
+	assert.ErrorIs(t, bulb.SetAdjust(ctx, AdjustIncrease, AdjustColor), ErrAdjustInvalid)
+	assert.ErrorIs(t, bulb.AdjustBrightness(ctx, 150, 500), ErrPercentageInvalid)
+	assert.ErrorIs(t, bulb.SetName(ctx, "two\r\nlines"), ErrNameInvalid)
+	assert.ErrorIs(t, bulb.AddCron(ctx, CronPowerOff, 0), ErrCronDelayInvalid)
+	assert.ErrorIs(t, bulb.SetScene(ctx, SceneHSV(10, 101, 50)), ErrSaturationInvalid)
 }
@@ -0,0 +1,72 @@
+package yeelight
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/rotisserie/eris"
+)
+
+var ErrUnsupported = eris.New("method not supported by bulb")
+
+// whiteModels are models without color, used when the support list is unknown. The
+// value reports whether the model has tunable white.
+var whiteModels = map[string]bool{
+	"mono":     false,
+	"mono1":    false,
+	"ct_bulb":  true,
+	"ceiling":  true,
+	"ceiling1": true,
+	"ceiling2": true,
+	"ceiling3": true,
+	"desklamp": true,
+	"lamp1":    true,
+}
+
+// UnsupportedError is returned for commands the bulb does not implement, either because
+// the method is missing from the support list it advertised or because the bulb
+// rejected it. It matches ErrUnsupported.
+type UnsupportedError struct {
+	Method string
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrUnsupported, e.Method)
+}
+
+func (e *UnsupportedError) Is(target error) bool {
+	return target == ErrUnsupported
+}
+
+// Supports reports whether the bulb advertised method. Bulbs that advertised nothing,
+// such as those created from an address alone, are assumed to support everything.
+func (bi BulbInfo) Supports(method string) bool {
+	return len(bi.support) == 0 || slices.Contains(bi.support, method)
+}
+
+// HasColor reports whether the bulb can show colors rather than only white light. It
+// goes by the support list and falls back to the model when the list is unknown.
+func (bi BulbInfo) HasColor() bool {
+	if len(bi.support) == 0 {
+		_, white := whiteModels[bi.model]
+		return !white
+	}
+
+	return bi.Supports("set_rgb") || bi.Supports("set_hsv")
+}
+
+// HasColorTemperature reports whether the bulb can change the temperature of its white
+// light.
+func (bi BulbInfo) HasColorTemperature() bool {
+	if len(bi.support) == 0 {
+		tunable, white := whiteModels[bi.model]
+		return !white || tunable
+	}
+
+	return bi.Supports("set_ct_abx")
+}
+
+func (e *BulbError) unsupported() bool {
+	return strings.Contains(strings.ToLower(e.Message), "not supported")
+}
@@ -0,0 +1,42 @@
+package yeelight
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSupports(t *testing.T) {
+	unknown := BulbInfo{}
+	assert.True(t, unknown.Supports("set_rgb"))
+	assert.True(t, unknown.HasColor())
+
+	mono := BulbInfo{support: []string{"get_prop", "set_power", "set_bright", "start_cf"}}
+	assert.True(t, mono.Supports("set_bright"))
+	assert.False(t, mono.Supports("set_rgb"))
+	assert.False(t, mono.HasColor())
+	assert.False(t, mono.HasColorTemperature())
+
+	ceiling := BulbInfo{model: "ceiling3"}
+	assert.False(t, ceiling.HasColor())
+	assert.True(t, ceiling.HasColorTemperature())
+}
+
+func TestUnsupportedCommandsAreNotSent(t *testing.T) {
+	bulb := newBulb(BulbInfo{support: []string{"get_prop", "set_power", "set_bright", "start_cf"}})
+	ctx := context.Background()
+
+	err := bulb.SetRGB(ctx, 255, 0, 0, Sudden, 0)
+	assert.ErrorIs(t, err, ErrUnsupported)
+
+	var unsupported *UnsupportedError
+	if assert.True(t, errors.As(err, &unsupported)) {
+		assert.Equal(t, "set_rgb", unsupported.Method)
+	}
+
+	assert.ErrorIs(t, bulb.SetHSV(ctx, 10, 50, 50, Sudden, 0), ErrUnsupported)
+	assert.ErrorIs(t, bulb.BackgroundLight().TurnOn(ctx, Sudden, 0), ErrUnsupported)
+	assert.ErrorIs(t, bulb.SetBrightness(ctx, 50, Sudden, 0), ErrNotConnected)
+}
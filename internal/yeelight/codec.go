@@ -0,0 +1,116 @@
+package yeelight
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"github.com/rotisserie/eris"
+)
+
+// maxMessageSize bounds a single line from the bulb. A get_prop reply for every
+// property a lamp knows is a few hundred bytes, so this only trips on garbage.
+const maxMessageSize = 64 * 1024
+
+// errMalformedMessage marks a line that is not a valid bulb message. The stream itself
+// is still intact, so readers skip the line and carry on.
+var errMalformedMessage = eris.New("malformed bulb message")
+
+type messageKind int
+
+const (
+	messageResult messageKind = iota + 1
+	messageError
+	messageNotification
+)
+
+func (k messageKind) String() string {
+	switch k {
+	case messageResult:
+		return "result"
+	case messageError:
+		return "error"
+	case messageNotification:
+		return "notification"
+	default:
+		return "unknown"
+	}
+}
+
+// message is one line received from a bulb. Kind says which of the other fields is
+// set: Reply for results and errors, Notification for notifications.
+type message struct {
+	Kind         messageKind
+	Reply        commandResult
+	Notification notification
+}
+
+// decodeMessage decodes a single line. Messages are told apart by the keys they carry,
+// not by their order, since nothing in the protocol fixes it.
+func decodeMessage(line []byte) (message, error) {
+	var raw struct {
+		ID     *int           `json:"id"`
+		Result resultValues   `json:"result"`
+		Error  *BulbError     `json:"error"`
+		Method string         `json:"method"`
+		Params map[string]any `json:"params"`
+	}
+	if err := json.Unmarshal(line, &raw); err != nil {
+		return message{}, eris.Wrapf(errMalformedMessage, "%q: %v", line, err)
+	}
+
+	switch {
+	case raw.ID != nil && raw.Error != nil:
+		return message{
+			Kind:  messageError,
+			Reply: commandResult{ID: *raw.ID, Error: raw.Error},
+		}, nil
+	case raw.ID != nil:
+		return message{
+			Kind:  messageResult,
+			Reply: commandResult{ID: *raw.ID, Result: raw.Result},
+		}, nil
+	case raw.Method != "":
+		return message{
+			Kind:         messageNotification,
+			Notification: notification{Method: raw.Method, Params: raw.Params},
+		}, nil
+	default:
+		return message{}, eris.Wrapf(errMalformedMessage, "%q is neither a reply nor a notification", line)
+	}
+}
+
+// messageReader decodes the bulb's CRLF-framed stream. Lines split across reads are
+// buffered until they are complete.
+type messageReader struct {
+	scanner *bufio.Scanner
+}
+
+func newMessageReader(r io.Reader) *messageReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), maxMessageSize)
+
+	return &messageReader{scanner: scanner}
+}
+
+// next returns the next message. Errors matching errMalformedMessage only affect that
+// line; any other error ends the stream, with io.EOF when the bulb closed it. The raw
+// line is only valid until the next call.
+func (r *messageReader) next() (message, []byte, error) {
+	for r.scanner.Scan() {
+		line := bytes.TrimSpace(r.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		msg, err := decodeMessage(line)
+		return msg, line, err
+	}
+
+	if err := r.scanner.Err(); err != nil {
+		return message{}, nil, err
+	}
+
+	return message{}, nil, io.EOF
+}
@@ -0,0 +1,141 @@
+package yeelight
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeMessageIgnoresKeyOrder(t *testing.T) {
+	msg, err := decodeMessage([]byte(`{"result":["ok"],"id":7}`))
+	require.NoError(t, err)
+	assert.Equal(t, messageResult, msg.Kind)
+	assert.Equal(t, commandResult{ID: 7, Result: resultValues{"ok"}}, msg.Reply)
+
+	msg, err = decodeMessage([]byte(`{"error":{"message":"client quota exceeded","code":-1},"id":8}`))
+	require.NoError(t, err)
+	assert.Equal(t, messageError, msg.Kind)
+	assert.Equal(t, 8, msg.Reply.ID)
+	assert.True(t, msg.Reply.Error.quotaExceeded())
+
+	msg, err = decodeMessage([]byte(`{"params":{"power":"off"},"method":"props"}`))
+	require.NoError(t, err)
+	assert.Equal(t, messageNotification, msg.Kind)
+	assert.Equal(t, notification{Method: "props", Params: map[string]any{"power": "off"}}, msg.Notification)
+}
+
+func TestDecodeMessageRejectsUnknownShapes(t *testing.T) {
+	for _, line := range []string{`{"id":1, garbage`, `{"foo":1}`, `[]`, `"ok"`} {
+		_, err := decodeMessage([]byte(line))
+		assert.ErrorIs(t, err, errMalformedMessage, line)
+	}
+}
+
+func TestMessageReaderBuffersPartialLines(t *testing.T) {
+	props := strings.Repeat(`"0123456789",`, 200)
+	stream := `{"id":1,"result":[` + props + `"end"]}` + lineEnding +
+		`not json` + lineEnding +
+		lineEnding +
+		`{"method":"props","params":{"bright":10}}` + lineEnding
+
+	reader := newMessageReader(iotest.OneByteReader(strings.NewReader(stream)))
+
+	msg, _, err := reader.next()
+	require.NoError(t, err)
+	assert.Equal(t, messageResult, msg.Kind)
+	assert.Len(t, msg.Reply.Result, 201)
+	assert.Equal(t, "end", msg.Reply.Result[200])
+
+	_, line, err := reader.next()
+	assert.ErrorIs(t, err, errMalformedMessage)
+	assert.Equal(t, "not json", string(line))
+
+	msg, _, err = reader.next()
+	require.NoError(t, err)
+	assert.Equal(t, messageNotification, msg.Kind)
+
+	_, _, err = reader.next()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func FuzzDecodeMessage(f *testing.F) {
+	f.Add([]byte(`{"id":1,"result":["ok"]}`))
+	f.Add([]byte(`{"id":2,"error":{"code":-1,"message":"method not supported"}}`))
+	f.Add([]byte(`{"method":"props","params":{"power":"on","bright":"10"}}`))
+	f.Add([]byte(`{"id":3,"result":[{"type":0,"delay":15,"mix":0}]}`))
+	f.Add([]byte(`{"id":null}`))
+
+	f.Fuzz(func(t *testing.T, line []byte) {
+		msg, err := decodeMessage(line)
+		if err != nil {
+			assert.ErrorIs(t, err, errMalformedMessage)
+			return
+		}
+
+		switch msg.Kind {
+		case messageResult:
+			assert.Nil(t, msg.Reply.Error)
+		case messageError:
+			assert.NotNil(t, msg.Reply.Error)
+		case messageNotification:
+			assert.NotEmpty(t, msg.Notification.Method)
+		default:
+			t.Fatalf("decoded message without a kind: %+v", msg)
+		}
+	})
+}
+
+// FuzzMessageReader checks that how the stream is chunked never changes what is decoded.
+func FuzzMessageReader(f *testing.F) {
+	f.Add(`{"id":1,"result":["ok"]}`+lineEnding+`{"method":"props","params":{"ct":2700}}`+lineEnding, uint8(3))
+	f.Add(`{"id":1,`+lineEnding+`"result":[]}`+lineEnding, uint8(1))
+	f.Add("\r\n\r\n{}\n", uint8(2))
+
+	f.Fuzz(func(t *testing.T, stream string, chunk uint8) {
+		whole := readAllMessages(t, strings.NewReader(stream))
+		chunked := readAllMessages(t, &chunkReader{data: stream, size: int(chunk)%16 + 1})
+
+		assert.Equal(t, whole, chunked)
+	})
+}
+
+func readAllMessages(t *testing.T, r io.Reader) []string {
+	t.Helper()
+
+	var decoded []string
+	reader := newMessageReader(r)
+	for {
+		msg, line, err := reader.next()
+		switch {
+		case err == nil:
+			decoded = append(decoded, msg.Kind.String()+" "+string(line))
+		case errors.Is(err, errMalformedMessage):
+			decoded = append(decoded, "malformed "+string(line))
+		default:
+			decoded = append(decoded, "end "+err.Error())
+			return decoded
+		}
+	}
+}
+
+// chunkReader returns at most size bytes per read.
+type chunkReader struct {
+	data string
+	size int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if r.data == "" {
+		return 0, io.EOF
+	}
+
+	n := copy(p[:min(len(p), r.size)], r.data)
+	r.data = r.data[n:]
+
+	return n, nil
+}
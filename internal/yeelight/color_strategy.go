@@ -0,0 +1,290 @@
+package yeelight
+
+import (
+	"context"
+	"time"
+
+	"github.com/rotisserie/eris"
+)
+
+// slowResponseTime is the reply time above which a bulb is treated as busy. Such bulbs
+// fall behind when every frame restarts the flow engine.
+const slowResponseTime = 150 * time.Millisecond
+
+// ColorStrategy is the command SetHSV and SetWhite use to set color and brightness
+// together. The strategies look different on different models, so it can be forced for
+// comparison.
+type ColorStrategy string
+
+const (
+	// ColorStrategyAuto picks a strategy from the bulb's model, support list and
+	// response time.
+	ColorStrategyAuto ColorStrategy = "auto"
+	// ColorStrategyFlow sends a single-step start_cf. It is one command with a smooth
+	// transition, but starts the bulb's flow engine every time.
+	ColorStrategyFlow ColorStrategy = "flow"
+	// ColorStrategyRGB sends set_rgb followed by set_bright when the brightness changed.
+	ColorStrategyRGB ColorStrategy = "rgb"
+	// ColorStrategyHSV sends set_hsv followed by set_bright when the brightness changed.
+	ColorStrategyHSV ColorStrategy = "hsv"
+	// ColorStrategyScene sends set_scene color. It is one command, but always sudden.
+	ColorStrategyScene ColorStrategy = "scene"
+)
+
+var ErrColorStrategyInvalid = newInvalidParameter("color strategy must be auto, flow, rgb, hsv or scene")
+
+// ParseColorStrategy parses the name of a color strategy.
+func ParseColorStrategy(name string) (ColorStrategy, error) {
+	strategy := ColorStrategy(name)
+	switch strategy {
+	case ColorStrategyAuto, ColorStrategyFlow, ColorStrategyRGB, ColorStrategyHSV, ColorStrategyScene:
+		return strategy, nil
+	default:
+		return "", eris.Wrapf(ErrColorStrategyInvalid, "%q", name)
+	}
+}
+
+// colorMethods lists the commands each strategy sends for SetHSV, in order.
+var colorMethods = map[ColorStrategy][]string{
+	ColorStrategyFlow:  {"start_cf"},
+	ColorStrategyRGB:   {"set_rgb", "set_bright"},
+	ColorStrategyHSV:   {"set_hsv", "set_bright"},
+	ColorStrategyScene: {"set_scene"},
+}
+
+// whiteMethods lists the commands each strategy sends for SetWhite. White light has no
+// RGB or HSV form, so both send set_ct_abx.
+var whiteMethods = map[ColorStrategy][]string{
+	ColorStrategyFlow:  {"start_cf"},
+	ColorStrategyRGB:   {"set_ct_abx", "set_bright"},
+	ColorStrategyHSV:   {"set_ct_abx", "set_bright"},
+	ColorStrategyScene: {"set_scene"},
+}
+
+// Commands returns the most commands the strategy sends for one SetHSV or SetWhite
+// call. ColorStrategyAuto counts the strategy that sends the most, since the one it
+// picks can change with the bulb's response time.
+func (s ColorStrategy) Commands() int {
+	commands := 1
+	for strategy, methods := range colorMethods {
+		if s == strategy || s == ColorStrategyAuto {
+			commands = max(commands, len(methods), len(whiteMethods[strategy]))
+		}
+	}
+
+	return commands
+}
+
+// modelStrategy prefers a strategy for a model.
+type modelStrategy struct {
+	model    string
+	strategy ColorStrategy
+}
+
+// modelStrategies are the starting strategies for these models. They are defaults, not
+// measurements; --color-strategy overrides them. Models not listed use the default
+// order.
+var modelStrategies = []modelStrategy{
+	{model: "color", strategy: ColorStrategyRGB},
+	{model: "strip1", strategy: ColorStrategyHSV},
+	{model: "bslamp1", strategy: ColorStrategyScene},
+}
+
+// preferredStrategy returns the strategy modelStrategies lists for the bulb, if any.
+func preferredStrategy(info BulbInfo) (ColorStrategy, bool) {
+	for _, entry := range modelStrategies {
+		if entry.model == info.model {
+			return entry.strategy, true
+		}
+	}
+
+	return "", false
+}
+
+// resolveColorStrategy turns ColorStrategyAuto into a concrete strategy. The model's
+// preferred strategy comes first, unless it is start_cf and the bulb is slow to answer.
+// Otherwise a single command is preferred, and start_cf is preferred over set_scene for
+// its transition unless the bulb is slow. responseTime is zero until it was measured.
+func resolveColorStrategy(info BulbInfo, background bool, responseTime time.Duration, methods map[ColorStrategy][]string) ColorStrategy {
+	slow := responseTime > slowResponseTime
+
+	preferred := []ColorStrategy{ColorStrategyFlow, ColorStrategyScene, ColorStrategyRGB, ColorStrategyHSV}
+	if slow {
+		preferred = []ColorStrategy{ColorStrategyScene, ColorStrategyRGB, ColorStrategyHSV, ColorStrategyFlow}
+	}
+
+	if strategy, ok := preferredStrategy(info); ok && !(slow && strategy == ColorStrategyFlow) {
+		preferred = append([]ColorStrategy{strategy}, preferred...)
+	}
+
+	for _, strategy := range preferred {
+		if supportsAll(info, background, methods[strategy]) {
+			return strategy
+		}
+	}
+
+	return ColorStrategyFlow
+}
+
+func supportsAll(info BulbInfo, background bool, methods []string) bool {
+	for _, method := range methods {
+		if background {
+			method = backgroundMethodPrefix + method
+		}
+		if !info.Supports(method) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// SetColorStrategy selects how SetHSV sends colors, for both lights of the bulb and for
+// its music mode connection.
+func (bb *bulbBase) SetColorStrategy(strategy ColorStrategy) error {
+	if _, err := ParseColorStrategy(string(strategy)); err != nil {
+		return eris.Wrap(err, "failed to set color strategy")
+	}
+
+	bb.colorStrategy.Store(&strategy)
+
+	return nil
+}
+
+// ColorStrategy returns the strategy SetHSV uses for the main light, with
+// ColorStrategyAuto resolved.
+func (bb *bulbBase) ColorStrategy() ColorStrategy {
+	return bb.light.activeColorStrategy(colorMethods)
+}
+
+// WhiteStrategy returns the strategy SetWhite uses for the main light, with
+// ColorStrategyAuto resolved.
+func (bb *bulbBase) WhiteStrategy() ColorStrategy {
+	return bb.light.activeColorStrategy(whiteMethods)
+}
+
+func (l light) activeColorStrategy(methods map[ColorStrategy][]string) ColorStrategy {
+	strategy := ColorStrategyAuto
+	if configured := l.bb.colorStrategy.Load(); configured != nil {
+		strategy = *configured
+	}
+
+	if strategy != ColorStrategyAuto {
+		return strategy
+	}
+
+	return resolveColorStrategy(l.bb.Info(), l.background, l.bb.ResponseTime(), methods)
+}
+
+// setColor sends a color, given both as hue and saturation and as RGB, at the given
+// brightness using the light's color strategy.
+func (l light) setColor(ctx context.Context, hue uint16, saturation uint8, rgb uint, brightness uint8, effect Effect, duration int) error {
+	current := l.lightInfo()
+	strategy := l.activeColorStrategy(colorMethods)
+
+	// only what the bulb was actually sent is recorded
+	var colorSent, brightnessSent bool
+	switch strategy {
+	case ColorStrategyFlow:
+		// The flow engine rejects steps shorter than 50ms, so sudden changes are
+		// stretched to that.
+		step := max(time.Duration(duration)*time.Millisecond, minFlowStepDuration)
+		r, g, b := uint8(rgb>>16), uint8(rgb>>8), uint8(rgb)
+		flow := NewFlow().RGB(step, r, g, b, int(brightness)).EndWith(FlowStay)
+		sent, err := l.execute(ctx, l.method("start_cf"), flow.params()...)
+		if err != nil {
+			return err
+		}
+		colorSent, brightnessSent = sent, sent
+	case ColorStrategyScene:
+		sent, err := l.execute(ctx, l.method("set_scene"), "color", rgb, brightness)
+		if err != nil {
+			return err
+		}
+		colorSent, brightnessSent = sent, sent
+	case ColorStrategyRGB, ColorStrategyHSV:
+		var err error
+		if strategy == ColorStrategyRGB {
+			colorSent, err = l.execute(ctx, l.method("set_rgb"), rgb, effect, duration)
+		} else {
+			colorSent, err = l.execute(ctx, l.method("set_hsv"), hue, saturation, effect, duration)
+		}
+		if err != nil {
+			return err
+		}
+
+		if brightness != current.Brightness() {
+			if brightnessSent, err = l.execute(ctx, l.method("set_bright"), brightness, effect, duration); err != nil {
+				return err
+			}
+		}
+	default:
+		return eris.Wrapf(ErrColorStrategyInvalid, "%q", strategy)
+	}
+
+	l.updateLight(func(light *LightInfo) {
+		if colorSent {
+			light.colorMode = ColorModeRGB
+			if strategy == ColorStrategyHSV {
+				light.colorMode = ColorModeHSV
+			}
+			light.hue = hue
+			light.saturation = saturation
+			light.rgb = rgb
+		}
+		if brightnessSent {
+			light.brightness = brightness
+		}
+	})
+
+	return nil
+}
+
+// setWhite sends a color temperature at the given brightness using the light's color
+// strategy.
+func (l light) setWhite(ctx context.Context, colorTemperature uint16, brightness uint8, effect Effect, duration int) error {
+	current := l.lightInfo()
+
+	var temperatureSent, brightnessSent bool
+	switch strategy := l.activeColorStrategy(whiteMethods); strategy {
+	case ColorStrategyFlow:
+		step := max(time.Duration(duration)*time.Millisecond, minFlowStepDuration)
+		flow := NewFlow().Temperature(step, colorTemperature, int(brightness)).EndWith(FlowStay)
+		sent, err := l.execute(ctx, l.method("start_cf"), flow.params()...)
+		if err != nil {
+			return err
+		}
+		temperatureSent, brightnessSent = sent, sent
+	case ColorStrategyScene:
+		sent, err := l.execute(ctx, l.method("set_scene"), "ct", colorTemperature, brightness)
+		if err != nil {
+			return err
+		}
+		temperatureSent, brightnessSent = sent, sent
+	case ColorStrategyRGB, ColorStrategyHSV:
+		var err error
+		if temperatureSent, err = l.execute(ctx, l.method("set_ct_abx"), colorTemperature, effect, duration); err != nil {
+			return err
+		}
+
+		if brightness != current.Brightness() {
+			if brightnessSent, err = l.execute(ctx, l.method("set_bright"), brightness, effect, duration); err != nil {
+				return err
+			}
+		}
+	default:
+		return eris.Wrapf(ErrColorStrategyInvalid, "%q", strategy)
+	}
+
+	l.updateLight(func(light *LightInfo) {
+		if temperatureSent {
+			light.colorMode = ColorModeTemperature
+			light.colorTemperature = colorTemperature
+		}
+		if brightnessSent {
+			light.brightness = brightness
+		}
+	})
+
+	return nil
+}
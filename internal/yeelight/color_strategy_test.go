@@ -0,0 +1,105 @@
+package yeelight
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseColorStrategy(t *testing.T) {
+	strategy, err := ParseColorStrategy("scene")
+	require.NoError(t, err)
+	assert.Equal(t, ColorStrategyScene, strategy)
+
+	_, err = ParseColorStrategy("cf")
+	assert.ErrorIs(t, err, ErrColorStrategyInvalid)
+}
+
+func TestColorStrategyCommands(t *testing.T) {
+	assert.Equal(t, 1, ColorStrategyFlow.Commands())
+	assert.Equal(t, 1, ColorStrategyScene.Commands())
+	assert.Equal(t, 2, ColorStrategyRGB.Commands())
+	assert.Equal(t, 2, ColorStrategyHSV.Commands())
+	assert.Equal(t, 2, ColorStrategyAuto.Commands())
+}
+
+func TestResolveColorStrategy(t *testing.T) {
+	full := []string{"start_cf", "set_scene", "set_rgb", "set_hsv", "set_bright"}
+
+	tests := []struct {
+		name         string
+		support      []string
+		background   bool
+		responseTime time.Duration
+		want         ColorStrategy
+	}{
+		{name: "unknown support list", want: ColorStrategyFlow},
+		{name: "fast bulb", support: full, responseTime: 40 * time.Millisecond, want: ColorStrategyFlow},
+		{name: "slow bulb", support: full, responseTime: 300 * time.Millisecond, want: ColorStrategyScene},
+		{name: "no flows", support: []string{"set_scene", "set_rgb", "set_bright"}, want: ColorStrategyScene},
+		{name: "plain commands only", support: []string{"set_hsv", "set_bright"}, want: ColorStrategyHSV},
+		{name: "background ring", support: []string{"start_cf", "bg_set_rgb", "bg_set_bright"}, background: true, want: ColorStrategyRGB},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := BulbInfo{support: tt.support}
+			assert.Equal(t, tt.want, resolveColorStrategy(info, tt.background, tt.responseTime, colorMethods))
+		})
+	}
+}
+
+func TestResolveColorStrategyByModel(t *testing.T) {
+	full := []string{"start_cf", "set_scene", "set_rgb", "set_hsv", "set_bright"}
+
+	tests := []struct {
+		name         string
+		model        string
+		support      []string
+		responseTime time.Duration
+		want         ColorStrategy
+	}{
+		{name: "color bulb", model: "color", support: full, want: ColorStrategyRGB},
+		{name: "strip", model: "strip1", support: full, want: ColorStrategyHSV},
+		{name: "slow strip", model: "strip1", support: full, responseTime: 300 * time.Millisecond, want: ColorStrategyHSV},
+		{name: "bedside lamp", model: "bslamp1", support: full, want: ColorStrategyScene},
+		{name: "unlisted model", model: "color4", support: full, want: ColorStrategyFlow},
+		{name: "preference not supported", model: "strip1", support: []string{"start_cf", "set_rgb", "set_bright"}, want: ColorStrategyFlow},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := BulbInfo{model: tt.model, support: tt.support}
+			assert.Equal(t, tt.want, resolveColorStrategy(info, false, tt.responseTime, colorMethods))
+		})
+	}
+}
+
+func TestConfiguredStrategyOverridesModel(t *testing.T) {
+	bulb := newBulb(BulbInfo{model: "color", support: []string{"start_cf", "set_rgb", "set_bright"}})
+	assert.Equal(t, ColorStrategyRGB, bulb.ColorStrategy())
+
+	require.NoError(t, bulb.SetColorStrategy(ColorStrategyFlow))
+	assert.Equal(t, ColorStrategyFlow, bulb.ColorStrategy())
+}
+
+func TestResolveWhiteStrategy(t *testing.T) {
+	info := BulbInfo{support: []string{"set_ct_abx", "set_bright", "set_scene"}}
+	assert.Equal(t, ColorStrategyScene, resolveColorStrategy(info, false, 0, whiteMethods))
+
+	info = BulbInfo{support: []string{"set_ct_abx", "set_bright"}}
+	assert.Equal(t, ColorStrategyRGB, resolveColorStrategy(info, false, 0, whiteMethods))
+}
+
+func TestResponseTimeAverage(t *testing.T) {
+	state := newBulbState(BulbInfo{})
+	assert.Zero(t, state.ResponseTime())
+
+	state.observeResponseTime(100 * time.Millisecond)
+	assert.Equal(t, 100*time.Millisecond, state.ResponseTime())
+
+	state.observeResponseTime(200 * time.Millisecond)
+	assert.Equal(t, 125*time.Millisecond, state.ResponseTime())
+}
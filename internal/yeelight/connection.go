@@ -0,0 +1,399 @@
+package yeelight
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rotisserie/eris"
+)
+
+type commandResult struct {
+	ID     int          `json:"id"`
+	Result resultValues `json:"result"`
+	Error  *BulbError   `json:"error"`
+}
+
+type notification struct {
+	Method string         `json:"method"`
+	Params map[string]any `json:"params"`
+}
+
+// connection owns a bulb socket. A single goroutine assigns command IDs and performs
+// every write while another reads replies and notifications; callers only submit
+// commands and wait on the returned futures.
+type connection struct {
+	addr           string
+	conn           net.Conn
+	pending        *pendingRequests
+	writeTimeout   time.Duration
+	onNotification func(notification)
+
+	requests  chan commandRequest
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+type commandRequest struct {
+	ctx         context.Context
+	method      string
+	params      []any
+	expectReply bool
+	future      *commandFuture
+}
+
+// commandFuture resolves once the command was written and, if the connection expects
+// replies, once the bulb answered it.
+type commandFuture struct {
+	written chan error
+	cmd     command
+	reply   <-chan commandResult
+	pending *pendingRequests
+}
+
+// newConnection takes ownership of conn. pending is nil for connections the bulb never
+// replies on, such as music mode. A write that takes longer than writeTimeout drops the
+// connection. Reads block until the bulb sends something or the connection is closed.
+func newConnection(conn net.Conn, pending *pendingRequests, writeTimeout time.Duration, onNotification func(notification)) *connection {
+	c := &connection{
+		addr:           conn.RemoteAddr().String(),
+		conn:           conn,
+		pending:        pending,
+		writeTimeout:   writeTimeout,
+		onNotification: onNotification,
+		requests:       make(chan commandRequest),
+		done:           make(chan struct{}),
+	}
+
+	go c.writeLoop()
+	go c.readLoop()
+
+	return c
+}
+
+func (c *connection) localAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// closed is closed once the connection shuts down.
+func (c *connection) closed() <-chan struct{} {
+	return c.done
+}
+
+func (c *connection) close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.closeErr = c.conn.Close()
+		if c.pending != nil {
+			c.pending.abandon()
+		}
+	})
+
+	return c.closeErr
+}
+
+// execute sends a command and, on connections the bulb replies on, waits for the bulb
+// to answer it.
+func (c *connection) execute(ctx context.Context, method string, params ...any) ([]string, error) {
+	return c.submit(ctx, method, params...).wait(ctx)
+}
+
+func (c *connection) submit(ctx context.Context, method string, params ...any) *commandFuture {
+	future := &commandFuture{
+		written: make(chan error, 1),
+		pending: c.pending,
+	}
+
+	req := commandRequest{
+		ctx:         ctx,
+		method:      method,
+		params:      params,
+		expectReply: c.pending != nil,
+		future:      future,
+	}
+
+	select {
+	case c.requests <- req:
+	case <-c.done:
+		future.written <- ErrConnectionLost
+	case <-ctx.Done():
+		future.written <- eris.Wrap(ctx.Err(), "failed to execute command")
+	}
+
+	return future
+}
+
+func (f *commandFuture) wait(ctx context.Context) ([]string, error) {
+	select {
+	case err := <-f.written:
+		if err != nil {
+			return nil, err
+		}
+	case <-ctx.Done():
+		return nil, eris.Wrap(ctx.Err(), "failed to execute command")
+	}
+
+	if f.reply == nil {
+		return nil, nil
+	}
+
+	return f.pending.wait(ctx, f.cmd, f.reply)
+}
+
+func (c *connection) writeLoop() {
+	lastCommandID := 0
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case req := <-c.requests:
+			if err := req.ctx.Err(); err != nil {
+				req.future.written <- eris.Wrap(err, "failed to execute command")
+				continue
+			}
+
+			lastCommandID++
+			cmd := newCommand(lastCommandID, req.method, req.params...)
+
+			commandText, err := cmd.String()
+			if err != nil {
+				req.future.written <- err
+				continue
+			}
+
+			req.future.cmd = cmd
+			if req.expectReply {
+				req.future.reply = c.pending.register(cmd.ID)
+			}
+
+			if err := c.write(req.ctx, cmd, commandText); err != nil {
+				if req.expectReply {
+					c.pending.forget(cmd.ID)
+					req.future.reply = nil
+				}
+				req.future.written <- err
+
+				// a caller giving up before anything was written only fails its own
+				// command
+				if !eris.Is(err, ErrConnectionLost) {
+					continue
+				}
+
+				// a failed write leaves the stream in an unknown state; drop the
+				// connection so the owner can re-establish it
+				c.close()
+				return
+			}
+
+			req.future.written <- nil
+		}
+	}
+}
+
+// write sends one command. It gives up after the write timeout or once ctx is done, as a
+// bulb that stopped reading would otherwise block it forever. It returns ErrConnectionLost
+// unless ctx ended before any of the command was written, which leaves the stream
+// intact.
+func (c *connection) write(ctx context.Context, cmd command, commandText string) error {
+	slog.Debug("executing command",
+		slog.String("addr", c.addr),
+		slog.Int("id", cmd.ID),
+		slog.String("method", cmd.Method),
+		slog.Any("params", cmd.Params),
+		slog.String("command", commandText),
+	)
+
+	if err := c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout)); err != nil {
+		return eris.Wrapf(ErrConnectionLost, "failed to set write deadline: %v", err)
+	}
+
+	// ctx ending, by cancellation or its own deadline, moves the write deadline to now,
+	// which unblocks Write. If that already started, it must finish before the next
+	// write sets its own deadline.
+	cancelled := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(cancelled)
+		_ = c.conn.SetWriteDeadline(time.Now())
+	})
+	defer func() {
+		if !stop() {
+			<-cancelled
+		}
+	}()
+
+	if n, err := c.conn.Write([]byte(commandText)); err != nil {
+		if n == 0 && ctx.Err() != nil {
+			return eris.Wrap(ctx.Err(), "cancelled before writing command to connection")
+		}
+		return eris.Wrapf(ErrConnectionLost, "failed to write command to connection: %v", err)
+	}
+
+	return nil
+}
+
+func (c *connection) readLoop() {
+	defer c.close()
+
+	reader := newMessageReader(c.conn)
+
+	for {
+		msg, line, err := reader.next()
+		if err != nil {
+			if eris.Is(err, errMalformedMessage) {
+				slog.Warn("ignoring malformed bulb message",
+					slog.String("addr", c.addr),
+					slog.Any("error", err),
+				)
+				continue
+			}
+
+			select {
+			case <-c.done:
+				return
+			default:
+			}
+
+			if eris.Is(err, net.ErrClosed) {
+				return
+			}
+
+			if eris.Is(err, io.EOF) {
+				slog.Warn("bulb closed the connection", slog.String("addr", c.addr))
+				return
+			}
+
+			slog.Error("failed to read data from bulb connection",
+				slog.String("addr", c.addr),
+				slog.Any("error", err),
+			)
+			return
+		}
+
+		slog.Debug("received message from bulb",
+			slog.String("addr", c.addr),
+			slog.String("kind", msg.Kind.String()),
+			slog.String("message", string(line)),
+		)
+
+		c.dispatch(msg)
+	}
+}
+
+func (c *connection) dispatch(msg message) {
+	switch msg.Kind {
+	case messageResult, messageError:
+		if c.pending == nil || !c.pending.resolve(msg.Reply) {
+			slog.Warn("discarding unmatched bulb reply",
+				slog.String("addr", c.addr),
+				slog.Int("id", msg.Reply.ID),
+			)
+		}
+	case messageNotification:
+		if c.onNotification != nil {
+			c.onNotification(msg.Notification)
+		}
+	}
+}
+
+// pendingRequests correlates replies from the bulb with the commands waiting for them,
+// so concurrent callers never receive each other's results.
+type pendingRequests struct {
+	mu      sync.Mutex
+	waiters map[int]chan commandResult
+	timeout time.Duration
+}
+
+func newPendingRequests(timeout time.Duration) *pendingRequests {
+	return &pendingRequests{
+		waiters: make(map[int]chan commandResult),
+		timeout: timeout,
+	}
+}
+
+// register must be called before the command is written so a fast reply cannot
+// arrive ahead of its waiter.
+func (p *pendingRequests) register(id int) <-chan commandResult {
+	reply := make(chan commandResult, 1)
+
+	p.mu.Lock()
+	p.waiters[id] = reply
+	p.mu.Unlock()
+
+	return reply
+}
+
+func (p *pendingRequests) forget(id int) {
+	p.mu.Lock()
+	delete(p.waiters, id)
+	p.mu.Unlock()
+}
+
+// resolve hands the result to the caller waiting for its ID. It reports false when
+// nobody is waiting, e.g. because the request already timed out.
+func (p *pendingRequests) resolve(result commandResult) bool {
+	p.mu.Lock()
+	reply, ok := p.waiters[result.ID]
+	delete(p.waiters, result.ID)
+	p.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	reply <- result
+
+	return true
+}
+
+// abandon releases every waiter once the connection is gone; their replies can no
+// longer arrive.
+func (p *pendingRequests) abandon() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for id, reply := range p.waiters {
+		close(reply)
+		delete(p.waiters, id)
+	}
+}
+
+func (p *pendingRequests) wait(ctx context.Context, cmd command, reply <-chan commandResult) ([]string, error) {
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+
+	select {
+	case result, ok := <-reply:
+		if !ok {
+			return nil, eris.Wrapf(ErrConnectionLost, "command %s (%d) was not answered", cmd.Method, cmd.ID)
+		}
+
+		if result.Error != nil {
+			if result.Error.quotaExceeded() {
+				return nil, eris.Wrapf(&QuotaError{}, "failed to execute command %s (%v)", cmd.Method, cmd.Params)
+			}
+			if result.Error.unsupported() {
+				return nil, eris.Wrapf(&UnsupportedError{Method: cmd.Method}, "failed to execute command %s (%v)", cmd.Method, cmd.Params)
+			}
+			bulbErr := *result.Error
+			bulbErr.Method = cmd.Method
+			return nil, eris.Wrapf(&bulbErr, "failed to execute command %s (%v)", cmd.Method, cmd.Params)
+		}
+
+		if len(result.Result) == 1 && result.Result[0] == "ok" {
+			return nil, nil
+		}
+
+		return result.Result, nil
+	case <-timer.C:
+		p.forget(cmd.ID)
+		return nil, eris.Wrapf(&TimeoutError{Method: cmd.Method, After: p.timeout}, "failed to execute command %s (%v)", cmd.Method, cmd.Params)
+	case <-ctx.Done():
+		p.forget(cmd.ID)
+		return nil, eris.Wrapf(ctx.Err(), "failed to execute command %s (%v)", cmd.Method, cmd.Params)
+	}
+}
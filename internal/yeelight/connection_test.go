@@ -0,0 +1,170 @@
+package yeelight
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPendingRequestsSuccess(t *testing.T) {
+	pending := newPendingRequests(50 * time.Millisecond)
+
+	cmd := command{ID: 1}
+	reply := pending.register(cmd.ID)
+	assert.True(t, pending.resolve(commandResult{ID: 1, Result: []string{"value"}}))
+
+	resp, err := pending.wait(context.Background(), cmd, reply)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"value"}, resp)
+}
+
+func TestPendingRequestsError(t *testing.T) {
+	pending := newPendingRequests(50 * time.Millisecond)
+
+	cmd := command{ID: 2, Method: "test", Params: []any{"a"}}
+	reply := pending.register(cmd.ID)
+	pending.resolve(commandResult{
+		ID:    2,
+		Error: &BulbError{Code: 500, Message: "boom"},
+	})
+
+	_, err := pending.wait(context.Background(), cmd, reply)
+	assert.ErrorIs(t, err, ErrBulb)
+
+	var bulbErr *BulbError
+	require.ErrorAs(t, err, &bulbErr)
+	assert.Equal(t, 500, bulbErr.Code)
+	assert.Equal(t, "boom", bulbErr.Message)
+	assert.Equal(t, "test", bulbErr.Method)
+	assert.NotErrorIs(t, err, ErrTimeout)
+}
+
+func TestPendingRequestsTimeout(t *testing.T) {
+	pending := newPendingRequests(30 * time.Millisecond)
+
+	cmd := command{ID: 3, Method: "get_prop"}
+	reply := pending.register(cmd.ID)
+
+	_, err := pending.wait(context.Background(), cmd, reply)
+	assert.ErrorIs(t, err, ErrTimeout)
+
+	var timeoutErr *TimeoutError
+	require.ErrorAs(t, err, &timeoutErr)
+	assert.Equal(t, "get_prop", timeoutErr.Method)
+	assert.Equal(t, 30*time.Millisecond, timeoutErr.After)
+	assert.True(t, timeoutErr.Timeout())
+
+	// a late reply must not be delivered to anyone
+	assert.False(t, pending.resolve(commandResult{ID: 3, Result: []string{"ok"}}))
+}
+
+func TestPendingRequestsUnmatchedReply(t *testing.T) {
+	pending := newPendingRequests(30 * time.Millisecond)
+
+	cmd := command{ID: 4}
+	reply := pending.register(cmd.ID)
+
+	assert.False(t, pending.resolve(commandResult{ID: 5, Result: []string{"on"}}))
+
+	_, err := pending.wait(context.Background(), cmd, reply)
+	assert.Error(t, err)
+}
+
+func TestPendingRequestsConcurrentCallers(t *testing.T) {
+	pending := newPendingRequests(time.Second)
+
+	const callers = 16
+	replies := make([]<-chan commandResult, callers)
+	for i := range callers {
+		replies[i] = pending.register(i + 1)
+	}
+
+	var wg sync.WaitGroup
+	results := make([][]string, callers)
+	for i := range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := pending.wait(context.Background(), command{ID: i + 1}, replies[i])
+			assert.NoError(t, err)
+			results[i] = resp
+		}()
+	}
+
+	// reply in reverse order to make sure routing is by ID, not arrival
+	for i := callers; i > 0; i-- {
+		assert.True(t, pending.resolve(commandResult{ID: i, Result: []string{string(rune('a' + i))}}))
+	}
+	wg.Wait()
+
+	for i := range callers {
+		assert.Equal(t, []string{string(rune('a' + i + 1))}, results[i])
+	}
+}
+
+func TestPendingRequestsContextCancelled(t *testing.T) {
+	pending := newPendingRequests(time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	cmd := command{ID: 6}
+	_, err := pending.wait(ctx, cmd, pending.register(cmd.ID))
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.False(t, pending.resolve(commandResult{ID: 6}))
+}
+
+func TestConnectionWriteTimeoutDropsConnection(t *testing.T) {
+	// nobody reads from server, so every write blocks
+	client, server := net.Pipe()
+	defer server.Close()
+
+	c := newConnection(client, nil, 30*time.Millisecond, nil)
+	defer c.close()
+
+	_, err := c.execute(context.Background(), "set_power", "on")
+	assert.ErrorIs(t, err, ErrConnectionLost)
+
+	select {
+	case <-c.closed():
+	case <-time.After(time.Second):
+		t.Fatal("connection was not dropped after the write timed out")
+	}
+}
+
+func TestCancelledCommandKeepsConnection(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	bulb := newBulb(BulbInfo{addr: netip.MustParseAddrPort("127.0.0.1:55443")})
+	bulb.limiter = newCommandLimiter(100, 0, time.Millisecond)
+	bulb.SetTimeouts(Timeouts{Write: time.Minute})
+	bulb.attach(client)
+	defer bulb.Disconnect()
+
+	// nobody reads from server yet, so the write blocks until ctx is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(30*time.Millisecond, cancel)
+
+	err := bulb.SetBrightness(ctx, 10, Sudden, 0)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, StateConnected, bulb.ConnectionState())
+
+	serveTestBulb(t, server)
+	require.NoError(t, bulb.SetBrightness(context.Background(), 20, Sudden, 0))
+	assert.Equal(t, StateConnected, bulb.ConnectionState())
+
+	conn, err := bulb.connection()
+	require.NoError(t, err)
+	select {
+	case <-conn.closed():
+		t.Fatal("cancelling one command dropped the connection")
+	default:
+	}
+}
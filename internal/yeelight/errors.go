@@ -0,0 +1,84 @@
+package yeelight
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rotisserie/eris"
+)
+
+// Errors returned by this package wrap one of the following, so callers can tell the
+// cases apart with errors.Is, or reach the details with errors.As:
+//
+//   - ErrTimeout, as *TimeoutError: the bulb did not answer a command in time.
+//   - ErrConnectionLost and ErrNotConnected: the command could not reach the bulb.
+//   - ErrQuotaExceeded, as *QuotaError: the command quota is used up.
+//   - ErrUnsupported, as *UnsupportedError: the bulb does not implement the method.
+//   - ErrInvalidParameter: a parameter was rejected before anything was sent. The
+//     specific sentinels, such as ErrBrightnessInvalid, all match it.
+//   - ErrBulb, as *BulbError: the bulb answered with any other error.
+var (
+	ErrTimeout          = eris.New("bulb did not answer in time")
+	ErrInvalidParameter = eris.New("invalid parameter")
+	ErrBulb             = eris.New("bulb reported an error")
+)
+
+// TimeoutError is returned when the bulb does not answer a command in time. It matches
+// ErrTimeout.
+type TimeoutError struct {
+	Method string
+	After  time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s: no answer to %s within %s", ErrTimeout, e.Method, e.After)
+}
+
+func (e *TimeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
+
+// Timeout reports true, as net.Error does for timeouts.
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// BulbError is an error reply from the bulb, with the bulb's own code and message. It
+// matches ErrBulb. Replies about the quota or an unsupported method are returned as
+// QuotaError and UnsupportedError instead.
+type BulbError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	// Method is the command the bulb rejected.
+	Method string `json:"-"`
+}
+
+func (e *BulbError) Error() string {
+	if e.Method != "" {
+		return fmt.Sprintf("bulb rejected %s: %s (%d)", e.Method, e.Message, e.Code)
+	}
+
+	return fmt.Sprintf("%s (%d)", e.Message, e.Code)
+}
+
+func (e *BulbError) Is(target error) bool {
+	return target == ErrBulb
+}
+
+// invalidParameter is the type of the sentinels for rejected parameters, so each of
+// them also matches ErrInvalidParameter.
+type invalidParameter struct {
+	message string
+}
+
+func newInvalidParameter(message string) error {
+	return &invalidParameter{message: message}
+}
+
+func (e *invalidParameter) Error() string {
+	return e.message
+}
+
+func (e *invalidParameter) Is(target error) bool {
+	return target == ErrInvalidParameter
+}
@@ -0,0 +1,171 @@
+package yeelight
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cybre/yeelight-music-sync/internal/utils"
+	"github.com/rotisserie/eris"
+)
+
+const (
+	// shortest step the flow engine accepts
+	minFlowStepDuration = 50 * time.Millisecond
+	// KeepBrightness leaves the brightness of a flow step unchanged.
+	KeepBrightness = -1
+)
+
+var ErrFlowInvalid = newInvalidParameter("invalid color flow")
+
+// FlowAction is what the bulb does once a color flow ends.
+type FlowAction int
+
+const (
+	// FlowRecover returns to the state before the flow started.
+	FlowRecover FlowAction = iota
+	// FlowStay keeps the state of the last step.
+	FlowStay
+	// FlowOff turns the light off.
+	FlowOff
+)
+
+type flowMode int
+
+const (
+	flowModeColor       flowMode = 1
+	flowModeTemperature flowMode = 2
+	flowModeSleep       flowMode = 7
+)
+
+type flowStep struct {
+	duration   time.Duration
+	mode       flowMode
+	value      uint
+	brightness int
+}
+
+// Flow is a color flow run by the bulb's flow engine. Build one from NewFlow; every
+// method returns a new Flow, so a Flow value can be shared and extended freely.
+//
+//	yeelight.NewFlow().
+//		RGB(500*time.Millisecond, 255, 0, 0, 100).
+//		Sleep(time.Second).
+//		Temperature(500*time.Millisecond, 2700, 40).
+//		Repeat(3).
+//		EndWith(yeelight.FlowStay)
+type Flow struct {
+	steps   []flowStep
+	runs    int
+	forever bool
+	action  FlowAction
+}
+
+// NewFlow returns an empty flow that runs its steps once and then recovers the previous
+// state.
+func NewFlow() Flow {
+	return Flow{runs: 1}
+}
+
+// RGB adds a step that fades to an RGB color over duration. Brightness is 1-100, or
+// KeepBrightness.
+func (f Flow) RGB(duration time.Duration, r, g, b uint8, brightness int) Flow {
+	return f.add(flowStep{
+		duration:   duration,
+		mode:       flowModeColor,
+		value:      utils.RGBToInt(r, g, b),
+		brightness: brightness,
+	})
+}
+
+// Temperature adds a step that fades to a white color temperature in Kelvin over
+// duration. Brightness is 1-100, or KeepBrightness.
+func (f Flow) Temperature(duration time.Duration, colorTemperature uint16, brightness int) Flow {
+	return f.add(flowStep{
+		duration:   duration,
+		mode:       flowModeTemperature,
+		value:      uint(colorTemperature),
+		brightness: brightness,
+	})
+}
+
+// Sleep adds a step that holds the current state for duration.
+func (f Flow) Sleep(duration time.Duration) Flow {
+	return f.add(flowStep{
+		duration: duration,
+		mode:     flowModeSleep,
+	})
+}
+
+// Repeat runs the steps the given number of times.
+func (f Flow) Repeat(runs int) Flow {
+	f.runs = runs
+	f.forever = false
+	return f
+}
+
+// Forever runs the steps until the flow is stopped or replaced.
+func (f Flow) Forever() Flow {
+	f.forever = true
+	return f
+}
+
+// EndWith sets what the bulb does after the last run.
+func (f Flow) EndWith(action FlowAction) Flow {
+	f.action = action
+	return f
+}
+
+func (f Flow) add(step flowStep) Flow {
+	f.steps = append(slices.Clip(f.steps), step)
+	return f
+}
+
+// Validate checks the flow against the limits of the bulb's flow engine.
+func (f Flow) Validate() error {
+	if len(f.steps) == 0 {
+		return eris.Wrap(ErrFlowInvalid, "flow has no steps")
+	}
+	if !f.forever && f.runs < 1 {
+		return eris.Wrapf(ErrFlowInvalid, "flow must run at least once, got %d", f.runs)
+	}
+	if f.action < FlowRecover || f.action > FlowOff {
+		return eris.Wrapf(ErrFlowInvalid, "unknown end action %d", f.action)
+	}
+
+	for i, step := range f.steps {
+		if step.duration < minFlowStepDuration {
+			return eris.Wrapf(ErrFlowInvalid, "step %d lasts %s, the minimum is %s", i, step.duration, minFlowStepDuration)
+		}
+		if step.mode == flowModeSleep {
+			continue
+		}
+		if step.brightness < KeepBrightness || step.brightness > 100 {
+			return eris.Wrapf(ErrFlowInvalid, "step %d brightness %d must be between -1 and 100", i, step.brightness)
+		}
+		if step.mode == flowModeTemperature {
+			if err := validateColorTemperature(uint16(step.value)); err != nil {
+				return eris.Wrapf(ErrFlowInvalid, "step %d: %s", i, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// params returns the count, action and expression parameters of start_cf.
+func (f Flow) params() []any {
+	// the bulb counts state changes, not runs; zero means forever
+	count := 0
+	if !f.forever {
+		count = f.runs * len(f.steps)
+	}
+
+	tuples := make([]string, len(f.steps))
+	for i, step := range f.steps {
+		tuples[i] = fmt.Sprintf("%d, %d, %d, %d", step.duration.Milliseconds(), step.mode, step.value, step.brightness)
+	}
+
+	return []any{count, f.action, strings.Join(tuples, ", ")}
+}
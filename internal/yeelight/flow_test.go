@@ -0,0 +1,79 @@
+package yeelight
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlowParams(t *testing.T) {
+	flow := NewFlow().
+		RGB(500*time.Millisecond, 255, 0, 0, 100).
+		Sleep(time.Second).
+		Temperature(250*time.Millisecond, 2700, KeepBrightness).
+		Repeat(2).
+		EndWith(FlowStay)
+
+	require.NoError(t, flow.Validate())
+	assert.Equal(t, []any{6, FlowStay, "500, 1, 16711680, 100, 1000, 7, 0, 0, 250, 2, 2700, -1"}, flow.params())
+}
+
+func TestFlowForeverCountsZero(t *testing.T) {
+	flow := NewFlow().RGB(time.Second, 0, 0, 255, 50).Forever()
+
+	require.NoError(t, flow.Validate())
+	assert.Equal(t, 0, flow.params()[0])
+	assert.Equal(t, FlowRecover, flow.params()[1])
+}
+
+func TestFlowIsAValue(t *testing.T) {
+	base := NewFlow().RGB(time.Second, 255, 0, 0, 100)
+	red := base.RGB(time.Second, 255, 0, 0, 50)
+	blue := base.RGB(time.Second, 0, 0, 255, 50)
+
+	assert.Len(t, base.steps, 1)
+	assert.Equal(t, uint(0xFF0000), red.steps[1].value)
+	assert.Equal(t, uint(0x0000FF), blue.steps[1].value)
+}
+
+func TestFlowValidate(t *testing.T) {
+	cases := map[string]Flow{
+		"no steps":          NewFlow(),
+		"short step":        NewFlow().RGB(49*time.Millisecond, 1, 2, 3, 100),
+		"short sleep":       NewFlow().Sleep(10 * time.Millisecond),
+		"brightness high":   NewFlow().RGB(time.Second, 1, 2, 3, 101),
+		"brightness low":    NewFlow().RGB(time.Second, 1, 2, 3, -2),
+		"temperature range": NewFlow().Temperature(time.Second, 1000, 50),
+		"no runs":           NewFlow().RGB(time.Second, 1, 2, 3, 50).Repeat(0),
+		"unknown action":    NewFlow().RGB(time.Second, 1, 2, 3, 50).EndWith(FlowAction(7)),
+	}
+
+	for name, flow := range cases {
+		t.Run(name, func(t *testing.T) {
+			assert.ErrorIs(t, flow.Validate(), ErrFlowInvalid)
+			assert.ErrorIs(t, flow.Validate(), ErrInvalidParameter)
+		})
+	}
+}
+
+func TestSetHSVStretchesSuddenChanges(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(server).ReadString('\n')
+		received <- line
+	}()
+
+	bulb := newMusicModeBulb(newBulbState(BulbInfo{}), client)
+	defer bulb.Disconnect()
+
+	require.NoError(t, bulb.SetHSV(context.Background(), 0, 100, 40, Sudden, 0))
+	assert.Contains(t, <-received, `"params":[1,1,"50, 1, 16711680, 40"]`)
+}
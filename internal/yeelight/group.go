@@ -0,0 +1,532 @@
+package yeelight
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/rotisserie/eris"
+)
+
+// Group drives several bulbs as one light. Every member receives each command, but
+// members send independently: one that is slow, rate limited or reconnecting only
+// misses updates and never holds back the others.
+//
+// Commands to members with a lower Latency are held back by the difference to the
+// slowest member, so that all lamps change together.
+type Group struct {
+	bulbs  []*Bulb
+	offset time.Duration
+}
+
+func NewGroup(bulbs ...*Bulb) *Group {
+	return &Group{bulbs: bulbs}
+}
+
+// Bulbs returns the members of the group.
+func (g *Group) Bulbs() []*Bulb {
+	return g.bulbs
+}
+
+// Connect connects every member concurrently. Members that cannot be reached are logged
+// and left out of the group; it only fails if none could be connected.
+func (g *Group) Connect(ctx context.Context) error {
+	if len(g.bulbs) == 0 {
+		return eris.New("failed to connect group: no bulbs")
+	}
+
+	errs := make([]error, len(g.bulbs))
+
+	var wg sync.WaitGroup
+	for i, bulb := range g.bulbs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = bulb.Connect(ctx)
+		}()
+	}
+	wg.Wait()
+
+	connected := make([]*Bulb, 0, len(g.bulbs))
+	for i, bulb := range g.bulbs {
+		if errs[i] != nil {
+			slog.Warn("leaving unreachable bulb out of the group",
+				slog.String("addr", bulb.Addr().String()),
+				slog.Any("error", errs[i]),
+			)
+			continue
+		}
+		connected = append(connected, bulb)
+	}
+
+	if len(connected) == 0 {
+		return eris.Wrap(errs[0], "failed to connect to any bulb in the group")
+	}
+
+	g.bulbs = connected
+
+	return nil
+}
+
+// SetOffset delays every command by offset on top of the latency compensation, to line
+// the lamps up with speakers that play late. It applies to lights created afterwards.
+func (g *Group) SetOffset(offset time.Duration) {
+	g.offset = max(offset, 0)
+}
+
+// Disconnect disconnects every member and returns the first error.
+func (g *Group) Disconnect() error {
+	var first error
+	for _, bulb := range g.bulbs {
+		if err := bulb.Disconnect(); err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
+// Quota returns the command budget of the most tightly limited member: the one with the
+// fewest commands available, or the slowest refill among equals.
+func (g *Group) Quota() QuotaStatus {
+	var tightest QuotaStatus
+	for i, bulb := range g.bulbs {
+		quota := bulb.Quota()
+		if i == 0 || quota.Available < tightest.Available ||
+			(quota.Available == tightest.Available && quota.RefillInterval > tightest.RefillInterval) {
+			tightest = quota
+		}
+	}
+
+	return tightest
+}
+
+// CommandsPerUpdate returns the most commands any member sends for one color or white
+// update with its current strategies.
+func (g *Group) CommandsPerUpdate() int {
+	commands := 1
+	for _, bulb := range g.bulbs {
+		commands = max(commands, bulb.ColorStrategy().Commands(), bulb.WhiteStrategy().Commands())
+	}
+
+	return commands
+}
+
+// Light drives every member over its rate-limited control connection until ctx is done.
+func (g *Group) Light(ctx context.Context) *GroupLight {
+	members := make([]*groupMember, len(g.bulbs))
+	for i, bulb := range g.bulbs {
+		members[i] = newGroupMember(ctx, bulb, &bulb.bulbBase, true)
+	}
+
+	return g.newLight(members)
+}
+
+func (g *Group) newLight(members []*groupMember) *GroupLight {
+	return &GroupLight{members: members, peers: members, offset: g.offset}
+}
+
+// EnableMusicMode enables music mode on every member concurrently and hands the group to
+// callback once each has either connected back or failed. Members without music mode
+// are driven over their control connection instead, with smooth transitions sized to
+// their quota. It fails without calling callback if no member could enable music mode.
+func (g *Group) EnableMusicMode(ctx context.Context, opts MusicModeOptions, callback func(context.Context, *GroupLight) error) error {
+	musicCtx, cancel := context.WithCancel(ctx)
+
+	type result struct {
+		index int
+		music *MusicModeBulb
+		err   error
+	}
+	results := make(chan result, len(g.bulbs))
+
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	for i, bulb := range g.bulbs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			started := false
+			err := bulb.EnableMusicMode(musicCtx, opts, func(ctx context.Context, music *MusicModeBulb) error {
+				started = true
+				results <- result{index: i, music: music}
+				<-ctx.Done()
+				return nil
+			})
+			if !started {
+				results <- result{index: i, err: err}
+			}
+		}()
+	}
+
+	members := make([]*groupMember, len(g.bulbs))
+	errs := make([]error, len(g.bulbs))
+	for range g.bulbs {
+		r := <-results
+		bulb := g.bulbs[r.index]
+
+		if r.err != nil {
+			errs[r.index] = r.err
+			members[r.index] = newGroupMember(musicCtx, bulb, &bulb.bulbBase, true)
+			continue
+		}
+
+		members[r.index] = newGroupMember(musicCtx, bulb, &r.music.bulbBase, false)
+	}
+
+	if !hasMusicMember(members) {
+		return eris.Wrap(errs[0], "failed to enable music mode on any bulb in the group")
+	}
+
+	for i, err := range errs {
+		if err != nil {
+			slog.Warn("music mode unavailable, driving bulb over its control connection",
+				slog.String("addr", g.bulbs[i].Addr().String()),
+				slog.Any("error", err),
+			)
+		}
+	}
+
+	return callback(musicCtx, g.newLight(members))
+}
+
+func hasMusicMember(members []*groupMember) bool {
+	for _, member := range members {
+		if !member.quota {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GroupLight sends the same commands to one light of every member. Commands are
+// validated immediately but delivered in the background, so they never fail because of
+// a single member; ConnectionStates reports whether any member is reachable.
+type GroupLight struct {
+	members []*groupMember
+	// peers are all members of the group, which latency compensation lines up even
+	// when the light drives only some of them.
+	peers      []*groupMember
+	background bool
+	offset     time.Duration
+}
+
+// BackgroundLight drives the background rings of the members that have one.
+func (gl *GroupLight) BackgroundLight() *GroupLight {
+	background := *gl
+	background.background = true
+
+	return &background
+}
+
+// Member narrows the light to a single member, so that bulb can be driven on its own
+// while sharing the member's connection. It returns nil if bulb is not in the group.
+func (gl *GroupLight) Member(bulb *Bulb) *GroupLight {
+	for _, member := range gl.members {
+		if member.bulb == bulb {
+			single := *gl
+			single.members = []*groupMember{member}
+			return &single
+		}
+	}
+
+	return nil
+}
+
+func (gl *GroupLight) SetBrightness(ctx context.Context, brightness uint8, effect Effect, duration int) error {
+	if err := firstError(validateBrightness(brightness), validateTransition(effect, duration)); err != nil {
+		return eris.Wrap(err, "failed to set brightness")
+	}
+
+	gl.dispatch(func(ctx context.Context, l light, effect Effect, duration int) error {
+		return l.SetBrightness(ctx, brightness, effect, duration)
+	}, effect, duration)
+
+	return nil
+}
+
+func (gl *GroupLight) SetHSV(ctx context.Context, hue uint16, saturation uint8, value uint8, effect Effect, duration int) error {
+	if err := firstError(validateHue(hue), validateSaturation(saturation), validateBrightness(value), validateTransition(effect, duration)); err != nil {
+		return eris.Wrap(err, "failed to set HSV")
+	}
+
+	gl.dispatch(func(ctx context.Context, l light, effect Effect, duration int) error {
+		return l.SetHSV(ctx, hue, saturation, value, effect, duration)
+	}, effect, duration)
+
+	return nil
+}
+
+func (gl *GroupLight) SetWhite(ctx context.Context, colorTemperature uint16, brightness uint8, effect Effect, duration int) error {
+	if err := firstError(validateColorTemperature(colorTemperature), validateBrightness(brightness), validateTransition(effect, duration)); err != nil {
+		return eris.Wrap(err, "failed to set white")
+	}
+
+	gl.dispatch(func(ctx context.Context, l light, effect Effect, duration int) error {
+		return l.SetWhite(ctx, colorTemperature, brightness, effect, duration)
+	}, effect, duration)
+
+	return nil
+}
+
+func (gl *GroupLight) dispatch(send func(context.Context, light, Effect, int) error, effect Effect, duration int) {
+	now := time.Now()
+	slowest := gl.slowestLatency()
+
+	for _, member := range gl.members {
+		if member.accepts(gl.background) {
+			publishLatest(member.next, groupCommand{
+				send:       send,
+				background: gl.background,
+				effect:     effect,
+				duration:   duration,
+				due:        now.Add(gl.offset + slowest - member.bulb.Latency()),
+			})
+		}
+	}
+}
+
+func (gl *GroupLight) slowestLatency() time.Duration {
+	var slowest time.Duration
+	for _, peer := range gl.peers {
+		slowest = max(slowest, peer.bulb.Latency())
+	}
+
+	return slowest
+}
+
+// Info returns the state of the first member.
+func (gl *GroupLight) Info() BulbInfo {
+	return gl.members[0].bb.Info()
+}
+
+// ConnectionStates reports StateConnected while any member is connected, otherwise
+// StateReconnecting while any member is reconnecting. Only the latest state is
+// buffered.
+func (gl *GroupLight) ConnectionStates(ctx context.Context) <-chan ConnectionState {
+	type memberState struct {
+		index int
+		state ConnectionState
+	}
+
+	out := make(chan ConnectionState, 1)
+	merged := make(chan memberState)
+
+	for i, member := range gl.members {
+		go func() {
+			for state := range member.bb.ConnectionStates(ctx) {
+				select {
+				case merged <- memberState{index: i, state: state}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(out)
+
+		states := make([]ConnectionState, len(gl.members))
+		current := ConnectionState(-1)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case update := <-merged:
+				states[update.index] = update.state
+				if next := groupConnectionState(states); next != current {
+					current = next
+					publishLatest(out, current)
+				}
+			}
+		}
+	}()
+
+	return out
+}
+
+func groupConnectionState(states []ConnectionState) ConnectionState {
+	group := StateDisconnected
+	for _, state := range states {
+		switch state {
+		case StateConnected:
+			return StateConnected
+		case StateReconnecting:
+			group = StateReconnecting
+		}
+	}
+
+	return group
+}
+
+// Subscribe reports power changes of the group as a whole: off once every member is
+// off, and on again once any member is back on. Members that are switched off are
+// skipped in the meantime.
+func (gl *GroupLight) Subscribe(ctx context.Context) <-chan PropertyChange {
+	out := make(chan PropertyChange, 1)
+	merged := make(chan PropertyChange)
+
+	for _, member := range gl.members {
+		go func() {
+			for change := range member.bulb.Subscribe(ctx) {
+				select {
+				case merged <- change:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(out)
+
+		allOff := gl.allOff()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case change := <-merged:
+				if change.Property != PropertyPower || change.Background != gl.background {
+					continue
+				}
+				if off := gl.allOff(); off != allOff {
+					allOff = off
+					publishLatest(out, change)
+				}
+			}
+		}
+	}()
+
+	return out
+}
+
+func (gl *GroupLight) allOff() bool {
+	for _, member := range gl.members {
+		if member.accepts(gl.background) && !member.switchedOff(gl.background) {
+			return false
+		}
+	}
+
+	return true
+}
+
+type groupCommand struct {
+	send       func(context.Context, light, Effect, int) error
+	background bool
+	effect     Effect
+	duration   int
+	// due is when the command should go out for the lamp to change in step with the
+	// rest of the group.
+	due time.Time
+}
+
+// groupMember delivers commands to one bulb. Commands wait in order until they are due;
+// once several are, only the newest is sent, so a member that falls behind skips to the
+// latest state.
+type groupMember struct {
+	bulb *Bulb
+	// bb is the connection commands go out on: the music mode connection, or the
+	// control connection when quota is set.
+	bb    *bulbBase
+	quota bool
+	next  chan groupCommand
+}
+
+func newGroupMember(ctx context.Context, bulb *Bulb, bb *bulbBase, quota bool) *groupMember {
+	m := &groupMember{
+		bulb:  bulb,
+		bb:    bb,
+		quota: quota,
+		next:  make(chan groupCommand, 1),
+	}
+	go m.run(ctx)
+
+	return m
+}
+
+func (m *groupMember) accepts(background bool) bool {
+	return !background || m.bb.Supports(backgroundMethodPrefix+"set_power")
+}
+
+func (m *groupMember) switchedOff(background bool) bool {
+	info := m.bb.Info()
+	if background {
+		return info.Background().Power() == PowerOff
+	}
+
+	return info.Power() == PowerOff
+}
+
+func (m *groupMember) run(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	var queue []groupCommand
+	for {
+		var due <-chan time.Time
+		if len(queue) > 0 {
+			timer.Reset(time.Until(queue[0].due))
+			due = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case cmd := <-m.next:
+			queue = append(queue, cmd)
+		case now := <-due:
+			latest := 0
+			for latest+1 < len(queue) && !queue[latest+1].due.After(now) {
+				latest++
+			}
+			cmd := queue[latest]
+			queue = queue[latest+1:]
+
+			m.deliver(ctx, cmd)
+		}
+	}
+}
+
+func (m *groupMember) deliver(ctx context.Context, cmd groupCommand) {
+	if m.switchedOff(cmd.background) {
+		return
+	}
+
+	l := m.bb.light
+	if cmd.background {
+		l = m.bb.background.light
+	}
+
+	effect, duration := cmd.effect, cmd.duration
+	if m.quota {
+		// fade across the gap until the bulb's quota allows the next command
+		effect = Smooth
+		duration = max(duration, int(m.bulb.Quota().RefillInterval/time.Millisecond))
+	}
+
+	if err := cmd.send(ctx, l, effect, duration); err != nil {
+		m.report(err)
+	}
+}
+
+func (m *groupMember) report(err error) {
+	attrs := []any{slog.String("addr", m.bulb.Addr().String()), slog.Any("error", err)}
+
+	switch {
+	case eris.Is(err, context.Canceled):
+	case eris.Is(err, ErrConnectionLost), eris.Is(err, ErrNotConnected), eris.Is(err, ErrQuotaExceeded),
+		eris.Is(err, ErrTimeout):
+		slog.Debug("group member skipped an update", attrs...)
+	default:
+		slog.Warn("group member failed to apply an update", attrs...)
+	}
+}
@@ -0,0 +1,230 @@
+package yeelight_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cybre/yeelight-music-sync/internal/yeelight"
+	"github.com/cybre/yeelight-music-sync/internal/yeelight/yeelighttest"
+)
+
+func newFakeGroup(t *testing.T, fakes ...*yeelighttest.Bulb) *yeelight.Group {
+	t.Helper()
+
+	bulbs := make([]*yeelight.Bulb, len(fakes))
+	for i, fake := range fakes {
+		bulb, err := yeelight.NewBulbFromAddress(fake.Addr())
+		require.NoError(t, err)
+		bulbs[i] = bulb
+	}
+
+	group := yeelight.NewGroup(bulbs...)
+	require.NoError(t, group.Connect(t.Context()))
+	t.Cleanup(func() { group.Disconnect() })
+
+	// a round trip makes sure each fake serves the connection before props change
+	for _, bulb := range bulbs {
+		_, err := bulb.MeasureLatency(t.Context(), 1)
+		require.NoError(t, err)
+	}
+
+	return group
+}
+
+func sentOverMusic(fake *yeelighttest.Bulb, method string) bool {
+	for _, cmd := range fake.Commands() {
+		if cmd.Music && cmd.Method == method {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestGroupFansOutToEveryBulb(t *testing.T) {
+	first := newFakeBulb(t, yeelighttest.Options{})
+	second := newFakeBulb(t, yeelighttest.Options{})
+	group := newFakeGroup(t, first, second)
+
+	err := group.EnableMusicMode(t.Context(), yeelight.MusicModeOptions{}, func(ctx context.Context, light *yeelight.GroupLight) error {
+		require.NoError(t, light.SetHSV(ctx, 120, 100, 70, yeelight.Sudden, 0))
+
+		assert.Eventually(t, func() bool {
+			return sentOverMusic(first, "start_cf") && sentOverMusic(second, "start_cf")
+		}, time.Second, 10*time.Millisecond)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, "70", first.Prop("bright"))
+	assert.Equal(t, "70", second.Prop("bright"))
+}
+
+func TestGroupDrivesBulbsWithoutMusicModeOverControlConnection(t *testing.T) {
+	music := newFakeBulb(t, yeelighttest.Options{})
+	stubborn := newFakeBulb(t, yeelighttest.Options{})
+	stubborn.SetFaults(yeelighttest.Faults{IgnoreMusic: true})
+	group := newFakeGroup(t, music, stubborn)
+
+	opts := yeelight.MusicModeOptions{AcceptTimeout: 100 * time.Millisecond}
+	err := group.EnableMusicMode(t.Context(), opts, func(ctx context.Context, light *yeelight.GroupLight) error {
+		require.NoError(t, light.SetBrightness(ctx, 42, yeelight.Sudden, 0))
+
+		assert.Eventually(t, func() bool {
+			return music.Prop("bright") == "42" && stubborn.Prop("bright") == "42"
+		}, time.Second, 10*time.Millisecond)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	assert.True(t, sentOverMusic(music, "set_bright"))
+	assert.False(t, sentOverMusic(stubborn, "set_bright"))
+}
+
+func TestGroupFailsWhenNoBulbEnablesMusicMode(t *testing.T) {
+	fake := newFakeBulb(t, yeelighttest.Options{})
+	fake.SetFaults(yeelighttest.Faults{IgnoreMusic: true})
+	group := newFakeGroup(t, fake)
+
+	opts := yeelight.MusicModeOptions{AcceptTimeout: 100 * time.Millisecond}
+	err := group.EnableMusicMode(t.Context(), opts, func(context.Context, *yeelight.GroupLight) error {
+		t.Fatal("callback must not run")
+		return nil
+	})
+	assert.ErrorIs(t, err, yeelight.ErrMusicModeNoDialBack)
+}
+
+func TestGroupConnectLeavesOutUnreachableBulbs(t *testing.T) {
+	fake := newFakeBulb(t, yeelighttest.Options{})
+
+	// a port that was just released refuses connections
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	unreachable := ln.Addr().String()
+	require.NoError(t, ln.Close())
+
+	reachable, err := yeelight.NewBulbFromAddress(fake.Addr())
+	require.NoError(t, err)
+	missing, err := yeelight.NewBulbFromAddress(unreachable)
+	require.NoError(t, err)
+
+	group := yeelight.NewGroup(reachable, missing)
+	require.NoError(t, group.Connect(t.Context()))
+	t.Cleanup(func() { group.Disconnect() })
+
+	assert.Equal(t, []*yeelight.Bulb{reachable}, group.Bulbs())
+}
+
+func TestGroupReportsPowerOffOnceEveryBulbIsOff(t *testing.T) {
+	first := newFakeBulb(t, yeelighttest.Options{})
+	second := newFakeBulb(t, yeelighttest.Options{})
+	group := newFakeGroup(t, first, second)
+
+	changes := group.Light(t.Context()).Subscribe(t.Context())
+
+	first.SetProp("power", "off")
+	select {
+	case change := <-changes:
+		t.Fatalf("unexpected change while a bulb is still on: %v", change.Property)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	second.SetProp("power", "off")
+	select {
+	case change := <-changes:
+		assert.Equal(t, yeelight.PropertyPower, change.Property)
+		assert.Equal(t, yeelight.PowerOff, change.Info.Power())
+	case <-time.After(time.Second):
+		t.Fatal("no power change once every bulb was off")
+	}
+}
+
+func TestGroupMemberDrivesOnlyThatBulb(t *testing.T) {
+	first := newFakeBulb(t, yeelighttest.Options{})
+	second := newFakeBulb(t, yeelighttest.Options{})
+	group := newFakeGroup(t, first, second)
+
+	light := group.Light(t.Context())
+	member := light.Member(group.Bulbs()[1])
+	require.NotNil(t, member)
+	require.NoError(t, member.SetBrightness(t.Context(), 42, yeelight.Sudden, 0))
+
+	assert.Eventually(t, func() bool {
+		return second.Prop("bright") == "42"
+	}, time.Second, 10*time.Millisecond)
+	assert.NotEqual(t, "42", first.Prop("bright"))
+
+	stranger, err := yeelight.NewBulbFromAddress(first.Addr())
+	require.NoError(t, err)
+	assert.Nil(t, light.Member(stranger))
+}
+
+func TestGroupHoldsBackFasterBulbs(t *testing.T) {
+	fast := newFakeBulb(t, yeelighttest.Options{})
+	slow := newFakeBulb(t, yeelighttest.Options{})
+	group := newFakeGroup(t, fast, slow)
+	group.Bulbs()[1].SetLatency(300 * time.Millisecond)
+
+	require.NoError(t, group.Light(t.Context()).SetBrightness(t.Context(), 42, yeelight.Sudden, 0))
+
+	assert.Eventually(t, func() bool {
+		return slow.Prop("bright") == "42"
+	}, 200*time.Millisecond, 5*time.Millisecond)
+	assert.NotEqual(t, "42", fast.Prop("bright"))
+
+	assert.Eventually(t, func() bool {
+		return fast.Prop("bright") == "42"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestGroupOffsetDelaysEveryBulb(t *testing.T) {
+	fake := newFakeBulb(t, yeelighttest.Options{})
+	group := newFakeGroup(t, fake)
+	group.SetOffset(200 * time.Millisecond)
+
+	start := time.Now()
+	require.NoError(t, group.Light(t.Context()).SetBrightness(t.Context(), 42, yeelight.Sudden, 0))
+
+	assert.Eventually(t, func() bool {
+		return fake.Prop("bright") == "42"
+	}, time.Second, 5*time.Millisecond)
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+}
+
+func TestGroupQuotaReportsTheMostDrainedBulb(t *testing.T) {
+	group := newFakeGroup(t,
+		newFakeBulb(t, yeelighttest.Options{}),
+		newFakeBulb(t, yeelighttest.Options{}),
+	)
+	bulbs := group.Bulbs()
+
+	for range 3 {
+		require.NoError(t, bulbs[1].SetBrightness(t.Context(), 50, yeelight.Sudden, 0))
+	}
+
+	quota := group.Quota()
+	assert.InDelta(t, bulbs[1].Quota().Available, quota.Available, 0.1)
+	assert.Less(t, quota.Available, bulbs[0].Quota().Available-2)
+}
+
+func TestGroupCommandsPerUpdateFollowsTheWordiestStrategy(t *testing.T) {
+	group := newFakeGroup(t,
+		newFakeBulb(t, yeelighttest.Options{}),
+		newFakeBulb(t, yeelighttest.Options{}),
+	)
+	bulbs := group.Bulbs()
+
+	require.NoError(t, bulbs[0].SetColorStrategy(yeelight.ColorStrategyScene))
+	require.NoError(t, bulbs[1].SetColorStrategy(yeelight.ColorStrategyScene))
+	assert.Equal(t, 1, group.CommandsPerUpdate())
+
+	require.NoError(t, bulbs[1].SetColorStrategy(yeelight.ColorStrategyHSV))
+	assert.Equal(t, 2, group.CommandsPerUpdate())
+}
@@ -0,0 +1,217 @@
+package yeelight
+
+import (
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rotisserie/eris"
+)
+
+// inventoryVersion is bumped when the file format changes; older files are ignored.
+const inventoryVersion = 1
+
+// Inventory remembers discovered bulbs between runs, keyed by bulb id, so they can be
+// offered before discovery answers. Only identity and capabilities are kept; state such
+// as power and color is always read from the bulb. It is safe for concurrent use.
+type Inventory struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]inventoryEntry
+}
+
+type inventoryFile struct {
+	Version int                       `json:"version"`
+	Bulbs   map[string]inventoryEntry `json:"bulbs"`
+}
+
+type inventoryEntry struct {
+	Addr            netip.AddrPort `json:"addr"`
+	Name            string         `json:"name,omitempty"`
+	Model           string         `json:"model,omitempty"`
+	FirmwareVersion string         `json:"fw_ver,omitempty"`
+	Support         []string       `json:"support,omitempty"`
+	LastSeen        time.Time      `json:"last_seen"`
+}
+
+func (e inventoryEntry) info(id string) BulbInfo {
+	return BulbInfo{
+		addr:            e.Addr,
+		id:              id,
+		name:            e.Name,
+		model:           e.Model,
+		firmwareVersion: e.FirmwareVersion,
+		support:         e.Support,
+	}
+}
+
+// AddressChange reports a remembered bulb that turned up at a different address.
+type AddressChange struct {
+	ID       string
+	Bulb     *Bulb
+	Previous netip.AddrPort
+}
+
+// DefaultInventoryPath returns where the inventory is kept in the user's config
+// directory.
+func DefaultInventoryPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", eris.Wrap(err, "failed to locate user config directory")
+	}
+
+	return filepath.Join(dir, "yeelight-music-sync", "bulbs.json"), nil
+}
+
+// LoadInventory reads the inventory at path. A missing file yields an empty inventory
+// that Save creates.
+func LoadInventory(path string) (*Inventory, error) {
+	inv := &Inventory{path: path, entries: make(map[string]inventoryEntry)}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return inv, nil
+		}
+		return inv, eris.Wrap(err, "failed to read bulb inventory")
+	}
+
+	var file inventoryFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return inv, eris.Wrapf(err, "failed to parse bulb inventory %s", path)
+	}
+	if file.Version != inventoryVersion {
+		return inv, nil
+	}
+
+	for id, entry := range file.Bulbs {
+		if id != "" && entry.Addr.IsValid() {
+			inv.entries[id] = entry
+		}
+	}
+
+	return inv, nil
+}
+
+// Bulbs returns a bulb for every remembered entry, ordered by id.
+func (inv *Inventory) Bulbs() []*Bulb {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	ids := make([]string, 0, len(inv.entries))
+	for id := range inv.entries {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	bulbs := make([]*Bulb, len(ids))
+	for i, id := range ids {
+		bulbs[i] = newBulb(inv.entries[id].info(id))
+	}
+
+	return bulbs
+}
+
+// BulbAt is NewBulbFromAddress with the identity and capabilities remembered for that
+// address filled in, when there are any.
+func (inv *Inventory) BulbAt(address string) (*Bulb, error) {
+	bulb, err := NewBulbFromAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	for id, entry := range inv.entries {
+		if entry.Addr == bulb.Addr() {
+			return newBulb(entry.info(id)), nil
+		}
+	}
+
+	return bulb, nil
+}
+
+// Latest returns a bulb at the address last recorded for bulb's id, or bulb itself when
+// the address is unchanged or the id is unknown.
+func (inv *Inventory) Latest(bulb *Bulb) *Bulb {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	entry, ok := inv.entries[bulb.ID()]
+	if !ok || entry.Addr == bulb.Addr() {
+		return bulb
+	}
+
+	return newBulb(entry.info(bulb.ID()))
+}
+
+// Update records discovered bulbs and returns the remembered ones whose address
+// changed. Bulbs without an id are skipped.
+func (inv *Inventory) Update(bulbs ...*Bulb) []AddressChange {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	var changes []AddressChange
+	now := time.Now()
+	for _, bulb := range bulbs {
+		info := bulb.Info()
+		if info.id == "" {
+			continue
+		}
+
+		if prev, known := inv.entries[info.id]; known && prev.Addr != info.addr {
+			changes = append(changes, AddressChange{ID: info.id, Bulb: bulb, Previous: prev.Addr})
+		}
+
+		inv.entries[info.id] = inventoryEntry{
+			Addr:            info.addr,
+			Name:            info.name,
+			Model:           info.model,
+			FirmwareVersion: info.firmwareVersion,
+			Support:         info.support,
+			LastSeen:        now,
+		}
+	}
+
+	return changes
+}
+
+// Save writes the inventory back to its file, replacing it atomically.
+func (inv *Inventory) Save() error {
+	inv.mu.Lock()
+	data, err := json.MarshalIndent(inventoryFile{Version: inventoryVersion, Bulbs: inv.entries}, "", "  ")
+	inv.mu.Unlock()
+	if err != nil {
+		return eris.Wrap(err, "failed to encode bulb inventory")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(inv.path), 0o755); err != nil {
+		return eris.Wrap(err, "failed to create bulb inventory directory")
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(inv.path), filepath.Base(inv.path)+".*")
+	if err != nil {
+		return eris.Wrap(err, "failed to write bulb inventory")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return eris.Wrap(err, "failed to write bulb inventory")
+	}
+	if err := tmp.Close(); err != nil {
+		return eris.Wrap(err, "failed to write bulb inventory")
+	}
+
+	if err := os.Rename(tmp.Name(), inv.path); err != nil {
+		return eris.Wrap(err, "failed to replace bulb inventory")
+	}
+
+	return nil
+}
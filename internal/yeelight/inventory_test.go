@@ -0,0 +1,97 @@
+package yeelight
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func inventoryBulb(id, addr string) *Bulb {
+	return newBulb(BulbInfo{
+		addr:            netip.MustParseAddrPort(addr),
+		id:              id,
+		name:            "desk",
+		model:           "color",
+		firmwareVersion: "18",
+		support:         []string{"get_prop", "set_rgb"},
+	})
+}
+
+func TestInventoryRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "bulbs.json")
+
+	inv, err := LoadInventory(path)
+	require.NoError(t, err)
+	assert.Empty(t, inv.Bulbs())
+
+	inv.Update(inventoryBulb("0x1", "192.0.2.10:55443"), newBulb(BulbInfo{addr: netip.MustParseAddrPort("192.0.2.11:55443")}))
+	require.NoError(t, inv.Save())
+
+	loaded, err := LoadInventory(path)
+	require.NoError(t, err)
+
+	bulbs := loaded.Bulbs()
+	require.Len(t, bulbs, 1, "bulbs without an id are not remembered")
+	assert.Equal(t, "0x1", bulbs[0].ID())
+	assert.Equal(t, "desk", bulbs[0].Name())
+	assert.Equal(t, "color", bulbs[0].Model())
+	assert.Equal(t, "18", bulbs[0].FirmwareVersion())
+	assert.Equal(t, []string{"get_prop", "set_rgb"}, bulbs[0].Support())
+	assert.Equal(t, netip.MustParseAddrPort("192.0.2.10:55443"), bulbs[0].Addr())
+}
+
+func TestInventoryReportsAddressChanges(t *testing.T) {
+	inv, err := LoadInventory(filepath.Join(t.TempDir(), "bulbs.json"))
+	require.NoError(t, err)
+
+	cached := inventoryBulb("0x1", "192.0.2.10:55443")
+	assert.Empty(t, inv.Update(cached))
+	assert.Empty(t, inv.Update(inventoryBulb("0x1", "192.0.2.10:55443")))
+
+	changes := inv.Update(inventoryBulb("0x1", "192.0.2.20:55443"))
+	require.Len(t, changes, 1)
+	assert.Equal(t, "0x1", changes[0].ID)
+	assert.Equal(t, netip.MustParseAddrPort("192.0.2.10:55443"), changes[0].Previous)
+	assert.Equal(t, netip.MustParseAddrPort("192.0.2.20:55443"), changes[0].Bulb.Addr())
+
+	assert.Equal(t, netip.MustParseAddrPort("192.0.2.20:55443"), inv.Latest(cached).Addr())
+
+	unknown := inventoryBulb("0x2", "192.0.2.30:55443")
+	assert.Same(t, unknown, inv.Latest(unknown))
+}
+
+func TestInventoryBulbAtFillsMetadata(t *testing.T) {
+	inv, err := LoadInventory(filepath.Join(t.TempDir(), "bulbs.json"))
+	require.NoError(t, err)
+	inv.Update(inventoryBulb("0x1", "192.0.2.10:55443"))
+
+	bulb, err := inv.BulbAt("192.0.2.10")
+	require.NoError(t, err)
+	assert.Equal(t, "0x1", bulb.ID())
+	assert.Equal(t, "color", bulb.Model())
+
+	bulb, err = inv.BulbAt("192.0.2.99:55443")
+	require.NoError(t, err)
+	assert.Empty(t, bulb.ID())
+}
+
+func TestInventoryIgnoresCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bulbs.json")
+	require.NoError(t, os.WriteFile(path, []byte("{not json"), 0o644))
+
+	inv, err := LoadInventory(path)
+	assert.ErrorContains(t, err, "failed to parse bulb inventory")
+	require.NotNil(t, inv)
+	assert.Empty(t, inv.Bulbs())
+
+	inv.Update(inventoryBulb("0x1", "192.0.2.10:55443"))
+	require.NoError(t, inv.Save())
+
+	loaded, err := LoadInventory(path)
+	require.NoError(t, err)
+	assert.Len(t, loaded.Bulbs(), 1)
+}
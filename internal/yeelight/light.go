@@ -0,0 +1,303 @@
+package yeelight
+
+import (
+	"context"
+
+	"github.com/crazy3lf/colorconv"
+	"github.com/cybre/yeelight-music-sync/internal/utils"
+	"github.com/rotisserie/eris"
+)
+
+const backgroundMethodPrefix = "bg_"
+
+// light sends the commands that control one light of a bulb. Every bulb has a main
+// light; dual-light ceiling lamps add a background ring that takes the same commands
+// with a bg_ prefix.
+type light struct {
+	bb         *bulbBase
+	background bool
+}
+
+// BackgroundLight controls the background ring of a dual-light ceiling lamp. Its state
+// is reported by BulbInfo.Background.
+type BackgroundLight struct {
+	light
+}
+
+func (l light) method(name string) string {
+	if l.background {
+		return backgroundMethodPrefix + name
+	}
+
+	return name
+}
+
+func (l light) lightInfo() LightInfo {
+	info := l.bb.Info()
+	if l.background {
+		return info.background
+	}
+
+	return info.LightInfo
+}
+
+// execute sends a command for this light and reports whether it reached the bulb. A
+// command superseded by a newer one queued for the quota is not sent and is not an
+// error; the caller must leave the cached state alone, as the newer command sets it.
+func (l light) execute(ctx context.Context, method string, params ...any) (bool, error) {
+	if _, err := l.bb.executeCommand(ctx, method, params...); err != nil {
+		if eris.Is(err, errCommandCoalesced) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (l light) updateLight(fn func(*LightInfo)) {
+	l.bb.update(func(info *BulbInfo) {
+		if l.background {
+			fn(&info.background)
+		} else {
+			fn(&info.LightInfo)
+		}
+	})
+}
+
+func (l light) TurnOn(ctx context.Context, effect Effect, duration int) error {
+	if err := validateTransition(effect, duration); err != nil {
+		return eris.Wrap(err, "failed to turn on")
+	}
+
+	if sent, err := l.execute(ctx, l.method("set_power"), "on", effect, duration); err != nil || !sent {
+		return err
+	}
+
+	l.updateLight(func(light *LightInfo) {
+		light.power = PowerOn
+	})
+
+	return nil
+}
+
+func (l light) TurnOff(ctx context.Context, effect Effect, duration int) error {
+	if err := validateTransition(effect, duration); err != nil {
+		return eris.Wrap(err, "failed to turn off")
+	}
+
+	if sent, err := l.execute(ctx, l.method("set_power"), "off", effect, duration); err != nil || !sent {
+		return err
+	}
+
+	l.updateLight(func(light *LightInfo) {
+		light.power = PowerOff
+	})
+
+	return nil
+}
+
+func (l light) Toggle(ctx context.Context, effect Effect, duration int) error {
+	power := l.lightInfo().Power()
+
+	if sent, err := l.execute(ctx, l.method("toggle"), effect, duration); err != nil || !sent {
+		return err
+	}
+
+	l.updateLight(func(light *LightInfo) {
+		if power == PowerOn {
+			light.power = PowerOff
+		} else {
+			light.power = PowerOn
+		}
+	})
+
+	return nil
+}
+
+func (l light) SetBrightness(ctx context.Context, brightness uint8, effect Effect, duration int) error {
+	if err := firstError(validateBrightness(brightness), validateTransition(effect, duration)); err != nil {
+		return eris.Wrap(err, "failed to set brightness")
+	}
+
+	if sent, err := l.execute(ctx, l.method("set_bright"), brightness, effect, duration); err != nil || !sent {
+		return err
+	}
+
+	l.updateLight(func(light *LightInfo) {
+		light.brightness = brightness
+	})
+
+	return nil
+}
+
+func (l light) SetRGB(ctx context.Context, r, g, b uint8, effect Effect, duration int) error {
+	if err := validateTransition(effect, duration); err != nil {
+		return eris.Wrap(err, "failed to set RGB")
+	}
+
+	rgb := utils.RGBToInt(r, g, b)
+
+	if sent, err := l.execute(ctx, l.method("set_rgb"), rgb, effect, duration); err != nil || !sent {
+		return err
+	}
+
+	l.updateLight(func(light *LightInfo) {
+		light.colorMode = ColorModeRGB
+		light.rgb = rgb
+	})
+
+	return nil
+}
+
+// SetColorTemperature switches to white light at the given temperature in Kelvin
+// (1700-6500) using set_ct_abx.
+func (l light) SetColorTemperature(ctx context.Context, colorTemperature uint16, effect Effect, duration int) error {
+	if err := firstError(validateColorTemperature(colorTemperature), validateTransition(effect, duration)); err != nil {
+		return eris.Wrap(err, "failed to set color temperature")
+	}
+
+	if sent, err := l.execute(ctx, l.method("set_ct_abx"), colorTemperature, effect, duration); err != nil || !sent {
+		return err
+	}
+
+	l.updateLight(func(light *LightInfo) {
+		light.colorMode = ColorModeTemperature
+		light.colorTemperature = colorTemperature
+	})
+
+	return nil
+}
+
+// SetHueSaturation sets the color with set_hsv, keeping the current brightness. Use
+// SetHSV to change brightness at the same time.
+func (l light) SetHueSaturation(ctx context.Context, hue uint16, saturation uint8, effect Effect, duration int) error {
+	if err := firstError(validateHue(hue), validateSaturation(saturation), validateTransition(effect, duration)); err != nil {
+		return eris.Wrap(err, "failed to set hue and saturation")
+	}
+
+	if sent, err := l.execute(ctx, l.method("set_hsv"), hue, saturation, effect, duration); err != nil || !sent {
+		return err
+	}
+
+	l.updateLight(func(light *LightInfo) {
+		light.colorMode = ColorModeHSV
+		light.hue = hue
+		light.saturation = saturation
+	})
+
+	return nil
+}
+
+// SetHSV sets color and brightness together, using the bulb's color strategy.
+func (l light) SetHSV(ctx context.Context, hue uint16, saturation uint8, value uint8, effect Effect, duration int) error {
+	if err := firstError(validateHue(hue), validateSaturation(saturation), validateBrightness(value), validateTransition(effect, duration)); err != nil {
+		return eris.Wrap(err, "failed to set HSV")
+	}
+
+	// start_cf and set_scene accept colors on white bulbs too, which cannot show them
+	if !l.bb.Supports(l.method("set_rgb")) && !l.bb.Supports(l.method("set_hsv")) {
+		return &UnsupportedError{Method: l.method("set_hsv")}
+	}
+
+	red, green, blue, err := colorconv.HSVToRGB(float64(hue), float64(saturation)/100.0, 1)
+	if err != nil {
+		return eris.Wrap(err, "failed to convert HSV to RGB")
+	}
+
+	return l.setColor(ctx, hue, saturation, utils.RGBToInt(red, green, blue), value, effect, duration)
+}
+
+// SetWhite sets color temperature in Kelvin (1700-6500) and brightness together, using
+// the bulb's color strategy.
+func (l light) SetWhite(ctx context.Context, colorTemperature uint16, brightness uint8, effect Effect, duration int) error {
+	if err := firstError(validateColorTemperature(colorTemperature), validateBrightness(brightness), validateTransition(effect, duration)); err != nil {
+		return eris.Wrap(err, "failed to set white")
+	}
+
+	if !l.bb.Supports(l.method("set_ct_abx")) {
+		return &UnsupportedError{Method: l.method("set_ct_abx")}
+	}
+
+	return l.setWhite(ctx, colorTemperature, brightness, effect, duration)
+}
+
+func (l light) StartColorFlow(ctx context.Context, flow Flow) error {
+	if err := flow.Validate(); err != nil {
+		return eris.Wrap(err, "failed to start color flow")
+	}
+
+	_, err := l.execute(ctx, l.method("start_cf"), flow.params()...)
+	return err
+}
+
+func (l light) StopColorFlow(ctx context.Context) error {
+	_, err := l.bb.executeCommand(ctx, l.method("stop_cf"))
+	return err
+}
+
+// SetScene applies a complete state in one command, turning the bulb on if needed.
+func (l light) SetScene(ctx context.Context, scene Scene) error {
+	if scene.class == "" {
+		return eris.Wrap(ErrInvalidParameter, "failed to set scene: empty scene")
+	}
+	if scene.err != nil {
+		return eris.Wrap(scene.err, "failed to set scene")
+	}
+
+	params := append([]any{scene.class}, scene.params...)
+	if sent, err := l.execute(ctx, l.method("set_scene"), params...); err != nil || !sent {
+		return err
+	}
+
+	l.updateLight(func(light *LightInfo) {
+		light.power = PowerOn
+		if scene.apply != nil {
+			scene.apply(light)
+		}
+	})
+
+	return nil
+}
+
+// SetAdjust nudges a property without knowing its current value. AdjustColor only
+// supports AdjustCircle.
+func (l light) SetAdjust(ctx context.Context, action AdjustAction, prop AdjustProperty) error {
+	if err := validateAdjust(action, prop); err != nil {
+		return eris.Wrap(err, "failed to adjust")
+	}
+
+	_, err := l.bb.executeCommand(ctx, l.method("set_adjust"), action, prop)
+	return err
+}
+
+// AdjustBrightness changes brightness by percentage (-100 to 100) of its range.
+func (l light) AdjustBrightness(ctx context.Context, percentage int, duration int) error {
+	return l.adjust(ctx, "adjust_bright", percentage, duration)
+}
+
+// AdjustColorTemperature changes color temperature by percentage (-100 to 100) of its
+// range.
+func (l light) AdjustColorTemperature(ctx context.Context, percentage int, duration int) error {
+	return l.adjust(ctx, "adjust_ct", percentage, duration)
+}
+
+// AdjustColor moves the color by percentage (-100 to 100) of its range.
+func (l light) AdjustColor(ctx context.Context, percentage int, duration int) error {
+	return l.adjust(ctx, "adjust_color", percentage, duration)
+}
+
+func (l light) adjust(ctx context.Context, method string, percentage int, duration int) error {
+	if err := firstError(validatePercentage(percentage), validateTransition(Smooth, duration)); err != nil {
+		return eris.Wrapf(err, "failed to execute %s", method)
+	}
+
+	_, err := l.bb.executeCommand(ctx, l.method(method), percentage, duration)
+	return err
+}
+
+// SetDefault saves the current state as the power-on default.
+func (l light) SetDefault(ctx context.Context) error {
+	_, err := l.bb.executeCommand(ctx, l.method("set_default"))
+	return err
+}
@@ -0,0 +1,121 @@
+package yeelight
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLightMethodPrefix(t *testing.T) {
+	bulb := newBulb(BulbInfo{})
+
+	assert.Equal(t, "set_rgb", bulb.method("set_rgb"))
+	assert.Equal(t, "bg_set_rgb", bulb.BackgroundLight().method("set_rgb"))
+}
+
+func TestBackgroundLightUpdatesItsOwnState(t *testing.T) {
+	bulb := newTestBulb(t)
+	ctx := context.Background()
+
+	require.NoError(t, bulb.SetRGB(ctx, 255, 0, 0, Sudden, 0))
+	require.NoError(t, bulb.BackgroundLight().SetRGB(ctx, 0, 0, 255, Sudden, 0))
+	require.NoError(t, bulb.BackgroundLight().TurnOff(ctx, Sudden, 0))
+
+	r, g, b := bulb.RGB()
+	assert.Equal(t, [3]uint8{255, 0, 0}, [3]uint8{r, g, b})
+
+	background := bulb.Background()
+	r, g, b = background.RGB()
+	assert.Equal(t, [3]uint8{0, 0, 255}, [3]uint8{r, g, b})
+	assert.Equal(t, ColorModeRGB, background.ColorMode())
+	assert.Equal(t, PowerOff, background.Power())
+}
+
+func TestBackgroundPropertyNotification(t *testing.T) {
+	bulb := newBulb(BulbInfo{})
+
+	bulb.applyPropertyNotification(map[string]any{
+		"bright":    50.0,
+		"bg_power":  "on",
+		"bg_bright": 20.0,
+		"bg_lmode":  2.0,
+		"bg_ct":     3000.0,
+	})
+
+	assert.Equal(t, uint8(50), bulb.Brightness())
+	assert.Equal(t, PowerStatus(""), bulb.Power())
+
+	background := bulb.Background()
+	assert.Equal(t, PowerOn, background.Power())
+	assert.Equal(t, uint8(20), background.Brightness())
+	assert.Equal(t, ColorModeTemperature, background.ColorMode())
+	assert.Equal(t, uint16(3000), background.ColorTemperature())
+}
+
+func TestPolledPropertiesIncludeBackground(t *testing.T) {
+	bulb := newBulb(BulbInfo{support: []string{"get_prop", "bg_set_power"}})
+	require.True(t, bulb.HasBackground())
+
+	props := bulb.polledProperties()
+	require.Len(t, props, 2*lightPropertyCount+1)
+
+	bulb.updatePropertiesFromSlice([]string{
+		"on", "80", "2", "2700", "0", "0", "0", "ceiling",
+		"on", "30", "1", "0", "65280", "0", "0",
+	})
+
+	assert.Equal(t, "ceiling", bulb.Name())
+	assert.Equal(t, uint16(2700), bulb.ColorTemperature())
+	assert.Equal(t, uint8(30), bulb.Background().Brightness())
+	r, g, b := bulb.Background().RGB()
+	assert.Equal(t, [3]uint8{0, 255, 0}, [3]uint8{r, g, b})
+}
+
+func TestCoalescedCommandLeavesStateAlone(t *testing.T) {
+	client, server := net.Pipe()
+	// answers without the property notifications serveTestBulb sends, which would
+	// change the brightness too
+	go func() {
+		scanner := bufio.NewScanner(server)
+		for scanner.Scan() {
+			var cmd command
+			if err := json.Unmarshal(scanner.Bytes(), &cmd); err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(server, `{"id":%d,"result":["ok"]}`+lineEnding, cmd.ID); err != nil {
+				return
+			}
+		}
+	}()
+
+	bulb := newBulb(BulbInfo{addr: netip.MustParseAddrPort("127.0.0.1:55443")})
+	bulb.limiter = newCommandLimiter(1, 0, 50*time.Millisecond)
+	bulb.attach(client)
+	t.Cleanup(func() {
+		bulb.Disconnect()
+		server.Close()
+	})
+
+	ctx := context.Background()
+	require.NoError(t, bulb.SetBrightness(ctx, 10, Sudden, 0))
+
+	superseded := make(chan error, 1)
+	go func() { superseded <- bulb.SetBrightness(ctx, 20, Sudden, 0) }()
+	time.Sleep(10 * time.Millisecond)
+	newest := make(chan error, 1)
+	go func() { newest <- bulb.SetBrightness(ctx, 30, Sudden, 0) }()
+
+	require.NoError(t, <-superseded)
+	assert.Equal(t, uint8(10), bulb.Brightness(), "a command that was never sent must not change the state")
+
+	require.NoError(t, <-newest)
+	assert.Equal(t, uint8(30), bulb.Brightness())
+}
@@ -0,0 +1,152 @@
+package yeelight
+
+import (
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/rotisserie/eris"
+)
+
+// how long to wait for the bulb to dial back after set_music
+const musicAcceptTimeout = 5 * time.Second
+
+var ErrMusicModeNoDialBack = eris.New("bulb did not connect back for music mode")
+
+// MusicModeOptions controls the listener the bulb dials back to in music mode.
+type MusicModeOptions struct {
+	// MinPort and MaxPort bound the listener port. Ports in the range are tried from a
+	// random starting point until one is free. Both zero lets the OS pick.
+	MinPort uint16
+	MaxPort uint16
+	// AdvertiseAddress is the IP the bulb is told to dial, for hosts the bulb cannot
+	// reach directly, such as a container with published ports or a NAT gateway. The
+	// listener then binds every interface. Empty advertises the local address of the
+	// control connection and listens only there. Either way, only connections from the
+	// bulb's own address are accepted.
+	AdvertiseAddress netip.Addr
+	// AcceptTimeout bounds how long to wait for the bulb to dial back. Zero uses 5s.
+	AcceptTimeout time.Duration
+}
+
+// musicListener accepts the connections the bulb opens after set_music.
+type musicListener struct {
+	ln            *net.TCPListener
+	advertise     netip.AddrPort
+	peer          netip.Addr
+	acceptTimeout time.Duration
+}
+
+// listenMusic opens the music mode listener. local is the local end of the control
+// connection, which is the address the bulb can reach unless told otherwise. peer is the
+// bulb's address; connections from anywhere else are turned away.
+func listenMusic(local net.Addr, peer netip.Addr, opts MusicModeOptions) (*musicListener, error) {
+	localTCP, ok := local.(*net.TCPAddr)
+	if !ok {
+		return nil, eris.Errorf("control connection has no TCP local address: %v", local)
+	}
+
+	bind := localTCP.AddrPort().Addr().Unmap()
+	// zones only mean something on this host
+	advertise := bind.WithZone("")
+	if opts.AdvertiseAddress.IsValid() {
+		bind = netip.IPv4Unspecified()
+		if opts.AdvertiseAddress.Is6() {
+			bind = netip.IPv6Unspecified()
+		}
+		advertise = opts.AdvertiseAddress
+	}
+
+	if opts.AcceptTimeout <= 0 {
+		opts.AcceptTimeout = musicAcceptTimeout
+	}
+
+	ln, err := listenPortRange(bind, opts.MinPort, opts.MaxPort)
+	if err != nil {
+		return nil, err
+	}
+
+	return &musicListener{
+		ln:            ln,
+		advertise:     netip.AddrPortFrom(advertise, ln.Addr().(*net.TCPAddr).AddrPort().Port()),
+		peer:          peer.Unmap().WithZone(""),
+		acceptTimeout: opts.AcceptTimeout,
+	}, nil
+}
+
+// listenPortRange listens on the first free port in [minPort, maxPort], starting from a
+// random one so concurrent sessions rarely collide.
+func listenPortRange(ip netip.Addr, minPort, maxPort uint16) (*net.TCPListener, error) {
+	if maxPort < minPort {
+		return nil, eris.Errorf("invalid music mode port range %d-%d", minPort, maxPort)
+	}
+
+	span := int(maxPort-minPort) + 1
+	start := rand.IntN(span)
+
+	var lastErr error
+	for i := range span {
+		port := minPort + uint16((start+i)%span)
+
+		ln, err := net.ListenTCP("tcp", net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, port)))
+		if err == nil {
+			return ln, nil
+		}
+		lastErr = err
+	}
+
+	if span == 1 {
+		return nil, eris.Wrapf(lastErr, "failed to listen for music mode on %s", netip.AddrPortFrom(ip, minPort))
+	}
+
+	return nil, eris.Wrapf(lastErr, "no free music mode port on %s in %d-%d", ip, minPort, maxPort)
+}
+
+func (ml *musicListener) close() error {
+	return ml.ln.Close()
+}
+
+// accept waits for the bulb to dial back, until the accept timeout passes or ctx is
+// done. Connections from other hosts are closed and waiting goes on, so nobody else on
+// the network can take over the session.
+func (ml *musicListener) accept(ctx context.Context) (net.Conn, error) {
+	if err := ml.ln.SetDeadline(deadline(ctx, ml.acceptTimeout)); err != nil {
+		return nil, eris.Wrap(err, "failed to set music mode accept deadline")
+	}
+
+	// cancelling ctx moves the deadline to now, which unblocks Accept
+	stop := context.AfterFunc(ctx, func() {
+		_ = ml.ln.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	for {
+		conn, err := ml.ln.AcceptTCP()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, eris.Wrap(ctx.Err(), "cancelled while waiting for the bulb to connect for music mode")
+			}
+
+			var netErr net.Error
+			if eris.As(err, &netErr) && netErr.Timeout() {
+				return nil, eris.Wrapf(ErrMusicModeNoDialBack, "the bulb did not connect to %s within %s", ml.advertise, ml.acceptTimeout)
+			}
+
+			return nil, eris.Wrap(err, "failed to accept connection from bulb")
+		}
+
+		from := conn.RemoteAddr().(*net.TCPAddr).AddrPort().Addr().Unmap().WithZone("")
+		if from == ml.peer {
+			return conn, nil
+		}
+
+		slog.Warn("rejecting music mode connection from another host",
+			slog.String("from", from.String()),
+			slog.String("bulb", ml.peer.String()),
+		)
+		conn.Close()
+	}
+}
@@ -1,7 +1,6 @@
 package yeelight
 
 import (
-	"context"
 	"net"
 )
 
@@ -9,14 +8,30 @@ type MusicModeBulb struct {
 	bulbBase
 }
 
-func newMusicModeBulb(b *bulbInfo, conn net.Conn) *MusicModeBulb {
-	return &MusicModeBulb{
+func newMusicModeBulb(state *bulbState, conn net.Conn) *MusicModeBulb {
+	bulb := &MusicModeBulb{
 		bulbBase: bulbBase{
-			bulbInfo: b,
-			conn:     conn,
-			commandCallback: func(ctx context.Context, cmd command) ([]string, error) {
-				return nil, nil
-			},
+			bulbState: state,
+			states:    newConnectionStates(),
 		},
 	}
+	bulb.initLights()
+	bulb.conn.Store(newConnection(conn, nil, state.Timeouts().Write, nil))
+	bulb.states.set(StateConnected)
+
+	return bulb
+}
+
+// reattach replaces the dropped connection prev. It reports false, and closes conn, if
+// the bulb was disconnected in the meantime.
+func (bb *MusicModeBulb) reattach(prev *connection, conn net.Conn) bool {
+	next := newConnection(conn, nil, bb.Timeouts().Write, nil)
+	if !bb.conn.CompareAndSwap(prev, next) {
+		next.close()
+		return false
+	}
+
+	bb.states.set(StateConnected)
+
+	return true
 }
@@ -0,0 +1,128 @@
+package yeelight
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var loopback = netip.MustParseAddr("127.0.0.1")
+
+// busyPort returns a loopback port that stays taken for the rest of the test.
+func busyPort(t *testing.T) uint16 {
+	t.Helper()
+
+	ln, err := net.ListenTCP("tcp", net.TCPAddrFromAddrPort(netip.AddrPortFrom(loopback, 0)))
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	return ln.Addr().(*net.TCPAddr).AddrPort().Port()
+}
+
+func TestListenPortRangeSkipsBusyPorts(t *testing.T) {
+	busy := busyPort(t)
+
+	// the OS tends to hand out neighbouring ports, but the one after busy may be taken too
+	for next := busy + 1; next < busy+10; next++ {
+		ln, err := listenPortRange(loopback, busy, next)
+		if err != nil {
+			continue
+		}
+		defer ln.Close()
+
+		port := ln.Addr().(*net.TCPAddr).AddrPort().Port()
+		assert.NotEqual(t, busy, port)
+		assert.LessOrEqual(t, port, next)
+		return
+	}
+
+	t.Skip("no free port next to the busy one")
+}
+
+func TestListenPortRangeReportsExhaustedRange(t *testing.T) {
+	busy := busyPort(t)
+
+	_, err := listenPortRange(loopback, busy, busy)
+	assert.ErrorContains(t, err, "failed to listen for music mode")
+
+	_, err = listenPortRange(loopback, busy, busy-1)
+	assert.ErrorContains(t, err, "invalid music mode port range")
+}
+
+func TestListenMusicAdvertisesControlAddress(t *testing.T) {
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+
+	ml, err := listenMusic(local, loopback, MusicModeOptions{})
+	require.NoError(t, err)
+	defer ml.close()
+
+	assert.Equal(t, loopback, ml.advertise.Addr())
+	assert.NotZero(t, ml.advertise.Port())
+	assert.Equal(t, musicAcceptTimeout, ml.acceptTimeout)
+}
+
+func TestListenMusicAdvertisesConfiguredAddress(t *testing.T) {
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	advertise := netip.MustParseAddr("192.0.2.10")
+
+	ml, err := listenMusic(local, loopback, MusicModeOptions{AdvertiseAddress: advertise})
+	require.NoError(t, err)
+	defer ml.close()
+
+	assert.Equal(t, advertise, ml.advertise.Addr())
+	assert.True(t, ml.ln.Addr().(*net.TCPAddr).IP.IsUnspecified())
+}
+
+func TestMusicAcceptTimesOut(t *testing.T) {
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+	ml, err := listenMusic(local, loopback, MusicModeOptions{AcceptTimeout: 50 * time.Millisecond})
+	require.NoError(t, err)
+	defer ml.close()
+
+	_, err = ml.accept(t.Context())
+	assert.ErrorIs(t, err, ErrMusicModeNoDialBack)
+}
+
+func TestMusicAcceptStopsOnCancel(t *testing.T) {
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+	ml, err := listenMusic(local, loopback, MusicModeOptions{})
+	require.NoError(t, err)
+	defer ml.close()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err = ml.accept(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), musicAcceptTimeout)
+}
+
+func TestMusicAcceptRejectsOtherHosts(t *testing.T) {
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	bulb := netip.MustParseAddr("192.0.2.10")
+
+	ml, err := listenMusic(local, bulb, MusicModeOptions{AcceptTimeout: 200 * time.Millisecond})
+	require.NoError(t, err)
+	defer ml.close()
+
+	// the connection comes from loopback, not from the bulb
+	foreign, err := net.Dial("tcp", ml.advertise.String())
+	require.NoError(t, err)
+	defer foreign.Close()
+
+	_, err = ml.accept(t.Context())
+	assert.ErrorIs(t, err, ErrMusicModeNoDialBack)
+
+	require.NoError(t, foreign.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = foreign.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF, "the foreign connection is closed")
+}
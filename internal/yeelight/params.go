@@ -0,0 +1,251 @@
+package yeelight
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/cybre/yeelight-music-sync/internal/utils"
+	"github.com/rotisserie/eris"
+)
+
+const (
+	minColorTemperature = 1700
+	maxColorTemperature = 6500
+	maxHue              = 359
+	// shortest transition the bulb accepts for the smooth effect, in milliseconds
+	minSmoothDuration = 30
+)
+
+// AdjustAction is the direction of a set_adjust command.
+type AdjustAction string
+
+const (
+	AdjustIncrease AdjustAction = "increase"
+	AdjustDecrease AdjustAction = "decrease"
+	// AdjustCircle wraps around to the minimum after reaching the maximum.
+	AdjustCircle AdjustAction = "circle"
+)
+
+// AdjustProperty is the property changed by a set_adjust command.
+type AdjustProperty string
+
+const (
+	AdjustBright AdjustProperty = "bright"
+	AdjustCT     AdjustProperty = "ct"
+	// AdjustColor only supports AdjustCircle.
+	AdjustColor AdjustProperty = "color"
+)
+
+// CronType identifies a bulb-side timer. Yeelight currently only supports power off.
+type CronType int
+
+const (
+	CronPowerOff CronType = 0
+)
+
+// CronJob is a timer stored on the bulb, as reported by cron_get.
+type CronJob struct {
+	Type CronType `json:"type"`
+	// Delay is the number of minutes until the job runs.
+	Delay int `json:"delay"`
+	Mix   int `json:"mix"`
+}
+
+// Scene is a complete lamp state applied with one set_scene command. The bulb is turned
+// on if it is off. Build one with SceneColor, SceneHSV, SceneColorTemperature,
+// SceneColorFlow or SceneAutoDelayOff.
+type Scene struct {
+	class  string
+	params []any
+	err    error
+	apply  func(*LightInfo)
+}
+
+// SceneColor sets an RGB color and brightness.
+func SceneColor(r, g, b, brightness uint8) Scene {
+	rgb := utils.RGBToInt(r, g, b)
+
+	return Scene{
+		class:  "color",
+		params: []any{rgb, brightness},
+		err:    validateBrightness(brightness),
+		apply: func(light *LightInfo) {
+			light.colorMode = ColorModeRGB
+			light.rgb = rgb
+			light.brightness = brightness
+		},
+	}
+}
+
+// SceneHSV sets a hue, saturation and brightness.
+func SceneHSV(hue uint16, saturation, brightness uint8) Scene {
+	return Scene{
+		class:  "hsv",
+		params: []any{hue, saturation, brightness},
+		err:    firstError(validateHue(hue), validateSaturation(saturation), validateBrightness(brightness)),
+		apply: func(light *LightInfo) {
+			light.colorMode = ColorModeHSV
+			light.hue = hue
+			light.saturation = saturation
+			light.brightness = brightness
+		},
+	}
+}
+
+// SceneColorTemperature sets a white color temperature in Kelvin and brightness.
+func SceneColorTemperature(colorTemperature uint16, brightness uint8) Scene {
+	return Scene{
+		class:  "ct",
+		params: []any{colorTemperature, brightness},
+		err:    firstError(validateColorTemperature(colorTemperature), validateBrightness(brightness)),
+		apply: func(light *LightInfo) {
+			light.colorMode = ColorModeTemperature
+			light.colorTemperature = colorTemperature
+			light.brightness = brightness
+		},
+	}
+}
+
+// SceneColorFlow turns the light on and starts a color flow.
+func SceneColorFlow(flow Flow) Scene {
+	return Scene{
+		class:  "cf",
+		params: flow.params(),
+		err:    flow.Validate(),
+	}
+}
+
+// SceneAutoDelayOff turns the bulb on at the given brightness and switches it off after
+// the given number of minutes.
+func SceneAutoDelayOff(brightness uint8, minutes int) Scene {
+	err := validateBrightness(brightness)
+	if err == nil && minutes < 1 {
+		err = ErrCronDelayInvalid
+	}
+
+	return Scene{
+		class:  "auto_delay_off",
+		params: []any{brightness, minutes},
+		err:    err,
+		apply: func(light *LightInfo) {
+			light.brightness = brightness
+		},
+	}
+}
+
+// resultValues decodes the result array of a reply. Most methods answer with strings;
+// cron_get answers with objects, which are kept as raw JSON text.
+type resultValues []string
+
+func (r *resultValues) UnmarshalJSON(data []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	values := make([]string, len(raw))
+	for i, item := range raw {
+		var s string
+		if err := json.Unmarshal(item, &s); err == nil {
+			values[i] = s
+			continue
+		}
+		values[i] = string(item)
+	}
+
+	*r = values
+
+	return nil
+}
+
+func validateBrightness(brightness uint8) error {
+	if brightness < 1 || brightness > 100 {
+		return ErrBrightnessInvalid
+	}
+
+	return nil
+}
+
+func validateColorTemperature(colorTemperature uint16) error {
+	if colorTemperature < minColorTemperature || colorTemperature > maxColorTemperature {
+		return ErrColorTemperatureInvalid
+	}
+
+	return nil
+}
+
+func validateHue(hue uint16) error {
+	if hue > maxHue {
+		return ErrHueInvalid
+	}
+
+	return nil
+}
+
+func validateSaturation(saturation uint8) error {
+	if saturation > 100 {
+		return ErrSaturationInvalid
+	}
+
+	return nil
+}
+
+func validatePercentage(percentage int) error {
+	if percentage < -100 || percentage > 100 {
+		return ErrPercentageInvalid
+	}
+
+	return nil
+}
+
+func validateTransition(effect Effect, duration int) error {
+	switch effect {
+	case Sudden:
+		return nil
+	case Smooth:
+		if duration < minSmoothDuration {
+			return ErrDurationInvalid
+		}
+		return nil
+	default:
+		return eris.Wrapf(ErrEffectInvalid, "unknown effect %q", effect)
+	}
+}
+
+func validateAdjust(action AdjustAction, prop AdjustProperty) error {
+	switch action {
+	case AdjustIncrease, AdjustDecrease, AdjustCircle:
+	default:
+		return eris.Wrapf(ErrAdjustInvalid, "unknown action %q", action)
+	}
+
+	switch prop {
+	case AdjustBright, AdjustCT:
+	case AdjustColor:
+		if action != AdjustCircle {
+			return eris.Wrap(ErrAdjustInvalid, "color can only be adjusted with circle")
+		}
+	default:
+		return eris.Wrapf(ErrAdjustInvalid, "unknown property %q", prop)
+	}
+
+	return nil
+}
+
+func validateName(name string) error {
+	if strings.TrimSpace(name) == "" || strings.ContainsAny(name, "\r\n") {
+		return ErrNameInvalid
+	}
+
+	return nil
+}
+
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,45 @@
+package yeelight
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResultValuesDecodesStringsAndObjects(t *testing.T) {
+	var result commandResult
+	require.NoError(t, json.Unmarshal([]byte(`{"id":1,"result":["on",{"type":0,"delay":15}]}`), &result))
+
+	assert.Equal(t, resultValues{"on", `{"type":0,"delay":15}`}, result.Result)
+}
+
+func TestSceneParams(t *testing.T) {
+	scene := SceneColor(255, 0, 0, 80)
+	assert.NoError(t, scene.err)
+	assert.Equal(t, "color", scene.class)
+	assert.Equal(t, []any{uint(0xFF0000), uint8(80)}, scene.params)
+
+	assert.ErrorIs(t, SceneColor(1, 2, 3, 0).err, ErrBrightnessInvalid)
+	assert.ErrorIs(t, SceneColorTemperature(7000, 50).err, ErrColorTemperatureInvalid)
+	assert.ErrorIs(t, SceneAutoDelayOff(50, 0).err, ErrCronDelayInvalid)
+	assert.ErrorIs(t, SceneColor(1, 2, 3, 0).err, ErrInvalidParameter)
+	assert.NotErrorIs(t, SceneColor(1, 2, 3, 0).err, ErrColorTemperatureInvalid)
+}
+
+func TestValidateTransition(t *testing.T) {
+	assert.NoError(t, validateTransition(Sudden, 0))
+	assert.NoError(t, validateTransition(Smooth, 30))
+	assert.ErrorIs(t, validateTransition(Smooth, 29), ErrDurationInvalid)
+	assert.ErrorIs(t, validateTransition("fade", 500), ErrEffectInvalid)
+	assert.ErrorIs(t, validateTransition("fade", 500), ErrInvalidParameter)
+}
+
+func TestValidateAdjust(t *testing.T) {
+	assert.NoError(t, validateAdjust(AdjustIncrease, AdjustBright))
+	assert.NoError(t, validateAdjust(AdjustCircle, AdjustColor))
+	assert.ErrorIs(t, validateAdjust(AdjustDecrease, AdjustColor), ErrAdjustInvalid)
+	assert.ErrorIs(t, validateAdjust("up", AdjustCT), ErrAdjustInvalid)
+	assert.ErrorIs(t, validateAdjust(AdjustIncrease, "hue"), ErrAdjustInvalid)
+}
@@ -0,0 +1,143 @@
+package yeelight
+
+import (
+	"context"
+	"log/slog"
+)
+
+// subscribers that fall this many changes behind miss the changes that follow
+const propertySubscriberBuffer = 32
+
+// Property identifies the bulb property a PropertyChange is about.
+type Property int
+
+const (
+	PropertyPower Property = iota
+	PropertyBrightness
+	PropertyColorMode
+	PropertyColorTemperature
+	PropertyRGB
+	PropertyHueSaturation
+	PropertyName
+)
+
+func (p Property) String() string {
+	switch p {
+	case PropertyPower:
+		return "power"
+	case PropertyBrightness:
+		return "brightness"
+	case PropertyColorMode:
+		return "color mode"
+	case PropertyColorTemperature:
+		return "color temperature"
+	case PropertyRGB:
+		return "rgb"
+	case PropertyHueSaturation:
+		return "hue/saturation"
+	case PropertyName:
+		return "name"
+	default:
+		return "unknown"
+	}
+}
+
+// PropertyChange reports a property the bulb says has changed, from a props
+// notification or a get_prop poll. Changes made by this program's own commands are
+// already part of the snapshot and are not reported again.
+type PropertyChange struct {
+	Property Property
+	// Background is set for changes to the background light of dual-light lamps.
+	Background bool
+	// Info is the snapshot with the change applied.
+	Info BulbInfo
+}
+
+// Subscribe delivers property changes until ctx is done, then closes the channel.
+func (s *bulbState) Subscribe(ctx context.Context) <-chan PropertyChange {
+	ch := make(chan PropertyChange, propertySubscriberBuffer)
+
+	s.mu.Lock()
+	if s.subscribers == nil {
+		s.subscribers = make(map[chan PropertyChange]struct{})
+	}
+	s.subscribers[ch] = struct{}{}
+	s.mu.Unlock()
+
+	context.AfterFunc(ctx, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		delete(s.subscribers, ch)
+		close(ch)
+	})
+
+	return ch
+}
+
+// report applies a change the bulb reported and notifies subscribers of every property
+// it changed.
+func (s *bulbState) report(fn func(*BulbInfo)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev := *s.snapshot.Load()
+	next := prev
+	fn(&next)
+	s.snapshot.Store(&next)
+
+	changes := propertyChanges(prev, next)
+	for ch := range s.subscribers {
+		for _, change := range changes {
+			select {
+			case ch <- change:
+			default:
+				slog.Warn("dropping bulb property change, subscriber is not keeping up",
+					slog.String("property", change.Property.String()),
+				)
+			}
+		}
+	}
+}
+
+func propertyChanges(prev, next BulbInfo) []PropertyChange {
+	var changes []PropertyChange
+
+	lights := []struct {
+		prev, next LightInfo
+		background bool
+	}{
+		{prev.LightInfo, next.LightInfo, false},
+		{prev.background, next.background, true},
+	}
+	for _, light := range lights {
+		add := func(property Property) {
+			changes = append(changes, PropertyChange{Property: property, Background: light.background, Info: next})
+		}
+
+		if light.prev.power != light.next.power {
+			add(PropertyPower)
+		}
+		if light.prev.brightness != light.next.brightness {
+			add(PropertyBrightness)
+		}
+		if light.prev.colorMode != light.next.colorMode {
+			add(PropertyColorMode)
+		}
+		if light.prev.colorTemperature != light.next.colorTemperature {
+			add(PropertyColorTemperature)
+		}
+		if light.prev.rgb != light.next.rgb {
+			add(PropertyRGB)
+		}
+		if light.prev.hue != light.next.hue || light.prev.saturation != light.next.saturation {
+			add(PropertyHueSaturation)
+		}
+	}
+
+	if prev.name != next.name {
+		changes = append(changes, PropertyChange{Property: PropertyName, Info: next})
+	}
+
+	return changes
+}
@@ -0,0 +1,56 @@
+package yeelight
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscribeReportsBulbChanges(t *testing.T) {
+	bulb := newBulb(BulbInfo{})
+	changes := bulb.Subscribe(t.Context())
+
+	bulb.applyPropertyNotification(map[string]any{"power": "off", "bg_bright": 30.0})
+
+	got := map[Property]PropertyChange{}
+	for range 2 {
+		change := <-changes
+		got[change.Property] = change
+	}
+
+	require.Contains(t, got, PropertyPower)
+	assert.False(t, got[PropertyPower].Background)
+	assert.Equal(t, PowerOff, got[PropertyPower].Info.Power())
+
+	require.Contains(t, got, PropertyBrightness)
+	assert.True(t, got[PropertyBrightness].Background)
+	assert.Equal(t, uint8(30), got[PropertyBrightness].Info.Background().Brightness())
+}
+
+func TestSubscribeSkipsConfirmedCommands(t *testing.T) {
+	bulb := newBulb(BulbInfo{})
+	changes := bulb.Subscribe(t.Context())
+
+	// a command updates the snapshot; the bulb's confirmation then changes nothing
+	bulb.update(func(info *BulbInfo) { info.brightness = 40 })
+	bulb.updatePropertiesFromSlice([]string{"", "40"})
+	bulb.applyPropertyNotification(map[string]any{"name": "desk"})
+
+	change := <-changes
+	assert.Equal(t, PropertyName, change.Property)
+	assert.Empty(t, changes)
+}
+
+func TestSubscribeClosesWhenContextEnds(t *testing.T) {
+	bulb := newBulb(BulbInfo{})
+	ctx, cancel := context.WithCancel(t.Context())
+	changes := bulb.Subscribe(ctx)
+
+	cancel()
+
+	_, ok := <-changes
+	assert.False(t, ok)
+	bulb.applyPropertyNotification(map[string]any{"power": "on"})
+}
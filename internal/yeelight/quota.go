@@ -0,0 +1,248 @@
+package yeelight
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rotisserie/eris"
+)
+
+const (
+	// Yeelight allows about 60 commands per minute on a normal connection. A bucket of
+	// 10 refilled once every 1.2s never sends more than 60 in any one-minute window.
+	defaultQuotaBurst          = 10
+	defaultQuotaRefillInterval = 1200 * time.Millisecond
+	// commands that would have to queue longer than this fail with a QuotaError
+	maxQuotaQueueDelay = 10 * time.Second
+	// property polling only runs while at least this many commands are left, so it can
+	// never starve interactive commands
+	pollQuotaReserve = 4
+	// commands kept back for Restore per light, enough to switch it on, set its color
+	// and brightness and switch it off again, so a session that used up the quota can
+	// still put the bulb back
+	restoreCommandsPerLight = 4
+)
+
+// restoreQuotaReserve is how many commands Restore may need for a bulb: the main light
+// and, where the bulb has one, the background light.
+func restoreQuotaReserve(info BulbInfo) int {
+	if info.HasBackground() {
+		return 2 * restoreCommandsPerLight
+	}
+	return restoreCommandsPerLight
+}
+
+var (
+	ErrQuotaExceeded = eris.New("bulb command quota exceeded")
+
+	errCommandCoalesced = eris.New("command superseded by a newer one")
+)
+
+// QuotaError is returned when a command does not fit in the connection's command quota,
+// either because the local limiter would have to queue it for too long or because the
+// bulb rejected it. It matches ErrQuotaExceeded.
+type QuotaError struct {
+	// RetryAfter is how long until the limiter has budget again. It is zero when the
+	// bulb reported the error.
+	RetryAfter time.Duration
+}
+
+func (e *QuotaError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("%s, retry after %s", ErrQuotaExceeded, e.RetryAfter.Round(time.Millisecond))
+	}
+
+	return ErrQuotaExceeded.Error()
+}
+
+func (e *QuotaError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+// QuotaStatus reports the command budget of a rate-limited connection.
+type QuotaStatus struct {
+	// Available is the number of commands that can be sent right now, not counting
+	// those kept back for Restore. It is negative while commands are queued.
+	Available float64
+	// Burst is the most commands that can be sent back to back.
+	Burst int
+	// RefillInterval is how often one more command becomes available.
+	RefillInterval time.Duration
+}
+
+// coalescableMethods set state absolutely, so a queued command is pointless once a
+// newer one of the same method is waiting behind it for the same light. Methods are
+// given without the background prefix.
+var coalescableMethods = map[string]bool{
+	"set_power":  true,
+	"set_bright": true,
+	"set_rgb":    true,
+	"set_hsv":    true,
+	"set_ct_abx": true,
+	"start_cf":   true,
+	"set_scene":  true,
+}
+
+// coalesceKey identifies the queued commands a newer one supersedes: the same method on
+// the same light. Power commands must also switch the same way, so an "off" is never
+// dropped in favour of an "on".
+type coalesceKey struct {
+	background bool
+	method     string
+	power      string
+}
+
+// coalesceKeyFor reports the key of a coalescable command, or false for commands that
+// are always sent.
+func coalesceKeyFor(method string, params []any) (coalesceKey, bool) {
+	base, background := strings.CutPrefix(method, backgroundMethodPrefix)
+	if !coalescableMethods[base] {
+		return coalesceKey{}, false
+	}
+
+	key := coalesceKey{background: background, method: base}
+	if base == "set_power" && len(params) > 0 {
+		key.power = fmt.Sprint(params[0])
+	}
+
+	return key, true
+}
+
+// commandLimiter is a token bucket guarding a connection's command quota. Commands
+// queue for a token; queued commands with the same coalesce key are collapsed so only
+// the newest one is sent. The last reserve tokens are only handed to commands whose
+// context came from WithReservedQuota.
+type commandLimiter struct {
+	mu          sync.Mutex
+	burst       float64
+	reserve     float64
+	interval    time.Duration
+	tokens      float64
+	last        time.Time
+	generations map[coalesceKey]uint64
+	now         func() time.Time
+}
+
+func newCommandLimiter(burst, reserve int, interval time.Duration) *commandLimiter {
+	return &commandLimiter{
+		burst:       float64(burst),
+		reserve:     float64(reserve),
+		interval:    interval,
+		tokens:      float64(burst),
+		last:        time.Now(),
+		generations: make(map[coalesceKey]uint64),
+		now:         time.Now,
+	}
+}
+
+func (l *commandLimiter) refill(now time.Time) {
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens = min(l.burst, l.tokens+float64(elapsed)/float64(l.interval))
+	}
+	l.last = now
+}
+
+type reservedQuotaKey struct{}
+
+// WithReservedQuota lets commands sent with ctx use the part of the quota kept back for
+// leaving the bulbs on exit. Restore uses it by itself; other commands sent on exit,
+// such as switching off, need it too.
+func WithReservedQuota(ctx context.Context) context.Context {
+	return context.WithValue(ctx, reservedQuotaKey{}, true)
+}
+
+// acquire waits until the command fits in the quota. It returns errCommandCoalesced if
+// a newer command with the same coalesce key was queued in the meantime.
+func (l *commandLimiter) acquire(ctx context.Context, method string, params []any) error {
+	l.mu.Lock()
+	now := l.now()
+	l.refill(now)
+
+	available := l.tokens
+	if reserved, _ := ctx.Value(reservedQuotaKey{}).(bool); !reserved {
+		available -= l.reserve
+	}
+
+	var wait time.Duration
+	if available < 1 {
+		wait = time.Duration((1 - available) * float64(l.interval))
+	}
+
+	if wait > maxQuotaQueueDelay {
+		l.mu.Unlock()
+		return &QuotaError{RetryAfter: wait}
+	}
+	if deadline, ok := ctx.Deadline(); ok && now.Add(wait).After(deadline) {
+		l.mu.Unlock()
+		return &QuotaError{RetryAfter: wait}
+	}
+
+	l.tokens--
+
+	var generation uint64
+	key, coalescable := coalesceKeyFor(method, params)
+	if coalescable {
+		l.generations[key]++
+		generation = l.generations[key]
+	}
+	l.mu.Unlock()
+
+	if wait == 0 {
+		return nil
+	}
+
+	if !sleepContext(ctx, wait) {
+		l.release()
+		return eris.Wrap(ctx.Err(), "failed to wait for command quota")
+	}
+
+	if coalescable && l.superseded(key, generation) {
+		l.release()
+		return errCommandCoalesced
+	}
+
+	return nil
+}
+
+func (l *commandLimiter) superseded(key coalesceKey, generation uint64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.generations[key] != generation
+}
+
+func (l *commandLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.tokens = min(l.burst, l.tokens+1)
+}
+
+// exhaust drains the bucket after the bulb rejected a command for exceeding its quota.
+func (l *commandLimiter) exhaust() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(l.now())
+	l.tokens = min(l.tokens, 0)
+}
+
+func (l *commandLimiter) status() QuotaStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(l.now())
+
+	return QuotaStatus{
+		Available:      l.tokens - l.reserve,
+		Burst:          int(l.burst),
+		RefillInterval: l.interval,
+	}
+}
+
+func (e *BulbError) quotaExceeded() bool {
+	return strings.Contains(strings.ToLower(e.Message), "quota")
+}
@@ -0,0 +1,151 @@
+package yeelight
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommandLimiterBurstThenQueue(t *testing.T) {
+	limiter := newCommandLimiter(2, 0, 20*time.Millisecond)
+	ctx := context.Background()
+
+	start := time.Now()
+	require.NoError(t, limiter.acquire(ctx, "get_prop", nil))
+	require.NoError(t, limiter.acquire(ctx, "get_prop", nil))
+	assert.Less(t, time.Since(start), 10*time.Millisecond)
+
+	require.NoError(t, limiter.acquire(ctx, "get_prop", nil))
+	assert.GreaterOrEqual(t, time.Since(start), 15*time.Millisecond)
+}
+
+func TestCommandLimiterQuotaError(t *testing.T) {
+	limiter := newCommandLimiter(1, 0, time.Minute)
+	require.NoError(t, limiter.acquire(context.Background(), "toggle", nil))
+
+	err := limiter.acquire(context.Background(), "toggle", nil)
+	require.Error(t, err)
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+
+	var quotaErr *QuotaError
+	require.True(t, errors.As(err, &quotaErr))
+	assert.Greater(t, quotaErr.RetryAfter, time.Duration(0))
+}
+
+func TestCommandLimiterRespectsDeadline(t *testing.T) {
+	limiter := newCommandLimiter(1, 0, time.Second)
+	require.NoError(t, limiter.acquire(context.Background(), "toggle", nil))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	assert.ErrorIs(t, limiter.acquire(ctx, "toggle", nil), ErrQuotaExceeded)
+	assert.InDelta(t, 0, limiter.status().Available, 0.1)
+}
+
+func TestCommandLimiterCoalescesQueuedCommands(t *testing.T) {
+	limiter := newCommandLimiter(1, 0, 30*time.Millisecond)
+	ctx := context.Background()
+	require.NoError(t, limiter.acquire(ctx, "set_rgb", nil))
+
+	var (
+		wg      sync.WaitGroup
+		results [2]error
+	)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = limiter.acquire(ctx, "set_rgb", nil)
+		}()
+		time.Sleep(5 * time.Millisecond)
+	}
+	wg.Wait()
+
+	assert.ErrorIs(t, results[0], errCommandCoalesced)
+	assert.NoError(t, results[1])
+}
+
+func TestCommandLimiterCoalescesOnlyTheSameCommand(t *testing.T) {
+	cases := map[string][2]struct {
+		method string
+		params []any
+	}{
+		"power off then on":    {{"set_power", []any{"off", "smooth", 500}}, {"set_power", []any{"on", "smooth", 500}}},
+		"main then background": {{"set_rgb", []any{255, "sudden", 0}}, {"bg_set_rgb", []any{255, "sudden", 0}}},
+	}
+
+	for name, commands := range cases {
+		t.Run(name, func(t *testing.T) {
+			limiter := newCommandLimiter(1, 0, 30*time.Millisecond)
+			ctx := context.Background()
+			require.NoError(t, limiter.acquire(ctx, "get_prop", nil))
+
+			var (
+				wg      sync.WaitGroup
+				results [2]error
+			)
+			for i, cmd := range commands {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					results[i] = limiter.acquire(ctx, cmd.method, cmd.params)
+				}()
+				time.Sleep(5 * time.Millisecond)
+			}
+			wg.Wait()
+
+			assert.NoError(t, results[0])
+			assert.NoError(t, results[1])
+		})
+	}
+}
+
+func TestCommandLimiterKeepsReserveForRestore(t *testing.T) {
+	limiter := newCommandLimiter(3, 2, time.Minute)
+	ctx := context.Background()
+
+	require.NoError(t, limiter.acquire(ctx, "set_bright", nil))
+	assert.InDelta(t, 0, limiter.status().Available, 0.01)
+	assert.ErrorIs(t, limiter.acquire(ctx, "set_bright", nil), ErrQuotaExceeded)
+
+	restore := WithReservedQuota(ctx)
+	require.NoError(t, limiter.acquire(restore, "set_bright", nil))
+	require.NoError(t, limiter.acquire(restore, "set_power", []any{"off"}))
+	assert.ErrorIs(t, limiter.acquire(restore, "set_bright", nil), ErrQuotaExceeded)
+}
+
+func TestRestoreReserveCoversEveryLight(t *testing.T) {
+	single := newBulb(BulbInfo{support: []string{"set_power"}})
+	assert.InDelta(t, defaultQuotaBurst-restoreCommandsPerLight, single.Quota().Available, 0.01)
+
+	dual := newBulb(BulbInfo{support: []string{"set_power", "bg_set_power"}})
+	assert.InDelta(t, defaultQuotaBurst-2*restoreCommandsPerLight, dual.Quota().Available, 0.01)
+}
+
+func TestCommandLimiterExhaust(t *testing.T) {
+	limiter := newCommandLimiter(5, 0, time.Minute)
+
+	limiter.exhaust()
+
+	status := limiter.status()
+	assert.InDelta(t, 0, status.Available, 0.01)
+	assert.Equal(t, 5, status.Burst)
+	assert.Equal(t, time.Minute, status.RefillInterval)
+}
+
+func TestPendingRequestsQuotaExceeded(t *testing.T) {
+	pending := newPendingRequests(50 * time.Millisecond)
+
+	cmd := command{ID: 1, Method: "set_bright"}
+	reply := pending.register(cmd.ID)
+	pending.resolve(commandResult{ID: 1, Error: &BulbError{Code: -1, Message: "client quota exceeded"}})
+
+	_, err := pending.wait(context.Background(), cmd, reply)
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+}
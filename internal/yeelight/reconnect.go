@@ -0,0 +1,148 @@
+package yeelight
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+const (
+	reconnectMinBackoff = 250 * time.Millisecond
+	reconnectMaxBackoff = 30 * time.Second
+)
+
+// ConnectionState describes the health of a bulb connection.
+type ConnectionState int
+
+const (
+	// StateDisconnected means the connection was never opened or was closed on purpose.
+	StateDisconnected ConnectionState = iota
+	// StateConnected means commands are being delivered.
+	StateConnected
+	// StateReconnecting means the connection dropped and is being re-established.
+	// Commands fail with ErrConnectionLost until the state returns to StateConnected.
+	StateReconnecting
+)
+
+// String returns a human-friendly name for the state.
+func (s ConnectionState) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	default:
+		return "unknown"
+	}
+}
+
+// connectionStates tracks the current ConnectionState and fans changes out to
+// subscribers. Subscribers only ever need the latest state, so a slow reader gets the
+// newest value instead of a backlog.
+type connectionStates struct {
+	mu          sync.Mutex
+	current     ConnectionState
+	subscribers map[chan ConnectionState]struct{}
+}
+
+func newConnectionStates() *connectionStates {
+	return &connectionStates{
+		subscribers: make(map[chan ConnectionState]struct{}),
+	}
+}
+
+func (s *connectionStates) get() ConnectionState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.current
+}
+
+func (s *connectionStates) set(state ConnectionState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.current == state {
+		return
+	}
+
+	s.current = state
+	for ch := range s.subscribers {
+		publishLatest(ch, state)
+	}
+}
+
+// subscribe delivers the current state immediately and every change after it until ctx
+// is done, at which point the channel is closed.
+func (s *connectionStates) subscribe(ctx context.Context) <-chan ConnectionState {
+	ch := make(chan ConnectionState, 1)
+
+	s.mu.Lock()
+	s.subscribers[ch] = struct{}{}
+	ch <- s.current
+	s.mu.Unlock()
+
+	context.AfterFunc(ctx, func() {
+		s.mu.Lock()
+		delete(s.subscribers, ch)
+		close(ch)
+		s.mu.Unlock()
+	})
+
+	return ch
+}
+
+func publishLatest[T any](ch chan T, value T) {
+	for {
+		select {
+		case ch <- value:
+			return
+		default:
+		}
+
+		select {
+		case <-ch:
+		default:
+		}
+	}
+}
+
+// backoff produces exponentially growing, jittered delays between reconnect attempts.
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	attempt int
+}
+
+func newBackoff() *backoff {
+	return &backoff{min: reconnectMinBackoff, max: reconnectMaxBackoff}
+}
+
+func (b *backoff) next() time.Duration {
+	delay := b.max
+	if b.attempt < 16 {
+		delay = min(b.min<<b.attempt, b.max)
+	}
+	b.attempt++
+
+	// ±20% jitter keeps several bulbs from retrying in lockstep
+	jitter := time.Duration(rand.Int64N(int64(delay)/5*2+1)) - delay/5
+
+	return delay + jitter
+}
+
+// sleepContext waits for d and reports false if ctx ended first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,43 @@
+package yeelight
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoffGrowsAndCaps(t *testing.T) {
+	retry := &backoff{min: 100 * time.Millisecond, max: time.Second}
+
+	var prev time.Duration
+	for range 4 {
+		delay := retry.next()
+		assert.Greater(t, delay, prev)
+		prev = delay
+	}
+
+	for range 20 {
+		delay := retry.next()
+		assert.LessOrEqual(t, delay, 1200*time.Millisecond)
+		assert.GreaterOrEqual(t, delay, 800*time.Millisecond)
+	}
+}
+
+func TestConnectionStatesKeepsLatest(t *testing.T) {
+	states := newConnectionStates()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ch := states.subscribe(ctx)
+	states.set(StateConnected)
+	states.set(StateReconnecting)
+
+	assert.Equal(t, StateReconnecting, <-ch)
+
+	cancel()
+	assert.Eventually(t, func() bool {
+		_, ok := <-ch
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+}
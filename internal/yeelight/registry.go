@@ -0,0 +1,278 @@
+package yeelight
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rotisserie/eris"
+)
+
+const (
+	// advertisement lifetime used when a bulb does not send Cache-Control
+	defaultAdvertisementMaxAge = time.Hour
+	// how often the registry checks for expired bulbs while idle
+	registrySweepInterval = 5 * time.Second
+	// buffered registry events before new ones are dropped
+	registryEventBuffer = 32
+)
+
+// RegistryEventType describes how a bulb entry in the Registry changed.
+type RegistryEventType int
+
+const (
+	// BulbAdded is emitted the first time a bulb is seen.
+	BulbAdded RegistryEventType = iota + 1
+	// BulbUpdated is emitted when a known bulb advertises a new address or state.
+	BulbUpdated
+	// BulbExpired is emitted when a bulb says goodbye or its advertisement times out.
+	BulbExpired
+)
+
+// String returns a human-friendly name for the event type.
+func (t RegistryEventType) String() string {
+	switch t {
+	case BulbAdded:
+		return "added"
+	case BulbUpdated:
+		return "updated"
+	case BulbExpired:
+		return "expired"
+	default:
+		return "unknown"
+	}
+}
+
+// RegistryEvent reports a change to the set of bulbs known to a Registry.
+type RegistryEvent struct {
+	Type RegistryEventType
+	ID   string
+	Bulb *Bulb
+}
+
+type registryEntry struct {
+	bulb    *Bulb
+	expires time.Time
+}
+
+// Registry keeps a live set of bulbs by listening to the NOTIFY advertisements Yeelight
+// bulbs periodically multicast on the SSDP group.
+type Registry struct {
+	mu      sync.Mutex
+	entries map[string]registryEntry
+	events  chan RegistryEvent
+	now     func() time.Time
+}
+
+// NewRegistry returns an empty registry. Call Watch to start listening.
+func NewRegistry() *Registry {
+	return &Registry{
+		entries: make(map[string]registryEntry),
+		events:  make(chan RegistryEvent, registryEventBuffer),
+		now:     time.Now,
+	}
+}
+
+// Events delivers added, updated and expired notifications keyed by bulb id.
+func (r *Registry) Events() <-chan RegistryEvent {
+	return r.events
+}
+
+// Bulbs returns the currently known bulbs ordered by id.
+func (r *Registry) Bulbs() []*Bulb {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	keys := make([]string, 0, len(r.entries))
+	for key := range r.entries {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	bulbs := make([]*Bulb, len(keys))
+	for i, key := range keys {
+		bulbs[i] = r.entries[key].bulb
+	}
+
+	return bulbs
+}
+
+// Seed records bulbs found through other means, such as Discover, without emitting
+// events for them.
+func (r *Registry) Seed(bulbs ...*Bulb) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	expires := r.now().Add(defaultAdvertisementMaxAge)
+	for _, bulb := range bulbs {
+		r.entries[bulbKey(bulb.Info())] = registryEntry{bulb: bulb, expires: expires}
+	}
+}
+
+// Watch joins the SSDP multicast group and processes advertisements until the context
+// is cancelled.
+func (r *Registry) Watch(ctx context.Context) error {
+	udpAddr, err := net.ResolveUDPAddr("udp4", ssdpAddress)
+	if err != nil {
+		return eris.Wrap(err, "failed to resolve SSDP address")
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, udpAddr)
+	if err != nil {
+		return eris.Wrap(err, "failed to join SSDP multicast group")
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	buf := make([]byte, 2048)
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(registrySweepInterval)); err != nil {
+			return eris.Wrap(err, "failed to set read deadline for SSDP connection")
+		}
+
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			var netErr net.Error
+			if eris.As(err, &netErr) && netErr.Timeout() {
+				r.expire(r.now())
+				continue
+			}
+
+			return eris.Wrap(err, "failed to read from SSDP connection")
+		}
+
+		if err := r.handleAdvertisement(string(buf[:n]), r.now()); err != nil {
+			slog.Debug("ignoring SSDP message",
+				slog.String("from", from.String()),
+				slog.Any("error", err),
+			)
+		}
+
+		r.expire(r.now())
+	}
+}
+
+func (r *Registry) handleAdvertisement(message string, now time.Time) error {
+	if !strings.HasPrefix(message, "NOTIFY") {
+		return eris.New("not a NOTIFY advertisement")
+	}
+
+	headers := parseSSDPHeaders(message)
+
+	if strings.EqualFold(headers["nts"], "ssdp:byebye") {
+		if id := headers["id"]; id != "" {
+			r.remove(id)
+			return nil
+		}
+	}
+
+	info, err := bulbInfoFromHeaders(headers)
+	if err != nil {
+		return err
+	}
+
+	r.observe(info, now.Add(advertisementMaxAge(headers["cache-control"])))
+
+	return nil
+}
+
+func (r *Registry) observe(info BulbInfo, expires time.Time) {
+	key := bulbKey(info)
+
+	r.mu.Lock()
+	entry, known := r.entries[key]
+	if known {
+		entry.expires = expires
+		r.entries[key] = entry
+
+		changed := !entry.bulb.Info().sameIdentity(info)
+		if changed {
+			entry.bulb.update(func(current *BulbInfo) {
+				current.setIdentity(info)
+			})
+		}
+		r.mu.Unlock()
+
+		if changed {
+			r.emit(RegistryEvent{Type: BulbUpdated, ID: key, Bulb: entry.bulb})
+		}
+
+		return
+	}
+
+	bulb := newBulb(info)
+	r.entries[key] = registryEntry{bulb: bulb, expires: expires}
+	r.mu.Unlock()
+
+	r.emit(RegistryEvent{Type: BulbAdded, ID: key, Bulb: bulb})
+}
+
+func (r *Registry) remove(key string) {
+	r.mu.Lock()
+	entry, ok := r.entries[key]
+	delete(r.entries, key)
+	r.mu.Unlock()
+
+	if ok {
+		r.emit(RegistryEvent{Type: BulbExpired, ID: key, Bulb: entry.bulb})
+	}
+}
+
+func (r *Registry) expire(now time.Time) {
+	r.mu.Lock()
+	var expired []RegistryEvent
+	for key, entry := range r.entries {
+		if now.After(entry.expires) {
+			delete(r.entries, key)
+			expired = append(expired, RegistryEvent{Type: BulbExpired, ID: key, Bulb: entry.bulb})
+		}
+	}
+	r.mu.Unlock()
+
+	for _, event := range expired {
+		r.emit(event)
+	}
+}
+
+func (r *Registry) emit(event RegistryEvent) {
+	select {
+	case r.events <- event:
+	default:
+		slog.Warn("dropping bulb registry event",
+			slog.String("id", event.ID),
+			slog.String("type", event.Type.String()),
+		)
+	}
+}
+
+// advertisementMaxAge extracts max-age from a Cache-Control header value.
+func advertisementMaxAge(cacheControl string) time.Duration {
+	for directive := range strings.SplitSeq(cacheControl, ",") {
+		value, found := strings.CutPrefix(strings.TrimSpace(directive), "max-age=")
+		if !found {
+			continue
+		}
+
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			break
+		}
+
+		return time.Duration(seconds) * time.Second
+	}
+
+	return defaultAdvertisementMaxAge
+}
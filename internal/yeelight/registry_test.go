@@ -0,0 +1,133 @@
+package yeelight
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func notifyMessage(addr, power string) string {
+	return ssdpMessage(
+		"NOTIFY * HTTP/1.1",
+		"Host: 239.255.255.250:1982",
+		"Cache-Control: max-age=60",
+		"Location: yeelight://"+addr,
+		"NTS: ssdp:alive",
+		"id: 0x01",
+		"model: color",
+		"power: "+power,
+	)
+}
+
+func nextEvent(t *testing.T, r *Registry) RegistryEvent {
+	t.Helper()
+
+	select {
+	case event := <-r.Events():
+		return event
+	default:
+		require.FailNow(t, "expected registry event")
+		return RegistryEvent{}
+	}
+}
+
+func assertNoEvent(t *testing.T, r *Registry) {
+	t.Helper()
+
+	select {
+	case event := <-r.Events():
+		assert.Failf(t, "unexpected registry event", "%s %s", event.Type, event.ID)
+	default:
+	}
+}
+
+func TestRegistryAddUpdateExpire(t *testing.T) {
+	r := NewRegistry()
+	now := time.Now()
+
+	require.NoError(t, r.handleAdvertisement(notifyMessage("10.0.0.2:55443", "on"), now))
+	event := nextEvent(t, r)
+	assert.Equal(t, BulbAdded, event.Type)
+	assert.Equal(t, "0x01", event.ID)
+	assert.Equal(t, PowerOn, event.Bulb.Power())
+	added := event.Bulb
+
+	require.NoError(t, r.handleAdvertisement(notifyMessage("10.0.0.2:55443", "on"), now.Add(time.Second)))
+	assertNoEvent(t, r)
+
+	require.NoError(t, r.handleAdvertisement(notifyMessage("10.0.0.3:55443", "on"), now.Add(2*time.Second)))
+	event = nextEvent(t, r)
+	assert.Equal(t, BulbUpdated, event.Type)
+	assert.Same(t, added, event.Bulb)
+	assert.Equal(t, "10.0.0.3:55443", event.Bulb.Addr().String())
+	assert.Len(t, r.Bulbs(), 1)
+
+	r.expire(now.Add(30 * time.Second))
+	assertNoEvent(t, r)
+
+	r.expire(now.Add(2 * time.Minute))
+	event = nextEvent(t, r)
+	assert.Equal(t, BulbExpired, event.Type)
+	assert.Empty(t, r.Bulbs())
+}
+
+func TestRegistryByeBye(t *testing.T) {
+	r := NewRegistry()
+	now := time.Now()
+
+	require.NoError(t, r.handleAdvertisement(notifyMessage("10.0.0.2:55443", "off"), now))
+	nextEvent(t, r)
+
+	bye := ssdpMessage("NOTIFY * HTTP/1.1", "NTS: ssdp:byebye", "id: 0x01")
+	require.NoError(t, r.handleAdvertisement(bye, now))
+	assert.Equal(t, BulbExpired, nextEvent(t, r).Type)
+}
+
+func TestRegistryIgnoresSearchRequests(t *testing.T) {
+	r := NewRegistry()
+
+	assert.Error(t, r.handleAdvertisement(discoverMSG, time.Now()))
+	assertNoEvent(t, r)
+}
+
+func TestRegistrySeedDoesNotEmit(t *testing.T) {
+	r := NewRegistry()
+	info, err := bulbInfoFromHeaders(parseSSDPHeaders(notifyMessage("10.0.0.2:55443", "on")))
+	require.NoError(t, err)
+
+	r.Seed(newBulb(info))
+	assertNoEvent(t, r)
+
+	require.NoError(t, r.handleAdvertisement(notifyMessage("10.0.0.2:55443", "on"), time.Now()))
+	assertNoEvent(t, r)
+}
+
+func TestRegistryIgnoresStateChanges(t *testing.T) {
+	r := NewRegistry()
+	info, err := bulbInfoFromHeaders(parseSSDPHeaders(notifyMessage("10.0.0.2:55443", "on")))
+	require.NoError(t, err)
+	seeded := newBulb(info)
+	r.Seed(seeded)
+
+	require.NoError(t, r.handleAdvertisement(notifyMessage("10.0.0.2:55443", "off"), time.Now()))
+	assertNoEvent(t, r)
+	require.Len(t, r.Bulbs(), 1)
+	assert.Same(t, seeded, r.Bulbs()[0])
+	assert.Equal(t, PowerOn, seeded.Power())
+
+	require.NoError(t, r.handleAdvertisement(notifyMessage("10.0.0.3:55443", "off"), time.Now()))
+	event := nextEvent(t, r)
+	assert.Equal(t, BulbUpdated, event.Type)
+	assert.Same(t, seeded, event.Bulb)
+	assert.Equal(t, "10.0.0.3:55443", seeded.Addr().String())
+	assert.Equal(t, PowerOn, seeded.Power())
+}
+
+func TestAdvertisementMaxAge(t *testing.T) {
+	assert.Equal(t, 3600*time.Second, advertisementMaxAge("max-age=3600"))
+	assert.Equal(t, 30*time.Second, advertisementMaxAge("no-cache, max-age=30"))
+	assert.Equal(t, defaultAdvertisementMaxAge, advertisementMaxAge(""))
+	assert.Equal(t, defaultAdvertisementMaxAge, advertisementMaxAge("max-age=soon"))
+}
@@ -0,0 +1,145 @@
+package yeelight
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rotisserie/eris"
+)
+
+const (
+	// how long a host gets to accept the connection and answer the handshake
+	defaultScanTimeout = time.Second
+	// hosts probed at once
+	defaultScanConcurrency = 64
+	// the largest range Scan sweeps, a /16 for IPv4
+	maxScanHosts = 1 << 16
+)
+
+// ScanOptions tunes Scan.
+type ScanOptions struct {
+	// Port is the control port probed on every host. Zero uses 55443.
+	Port uint16
+	// Timeout bounds connecting to and hearing back from one host. Zero uses one
+	// second.
+	Timeout time.Duration
+	// Concurrency is how many hosts are probed at once. Zero uses 64.
+	Concurrency int
+}
+
+// Scan probes every host in prefix for a bulb's control port, for networks that filter
+// the SSDP multicast Discover relies on. Each open port is confirmed with a get_prop
+// handshake that fills in the name, power and color state. Bulbs are returned ordered
+// by address. Only SSDP advertises the id, model and support list, so those stay empty.
+func Scan(ctx context.Context, prefix netip.Prefix, opts ScanOptions) ([]*Bulb, error) {
+	if opts.Port == 0 {
+		opts.Port = defaultBulbPort
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultScanTimeout
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = defaultScanConcurrency
+	}
+
+	hosts, err := scanHosts(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make([]*Bulb, len(hosts))
+	next := make(chan int)
+
+	var wg sync.WaitGroup
+	for range min(opts.Concurrency, len(hosts)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				found[i] = probeBulb(ctx, netip.AddrPortFrom(hosts[i], opts.Port), opts.Timeout)
+			}
+		}()
+	}
+
+feed:
+	for i := range hosts {
+		select {
+		case next <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(next)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, eris.Wrap(err, "bulb scan cancelled")
+	}
+
+	bulbs := make([]*Bulb, 0)
+	for _, bulb := range found {
+		if bulb != nil {
+			bulbs = append(bulbs, bulb)
+		}
+	}
+
+	return bulbs, nil
+}
+
+// scanHosts lists the host addresses of prefix, leaving out the network and broadcast
+// addresses of IPv4 ranges that have them.
+func scanHosts(prefix netip.Prefix) ([]netip.Addr, error) {
+	if !prefix.IsValid() {
+		return nil, eris.New("invalid scan range")
+	}
+	prefix = prefix.Masked()
+
+	hostBits := prefix.Addr().BitLen() - prefix.Bits()
+	if hostBits > 16 {
+		return nil, eris.Errorf("scan range %s is larger than %d addresses", prefix, maxScanHosts)
+	}
+
+	hosts := make([]netip.Addr, 0, 1<<hostBits)
+	for addr := prefix.Addr(); addr.IsValid() && prefix.Contains(addr); addr = addr.Next() {
+		hosts = append(hosts, addr)
+	}
+
+	if prefix.Addr().Is4() && hostBits >= 2 {
+		hosts = slices.Clip(hosts[1 : len(hosts)-1])
+	}
+
+	return hosts, nil
+}
+
+// probeBulb returns the bulb at addr, or nil if nothing answering like a bulb is there.
+func probeBulb(ctx context.Context, addr netip.AddrPort, timeout time.Duration) *Bulb {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	conn, err := dialBulb(ctx, addr.String(), timeout)
+	if err != nil {
+		return nil
+	}
+
+	bulb := newBulb(BulbInfo{addr: addr})
+
+	c := newConnection(conn, newPendingRequests(timeout), timeout, nil)
+	defer c.close()
+
+	props, err := c.execute(ctx, "get_prop", bulb.polledProperties()...)
+	if err != nil || len(props) <= lightPropertyCount {
+		return nil
+	}
+
+	// anything can listen on the port, but only a bulb reports its power this way
+	if power := PowerStatus(props[0]); power != PowerOn && power != PowerOff {
+		return nil
+	}
+
+	bulb.updatePropertiesFromSlice(props)
+
+	return bulb
+}
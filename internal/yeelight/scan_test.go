@@ -0,0 +1,66 @@
+package yeelight
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScanHosts(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{prefix: "192.0.2.0/30", want: []string{"192.0.2.1", "192.0.2.2"}},
+		{prefix: "192.0.2.5/30", want: []string{"192.0.2.5", "192.0.2.6"}},
+		{prefix: "192.0.2.4/31", want: []string{"192.0.2.4", "192.0.2.5"}},
+		{prefix: "192.0.2.7/32", want: []string{"192.0.2.7"}},
+		{prefix: "2001:db8::/127", want: []string{"2001:db8::", "2001:db8::1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			hosts, err := scanHosts(netip.MustParsePrefix(tt.prefix))
+			require.NoError(t, err)
+
+			got := make([]string, len(hosts))
+			for i, host := range hosts {
+				got[i] = host.String()
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	hosts, err := scanHosts(netip.MustParsePrefix("192.0.2.0/24"))
+	require.NoError(t, err)
+	assert.Len(t, hosts, 254)
+
+	_, err = scanHosts(netip.MustParsePrefix("10.0.0.0/8"))
+	assert.ErrorContains(t, err, "larger than")
+
+	_, err = scanHosts(netip.Prefix{})
+	assert.ErrorContains(t, err, "invalid scan range")
+}
+
+func TestProbeIgnoresSilentListeners(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr).AddrPort()
+	assert.Nil(t, probeBulb(t.Context(), addr, 100*time.Millisecond))
+}
@@ -0,0 +1,194 @@
+package yeelight
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/rotisserie/eris"
+)
+
+// restoreDuration is the fade used when putting a light back.
+const restoreDuration = 500
+
+// Snapshot is the state of a bulb's lights as Restore puts it back: power, brightness,
+// color and any color flow that was running.
+type Snapshot struct {
+	main          lightSnapshot
+	background    lightSnapshot
+	hasBackground bool
+}
+
+// Main returns the saved state of the main light.
+func (s Snapshot) Main() LightInfo {
+	return s.main.LightInfo
+}
+
+// Background returns the saved state of the background light. It is zero for bulbs
+// without one.
+func (s Snapshot) Background() LightInfo {
+	return s.background.LightInfo
+}
+
+// Flowing reports whether the main light was running a color flow.
+func (s Snapshot) Flowing() bool {
+	return s.main.flow != nil
+}
+
+type lightSnapshot struct {
+	LightInfo
+	// flow holds the start_cf parameters of the flow that was running, or nil.
+	flow []any
+}
+
+// snapshotProperties lists the properties read for one light, in the order
+// parseLightSnapshot expects them.
+var snapshotProperties = []string{"power", "bright", "color_mode", "ct", "rgb", "hue", "sat", "flowing", "flow_params"}
+
+// Snapshot reads the current state of the bulb's lights from the bulb itself.
+func (bb *Bulb) Snapshot(ctx context.Context) (Snapshot, error) {
+	hasBackground := bb.HasBackground()
+
+	props := make([]any, 0, 2*len(snapshotProperties))
+	for _, prop := range snapshotProperties {
+		props = append(props, prop)
+	}
+	if hasBackground {
+		for _, prop := range snapshotProperties {
+			if prop == "color_mode" {
+				prop = "lmode"
+			}
+			props = append(props, backgroundMethodPrefix+prop)
+		}
+	}
+
+	values, err := bb.executeCommand(ctx, "get_prop", props...)
+	if err != nil {
+		return Snapshot{}, eris.Wrap(err, "failed to snapshot bulb")
+	}
+	if len(values) != len(props) {
+		return Snapshot{}, eris.Errorf("failed to snapshot bulb: got %d properties, want %d", len(values), len(props))
+	}
+
+	addr := bb.Addr().String()
+	snapshot := Snapshot{
+		main:          parseLightSnapshot(values[:len(snapshotProperties)], addr),
+		hasBackground: hasBackground,
+	}
+	if hasBackground {
+		snapshot.background = parseLightSnapshot(values[len(snapshotProperties):], addr)
+	}
+
+	return snapshot, nil
+}
+
+func parseLightSnapshot(values []string, addr string) lightSnapshot {
+	var snapshot lightSnapshot
+	for i, value := range values[:lightPropertyCount] {
+		if value != "" {
+			updateLightProperty(&snapshot.LightInfo, i, value, addr)
+		}
+	}
+
+	if values[lightPropertyCount] == "1" {
+		snapshot.flow = parseFlowParams(values[lightPropertyCount+1])
+	}
+
+	return snapshot
+}
+
+// parseFlowParams turns a flow_params reply, "count,action,duration,mode,value,bright,..."
+// with one tuple per step, back into start_cf parameters. It returns nil for replies
+// that do not describe a flow.
+func parseFlowParams(value string) []any {
+	fields := strings.Split(value, ",")
+	if len(fields) < 6 || (len(fields)-2)%4 != 0 {
+		return nil
+	}
+
+	numbers := make([]int, len(fields))
+	for i, field := range fields {
+		n, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil
+		}
+		numbers[i] = n
+	}
+
+	steps := make([]string, len(numbers)-2)
+	for i, n := range numbers[2:] {
+		steps[i] = strconv.Itoa(n)
+	}
+
+	return []any{numbers[0], numbers[1], strings.Join(steps, ", ")}
+}
+
+// Restore puts the bulb's lights back into the state of snapshot with a short fade. A
+// light that was off gets its color back before it is switched off, so it comes back
+// on the same way. It may use the part of the command quota other commands leave alone,
+// so it works even after a session used up the rest.
+func (bb *Bulb) Restore(ctx context.Context, snapshot Snapshot) error {
+	ctx = WithReservedQuota(ctx)
+
+	if err := bb.light.restore(ctx, snapshot.main); err != nil {
+		return eris.Wrap(err, "failed to restore bulb")
+	}
+
+	if snapshot.hasBackground {
+		if err := bb.background.light.restore(ctx, snapshot.background); err != nil {
+			return eris.Wrap(err, "failed to restore background light")
+		}
+	}
+
+	return nil
+}
+
+func (l light) restore(ctx context.Context, snapshot lightSnapshot) error {
+	if l.lightInfo().Power() != PowerOn {
+		// the color of a light that stays off cannot be set without flashing it
+		if snapshot.power != PowerOn {
+			return nil
+		}
+		if err := l.TurnOn(ctx, Smooth, restoreDuration); err != nil {
+			return err
+		}
+	}
+
+	if snapshot.flow != nil {
+		if _, err := l.execute(ctx, l.method("start_cf"), snapshot.flow...); err != nil {
+			return err
+		}
+	} else if err := l.restoreColor(ctx, snapshot.LightInfo); err != nil {
+		return err
+	}
+
+	if snapshot.power == PowerOff {
+		return l.TurnOff(ctx, Smooth, restoreDuration)
+	}
+
+	return nil
+}
+
+// restoreColor sets the saved color and brightness. Colors the light cannot show, such
+// as the temperature a single-white bulb reports, are skipped.
+func (l light) restoreColor(ctx context.Context, saved LightInfo) error {
+	var err error
+	switch {
+	case saved.colorMode == ColorModeRGB:
+		r, g, b := saved.RGB()
+		err = l.SetRGB(ctx, r, g, b, Smooth, restoreDuration)
+	case saved.colorMode == ColorModeTemperature && saved.colorTemperature != 0:
+		err = l.SetColorTemperature(ctx, saved.colorTemperature, Smooth, restoreDuration)
+	case saved.colorMode == ColorModeHSV:
+		err = l.SetHueSaturation(ctx, saved.hue, saved.saturation, Smooth, restoreDuration)
+	}
+	if err != nil && !eris.Is(err, ErrUnsupported) {
+		return err
+	}
+
+	if saved.brightness == 0 {
+		return nil
+	}
+
+	return l.SetBrightness(ctx, saved.brightness, Smooth, restoreDuration)
+}
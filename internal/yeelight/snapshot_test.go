@@ -0,0 +1,31 @@
+package yeelight
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFlowParams(t *testing.T) {
+	assert.Equal(t,
+		[]any{0, 1, "1000, 2, 2700, 100, 500, 1, 255, 10"},
+		parseFlowParams("0,1,1000,2,2700,100,500,1,255,10"),
+	)
+	assert.Equal(t, []any{4, 0, "50, 1, 16711680, 80"}, parseFlowParams("4, 0, 50, 1, 16711680, 80"))
+
+	assert.Nil(t, parseFlowParams(""))
+	assert.Nil(t, parseFlowParams("0,1,1000,2,2700"))
+	assert.Nil(t, parseFlowParams("0,1,1000,2,warm,100"))
+}
+
+func TestParseLightSnapshot(t *testing.T) {
+	snapshot := parseLightSnapshot([]string{"on", "30", "2", "2700", "", "", "", "0", ""}, "test")
+	assert.Equal(t, PowerOn, snapshot.Power())
+	assert.Equal(t, uint8(30), snapshot.Brightness())
+	assert.Equal(t, ColorModeTemperature, snapshot.ColorMode())
+	assert.Equal(t, uint16(2700), snapshot.ColorTemperature())
+	assert.Nil(t, snapshot.flow)
+
+	flowing := parseLightSnapshot([]string{"on", "100", "1", "", "255", "", "", "1", "0,0,500,1,255,100"}, "test")
+	assert.Equal(t, []any{0, 0, "500, 1, 255, 100"}, flowing.flow)
+}
@@ -0,0 +1,126 @@
+package yeelight
+
+import (
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/rotisserie/eris"
+)
+
+const locationScheme = "yeelight://"
+
+// parseSSDPHeaders splits an SSDP message into a header map keyed by lowercase header
+// name. The start line and anything that is not a "key: value" pair are ignored, so the
+// headers may appear in any order.
+func parseSSDPHeaders(message string) map[string]string {
+	headers := make(map[string]string)
+
+	for line := range strings.SplitSeq(message, lineEnding) {
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+
+		key = strings.ToLower(strings.TrimSpace(key))
+		if key == "" {
+			continue
+		}
+
+		headers[key] = strings.TrimSpace(value)
+	}
+
+	return headers
+}
+
+// bulbInfoFromHeaders builds the bulb description advertised in an SSDP response or
+// notification.
+func bulbInfoFromHeaders(headers map[string]string) (BulbInfo, error) {
+	location, ok := headers["location"]
+	if !ok {
+		return BulbInfo{}, eris.New("missing Location header")
+	}
+
+	address, found := strings.CutPrefix(location, locationScheme)
+	if !found {
+		return BulbInfo{}, eris.Errorf("unexpected bulb location %q", location)
+	}
+
+	addr, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return BulbInfo{}, eris.Wrap(err, "failed to parse bulb address")
+	}
+
+	info := BulbInfo{
+		addr:            addr,
+		id:              headers["id"],
+		name:            headers["name"],
+		model:           headers["model"],
+		firmwareVersion: headers["fw_ver"],
+	}
+	info.power = PowerStatus(headers["power"])
+
+	if support := headers["support"]; support != "" {
+		info.support = strings.Fields(support)
+	}
+
+	if brightness, ok := headers["bright"]; ok {
+		v, err := strconv.ParseUint(brightness, 10, 8)
+		if err != nil {
+			return BulbInfo{}, eris.Wrap(err, "failed to convert brightness to uint8")
+		}
+		info.brightness = uint8(v)
+	}
+
+	if colorMode, ok := headers["color_mode"]; ok {
+		v, err := strconv.ParseUint(colorMode, 10, 8)
+		if err != nil {
+			return BulbInfo{}, eris.Wrap(err, "failed to convert color mode to uint8")
+		}
+		info.colorMode = ColorMode(v)
+	}
+
+	if colorTemperature, ok := headers["ct"]; ok {
+		v, err := strconv.ParseUint(colorTemperature, 10, 16)
+		if err != nil {
+			return BulbInfo{}, eris.Wrap(err, "failed to convert color temperature to uint16")
+		}
+		info.colorTemperature = uint16(v)
+	}
+
+	if rgb, ok := headers["rgb"]; ok {
+		v, err := strconv.ParseUint(rgb, 10, 32)
+		if err != nil {
+			return BulbInfo{}, eris.Wrap(err, "failed to convert RGB to uint32")
+		}
+		info.rgb = uint(v)
+	}
+
+	if hue, ok := headers["hue"]; ok {
+		v, err := strconv.ParseUint(hue, 10, 16)
+		if err != nil {
+			return BulbInfo{}, eris.Wrap(err, "failed to convert hue to uint16")
+		}
+		info.hue = uint16(v)
+	}
+
+	if saturation, ok := headers["sat"]; ok {
+		v, err := strconv.ParseUint(saturation, 10, 8)
+		if err != nil {
+			return BulbInfo{}, eris.Wrap(err, "failed to convert saturation to uint8")
+		}
+		info.saturation = uint8(v)
+	}
+
+	return info, nil
+}
+
+// bulbKey identifies a bulb across SSDP messages, falling back to its address when the
+// bulb did not advertise an id.
+func bulbKey(info BulbInfo) string {
+	if info.id != "" {
+		return info.id
+	}
+
+	return info.addr.String()
+}
@@ -0,0 +1,73 @@
+package yeelight
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func ssdpMessage(lines ...string) string {
+	return strings.Join(lines, lineEnding) + lineEnding
+}
+
+func TestBulbInfoFromHeadersLocationNotFirst(t *testing.T) {
+	msg := ssdpMessage(
+		"HTTP/1.1 200 OK",
+		"Cache-Control: max-age=3600",
+		"id: 0x000000000015243f",
+		"model: color",
+		"fw_ver: 18",
+		"support: get_prop set_default set_power toggle",
+		"Location: yeelight://192.168.1.239:55443",
+		"power: on",
+		"bright: 100",
+		"color_mode: 2",
+		"ct: 4000",
+		"rgb: 16711680",
+		"hue: 100",
+		"sat: 35",
+		"name: desk",
+	)
+
+	info, err := bulbInfoFromHeaders(parseSSDPHeaders(msg))
+	require.NoError(t, err)
+
+	assert.Equal(t, "192.168.1.239:55443", info.Addr().String())
+	assert.Equal(t, "0x000000000015243f", info.ID())
+	assert.Equal(t, "color", info.Model())
+	assert.Equal(t, "18", info.FirmwareVersion())
+	assert.Equal(t, []string{"get_prop", "set_default", "set_power", "toggle"}, info.Support())
+	assert.Equal(t, PowerOn, info.Power())
+	assert.Equal(t, uint8(100), info.Brightness())
+	assert.Equal(t, ColorModeTemperature, info.ColorMode())
+	assert.Equal(t, uint16(4000), info.ColorTemperature())
+	r, g, b := info.RGB()
+	assert.Equal(t, [3]uint8{255, 0, 0}, [3]uint8{r, g, b})
+	assert.Equal(t, uint16(100), info.Hue())
+	assert.Equal(t, uint8(35), info.Saturation())
+	assert.Equal(t, "desk", info.Name())
+}
+
+func TestBulbInfoFromHeadersMissingLocation(t *testing.T) {
+	_, err := bulbInfoFromHeaders(parseSSDPHeaders(ssdpMessage("HTTP/1.1 200 OK", "id: 0x1")))
+	assert.Error(t, err)
+}
+
+func TestBulbInfoFromHeadersInvalidNumber(t *testing.T) {
+	msg := ssdpMessage(
+		"Location: yeelight://192.168.1.239:55443",
+		"bright: very",
+	)
+
+	_, err := bulbInfoFromHeaders(parseSSDPHeaders(msg))
+	assert.Error(t, err)
+}
+
+func TestBulbKeyFallsBackToAddress(t *testing.T) {
+	info, err := bulbInfoFromHeaders(parseSSDPHeaders(ssdpMessage("Location: yeelight://10.0.0.2:55443")))
+	require.NoError(t, err)
+
+	assert.Equal(t, "10.0.0.2:55443", bulbKey(info))
+}
@@ -0,0 +1,55 @@
+package yeelight
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+const (
+	defaultDialTimeout  = 5 * time.Second
+	defaultWriteTimeout = 3 * time.Second
+)
+
+// Timeouts bounds the network I/O of a bulb. Each bound also ends early when the
+// context of the call is done. Zero fields use the defaults.
+type Timeouts struct {
+	// Dial bounds opening the control connection, including reconnects. Zero uses 5s.
+	Dial time.Duration
+	// Write bounds writing one command to the control or music connection. Zero uses
+	// 3s.
+	Write time.Duration
+	// Reply bounds waiting for the bulb to answer a command. Zero uses 3s.
+	Reply time.Duration
+}
+
+func (t Timeouts) withDefaults() Timeouts {
+	if t.Dial <= 0 {
+		t.Dial = defaultDialTimeout
+	}
+	if t.Write <= 0 {
+		t.Write = defaultWriteTimeout
+	}
+	if t.Reply <= 0 {
+		t.Reply = commandResponseTimeout
+	}
+
+	return t
+}
+
+// dialBulb opens a TCP connection to addr, giving up after timeout or once ctx is done.
+func dialBulb(ctx context.Context, addr string, timeout time.Duration) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: timeout}
+
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+// deadline returns the earlier of now+timeout and the deadline of ctx.
+func deadline(ctx context.Context, timeout time.Duration) time.Time {
+	d := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(d) {
+		d = ctxDeadline
+	}
+
+	return d
+}
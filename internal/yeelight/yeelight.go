@@ -2,10 +2,10 @@ package yeelight
 
 import (
 	"context"
+	"log/slog"
 	"net"
 	"net/netip"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/rotisserie/eris"
@@ -34,130 +34,96 @@ func NewBulbFromAddress(address string) (*Bulb, error) {
 		return nil, eris.Wrap(err, "failed to parse bulb address")
 	}
 
-	return newBulb(addr), nil
+	return newBulb(BulbInfo{addr: addr}), nil
 }
 
-func Discover(ctx context.Context) ([]*Bulb, error) {
-	bulbs := make([]*Bulb, 0)
-
-	udpAddr, err := net.ResolveUDPAddr("udp4", ssdpAddress)
-	if err != nil {
-		return nil, eris.Wrap(err, "failed to resolve SSDP address")
-	}
+// DiscoverOptions tunes SSDP discovery.
+type DiscoverOptions struct {
+	// Window bounds how long responses are collected. The context deadline still
+	// applies when it is earlier. Zero uses the default timeout.
+	Window time.Duration
+	// Address is where the search is sent. Empty uses the SSDP multicast group; a
+	// unicast address asks a single responder, such as a yeelighttest bulb.
+	Address string
+}
 
-	conn, err := net.ListenUDP("udp4", udpAddr)
-	if err != nil {
-		return nil, eris.Wrap(err, "failed to establish connection to SSDP address")
+// Discover multicasts an SSDP search and collects responses until the discovery window
+// or the context deadline ends. Responses are merged by bulb id, so every bulb is
+// returned once, in the order it first answered.
+func Discover(ctx context.Context, opts DiscoverOptions) ([]*Bulb, error) {
+	if opts.Window <= 0 {
+		opts.Window = timeout
 	}
-
-	if _, err = conn.WriteToUDP([]byte(discoverMSG), udpAddr); err != nil {
-		return nil, eris.Wrap(err, "failed to write discover message to SSDP address")
+	if opts.Address == "" {
+		opts.Address = ssdpAddress
 	}
 
-	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
-		return nil, eris.Wrap(err, "failed to set read deadline for SSDP connection")
+	udpAddr, err := net.ResolveUDPAddr("udp4", opts.Address)
+	if err != nil {
+		return nil, eris.Wrap(err, "failed to resolve SSDP address")
 	}
 
-	buf := make([]byte, 1024)
-	n, _, err := conn.ReadFromUDP(buf)
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
 	if err != nil {
-		return nil, eris.Wrap(err, "failed to read from SSDP connection")
+		return nil, eris.Wrap(err, "failed to open SSDP socket")
 	}
+	defer conn.Close()
 
-	resp := string(buf[:n])
-	for line := range strings.SplitSeq(resp, lineEnding) {
-		if address, found := strings.CutPrefix(line, "Location: yeelight://"); found {
-			addr, err := netip.ParseAddrPort(address)
-			if err != nil {
-				return nil, eris.Wrap(err, "failed to parse bulb address")
-			}
-			bulbs = append(bulbs, newBulb(addr))
-			continue
-		}
-
-		if id, found := strings.CutPrefix(line, "id: "); found {
-			bulbs[len(bulbs)-1].id = id
-			continue
-		}
-
-		if support, found := strings.CutPrefix(line, "support: "); found {
-			bulbs[len(bulbs)-1].support = strings.Split(support, " ")
-			continue
-		}
-
-		if power, found := strings.CutPrefix(line, "power: "); found {
-			bulbs[len(bulbs)-1].power = PowerStatus(power)
-			continue
-		}
-
-		if brightness, found := strings.CutPrefix(line, "bright: "); found {
-			brightnessInt, err := strconv.ParseUint(brightness, 10, 8)
-			if err != nil {
-				return nil, eris.Wrap(err, "failed to convert brightness to uint8")
-			}
-			bulbs[len(bulbs)-1].brightness = uint8(brightnessInt)
-			continue
-		}
-
-		if colorMode, found := strings.CutPrefix(line, "color_mode: "); found {
-			colorModeInt, err := strconv.ParseUint(colorMode, 10, 8)
-			if err != nil {
-				return nil, eris.Wrap(err, "failed to convert color mode to uint8")
-			}
-			bulbs[len(bulbs)-1].colorMode = ColorMode(colorModeInt)
-			continue
-		}
+	if err := conn.SetDeadline(deadline(ctx, opts.Window)); err != nil {
+		return nil, eris.Wrap(err, "failed to set deadline for SSDP connection")
+	}
 
-		if colorTemperature, found := strings.CutPrefix(line, "ct: "); found {
-			colorTemperatureInt, err := strconv.ParseUint(colorTemperature, 10, 16)
-			if err != nil {
-				return nil, eris.Wrap(err, "failed to convert color temperature to uint16")
-			}
-			bulbs[len(bulbs)-1].colorTemperature = uint16(colorTemperatureInt)
-			continue
-		}
+	// cancelling ctx moves the deadline to now, which unblocks the read
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+	defer stop()
 
-		if rgb, found := strings.CutPrefix(line, "rgb: "); found {
-			rgbInt, err := strconv.ParseUint(rgb, 10, 32)
-			if err != nil {
-				return nil, eris.Wrap(err, "failed to convert RGB to uint32")
-			}
-			bulbs[len(bulbs)-1].rgb = uint(rgbInt)
-			continue
+	if _, err = conn.WriteToUDP([]byte(discoverMSG), udpAddr); err != nil {
+		if ctx.Err() != nil {
+			return nil, eris.Wrap(ctx.Err(), "bulb discovery cancelled")
 		}
+		return nil, eris.Wrap(err, "failed to write discover message to SSDP address")
+	}
 
-		if hue, found := strings.CutPrefix(line, "hue: "); found {
-			hueInt, err := strconv.ParseUint(hue, 10, 16)
-			if err != nil {
-				return nil, eris.Wrap(err, "failed to convert hue to uint16")
+	var (
+		bulbs = make([]*Bulb, 0)
+		seen  = make(map[string]int)
+		buf   = make([]byte, 2048)
+	)
+
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			// running into the context deadline ends the window like the timeout does
+			if err := ctx.Err(); err != nil && !eris.Is(err, context.DeadlineExceeded) {
+				return nil, eris.Wrap(err, "bulb discovery cancelled")
 			}
-			bulbs[len(bulbs)-1].hue = uint16(hueInt)
-			continue
-		}
 
-		if saturation, found := strings.CutPrefix(line, "sat: "); found {
-			saturationInt, err := strconv.ParseUint(saturation, 10, 8)
-			if err != nil {
-				return nil, eris.Wrap(err, "failed to convert saturation to uint8")
+			var netErr net.Error
+			if eris.As(err, &netErr) && netErr.Timeout() {
+				break
 			}
-			bulbs[len(bulbs)-1].saturation = uint8(saturationInt)
-			continue
+			return nil, eris.Wrap(err, "failed to read from SSDP connection")
 		}
 
-		if name, found := strings.CutPrefix(line, "name: "); found {
-			bulbs[len(bulbs)-1].name = name
+		info, err := bulbInfoFromHeaders(parseSSDPHeaders(string(buf[:n])))
+		if err != nil {
+			slog.Warn("ignoring malformed SSDP response",
+				slog.String("from", from.String()),
+				slog.Any("error", err),
+			)
 			continue
 		}
 
-		if model, found := strings.CutPrefix(line, "model: "); found {
-			bulbs[len(bulbs)-1].model = model
+		key := bulbKey(info)
+		if i, ok := seen[key]; ok {
+			bulbs[i] = newBulb(info)
 			continue
 		}
 
-		if firmwareVersion, found := strings.CutPrefix(line, "fw_ver: "); found {
-			bulbs[len(bulbs)-1].firmwareVersion = firmwareVersion
-			continue
-		}
+		seen[key] = len(bulbs)
+		bulbs = append(bulbs, newBulb(info))
 	}
 
 	return bulbs, nil
@@ -0,0 +1,415 @@
+package yeelight_test
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cybre/yeelight-music-sync/internal/yeelight"
+	"github.com/cybre/yeelight-music-sync/internal/yeelight/yeelighttest"
+)
+
+func newFakeBulb(t *testing.T, opts yeelighttest.Options) *yeelighttest.Bulb {
+	t.Helper()
+
+	fake, err := yeelighttest.NewBulb(opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { fake.Close() })
+
+	return fake
+}
+
+func connectFakeBulb(t *testing.T, fake *yeelighttest.Bulb) *yeelight.Bulb {
+	t.Helper()
+
+	bulb, err := yeelight.NewBulbFromAddress(fake.Addr())
+	require.NoError(t, err)
+	require.NoError(t, bulb.Connect(t.Context()))
+	t.Cleanup(func() { bulb.Disconnect() })
+
+	return bulb
+}
+
+func lastCommand(t *testing.T, fake *yeelighttest.Bulb) yeelighttest.Command {
+	t.Helper()
+
+	commands := fake.Commands()
+	require.NotEmpty(t, commands)
+
+	return commands[len(commands)-1]
+}
+
+func TestDiscoverFakeBulb(t *testing.T) {
+	fake := newFakeBulb(t, yeelighttest.Options{
+		ID:      "0x0000000000abcdef",
+		Name:    "desk",
+		Model:   "ceiling4",
+		Support: []string{"get_prop", "set_power", "bg_set_power"},
+	})
+
+	bulbs, err := yeelight.Discover(t.Context(), yeelight.DiscoverOptions{
+		Address: fake.SSDPAddr(),
+		Window:  200 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	require.Len(t, bulbs, 1)
+
+	bulb := bulbs[0]
+	assert.Equal(t, "0x0000000000abcdef", bulb.ID())
+	assert.Equal(t, "desk", bulb.Name())
+	assert.Equal(t, "ceiling4", bulb.Model())
+	assert.Equal(t, fake.Addr(), bulb.Addr().String())
+	assert.True(t, bulb.HasBackground())
+	assert.Equal(t, yeelight.PowerOn, bulb.Power())
+}
+
+func TestDiscoverStopsWhenCancelled(t *testing.T) {
+	// a socket that never answers the search
+	silent, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer silent.Close()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err = yeelight.Discover(ctx, yeelight.DiscoverOptions{
+		Address: silent.LocalAddr().String(),
+		Window:  time.Minute,
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestScanFindsFakeBulb(t *testing.T) {
+	fake := newFakeBulb(t, yeelighttest.Options{
+		Name:  "desk",
+		Props: map[string]string{"power": "off", "bright": "42"},
+	})
+	addr := netip.MustParseAddrPort(fake.Addr())
+
+	bulbs, err := yeelight.Scan(t.Context(), netip.PrefixFrom(addr.Addr(), 32), yeelight.ScanOptions{Port: addr.Port()})
+	require.NoError(t, err)
+	require.Len(t, bulbs, 1)
+
+	bulb := bulbs[0]
+	assert.Equal(t, addr, bulb.Addr())
+	assert.Equal(t, "desk", bulb.Name())
+	assert.Equal(t, yeelight.PowerOff, bulb.Power())
+	assert.Equal(t, uint8(42), bulb.Brightness())
+}
+
+func TestRestorePutsBackWarmWhite(t *testing.T) {
+	fake := newFakeBulb(t, yeelighttest.Options{
+		Props: map[string]string{"power": "on", "bright": "30", "color_mode": "2", "ct": "2700"},
+	})
+	bulb := connectFakeBulb(t, fake)
+
+	snapshot, err := bulb.Snapshot(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, yeelight.ColorModeTemperature, snapshot.Main().ColorMode())
+
+	require.NoError(t, bulb.SetHSV(t.Context(), 200, 100, 90, yeelight.Sudden, 0))
+	require.NoError(t, bulb.Restore(t.Context(), snapshot))
+
+	assert.Equal(t, "on", fake.Prop("power"))
+	assert.Equal(t, "2", fake.Prop("color_mode"))
+	assert.Equal(t, "2700", fake.Prop("ct"))
+	assert.Equal(t, "30", fake.Prop("bright"))
+}
+
+func TestRestoreWorksWithExhaustedQuota(t *testing.T) {
+	fake := newFakeBulb(t, yeelighttest.Options{
+		Props: map[string]string{"power": "on", "bright": "30", "color_mode": "2", "ct": "2700"},
+	})
+	bulb := connectFakeBulb(t, fake)
+
+	snapshot, err := bulb.Snapshot(t.Context())
+	require.NoError(t, err)
+
+	// a fallback session spends every command it is allowed
+	for i := 0; bulb.Quota().Available >= 1; i++ {
+		require.NoError(t, bulb.SetBrightness(t.Context(), uint8(50+i), yeelight.Sudden, 0))
+	}
+	short, cancel := context.WithTimeout(t.Context(), 100*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, bulb.SetBrightness(short, 90, yeelight.Sudden, 0), yeelight.ErrQuotaExceeded)
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second)
+	defer cancel()
+	require.NoError(t, bulb.Restore(ctx, snapshot))
+
+	assert.Equal(t, "2700", fake.Prop("ct"))
+	assert.Equal(t, "30", fake.Prop("bright"))
+}
+
+func TestRestoreWorksWithExhaustedQuotaOnDualLightBulb(t *testing.T) {
+	fake := newFakeBulb(t, yeelighttest.Options{
+		ID: "0x01",
+		Support: []string{
+			"get_prop", "set_power", "set_bright", "set_ct_abx",
+			"bg_set_power", "bg_set_bright", "bg_set_ct_abx",
+		},
+		Props: map[string]string{
+			"power": "off", "bright": "30", "color_mode": "2", "ct": "2700",
+			"bg_power": "off", "bg_bright": "60", "bg_lmode": "2", "bg_ct": "3500",
+		},
+	})
+	bulbs, err := yeelight.Discover(t.Context(), yeelight.DiscoverOptions{
+		Address: fake.SSDPAddr(),
+		Window:  200 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	require.Len(t, bulbs, 1)
+	bulb := bulbs[0]
+	require.True(t, bulb.HasBackground())
+	require.NoError(t, bulb.Connect(t.Context()))
+	t.Cleanup(func() { bulb.Disconnect() })
+
+	snapshot, err := bulb.Snapshot(t.Context())
+	require.NoError(t, err)
+
+	// a fallback session switches both lights on and then spends every command left
+	background := bulb.BackgroundLight()
+	require.NoError(t, bulb.TurnOn(t.Context(), yeelight.Sudden, 0))
+	require.NoError(t, background.TurnOn(t.Context(), yeelight.Sudden, 0))
+	for i := 0; bulb.Quota().Available >= 1; i++ {
+		require.NoError(t, background.SetBrightness(t.Context(), uint8(10+i), yeelight.Sudden, 0))
+	}
+	require.Eventually(t, func() bool {
+		return bulb.Power() == yeelight.PowerOn && bulb.Info().Background().Power() == yeelight.PowerOn
+	}, time.Second, 5*time.Millisecond)
+
+	// both lights go through on, color, brightness and off
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second)
+	defer cancel()
+	require.NoError(t, bulb.Restore(ctx, snapshot))
+
+	assert.Equal(t, "off", fake.Prop("power"))
+	assert.Equal(t, "2700", fake.Prop("ct"))
+	assert.Equal(t, "30", fake.Prop("bright"))
+	assert.Equal(t, "off", fake.Prop("bg_power"))
+	assert.Equal(t, "3500", fake.Prop("bg_ct"))
+	assert.Equal(t, "60", fake.Prop("bg_bright"))
+}
+
+func TestRestoreSwitchesOffAfterRestoringColor(t *testing.T) {
+	fake := newFakeBulb(t, yeelighttest.Options{
+		Props: map[string]string{"power": "off", "bright": "40", "color_mode": "1", "rgb": "255"},
+	})
+	bulb := connectFakeBulb(t, fake)
+
+	snapshot, err := bulb.Snapshot(t.Context())
+	require.NoError(t, err)
+
+	require.NoError(t, bulb.TurnOn(t.Context(), yeelight.Sudden, 0))
+	require.NoError(t, bulb.SetWhite(t.Context(), 6500, 100, yeelight.Sudden, 0))
+	require.NoError(t, bulb.Restore(t.Context(), snapshot))
+
+	assert.Equal(t, "off", fake.Prop("power"))
+	assert.Equal(t, "1", fake.Prop("color_mode"))
+	assert.Equal(t, "255", fake.Prop("rgb"))
+	assert.Equal(t, "40", fake.Prop("bright"))
+}
+
+func TestBulbCommandsReachFakeBulb(t *testing.T) {
+	fake := newFakeBulb(t, yeelighttest.Options{})
+	bulb := connectFakeBulb(t, fake)
+
+	require.NoError(t, bulb.SetRGB(t.Context(), 0, 0, 255, yeelight.Smooth, 300))
+
+	cmd := lastCommand(t, fake)
+	assert.Equal(t, "set_rgb", cmd.Method)
+	assert.Equal(t, []any{float64(255), "smooth", float64(300)}, cmd.Params)
+	assert.Equal(t, "255", fake.Prop("rgb"))
+	assert.Equal(t, "1", fake.Prop("color_mode"))
+}
+
+func TestBulbFollowsFakeBulbNotifications(t *testing.T) {
+	fake := newFakeBulb(t, yeelighttest.Options{})
+	bulb := connectFakeBulb(t, fake)
+
+	fake.SetProp("power", "off")
+	fake.SetProp("bright", "12")
+
+	assert.Eventually(t, func() bool {
+		return bulb.Power() == yeelight.PowerOff && bulb.Brightness() == 12
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestBulbReportsFakeBulbQuotaErrors(t *testing.T) {
+	fake := newFakeBulb(t, yeelighttest.Options{})
+	bulb := connectFakeBulb(t, fake)
+
+	fake.SetFaults(yeelighttest.Faults{QuotaExceeded: true})
+
+	err := bulb.SetBrightness(t.Context(), 50, yeelight.Sudden, 0)
+	assert.ErrorIs(t, err, yeelight.ErrQuotaExceeded)
+}
+
+func TestConnectHonoursContext(t *testing.T) {
+	fake := newFakeBulb(t, yeelighttest.Options{})
+
+	bulb, err := yeelight.NewBulbFromAddress(fake.Addr())
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	assert.ErrorIs(t, bulb.Connect(ctx), context.Canceled)
+	assert.Equal(t, yeelight.StateDisconnected, bulb.ConnectionState())
+}
+
+func TestBulbReportsSlowRepliesAsTimeouts(t *testing.T) {
+	fake := newFakeBulb(t, yeelighttest.Options{})
+
+	bulb, err := yeelight.NewBulbFromAddress(fake.Addr())
+	require.NoError(t, err)
+	bulb.SetTimeouts(yeelight.Timeouts{Reply: 50 * time.Millisecond})
+	require.NoError(t, bulb.Connect(t.Context()))
+	t.Cleanup(func() { bulb.Disconnect() })
+
+	fake.SetFaults(yeelighttest.Faults{Latency: 500 * time.Millisecond})
+
+	err = bulb.SetBrightness(t.Context(), 50, yeelight.Sudden, 0)
+	assert.ErrorIs(t, err, yeelight.ErrTimeout)
+
+	var timeoutErr *yeelight.TimeoutError
+	require.ErrorAs(t, err, &timeoutErr)
+	assert.Equal(t, 50*time.Millisecond, timeoutErr.After)
+}
+
+func TestBulbIgnoresMalformedLines(t *testing.T) {
+	fake := newFakeBulb(t, yeelighttest.Options{})
+	bulb := connectFakeBulb(t, fake)
+
+	fake.SetFaults(yeelighttest.Faults{Malformed: true, Latency: 20 * time.Millisecond})
+
+	start := time.Now()
+	require.NoError(t, bulb.SetBrightness(t.Context(), 50, yeelight.Sudden, 0))
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+	assert.Equal(t, "50", fake.Prop("bright"))
+}
+
+func TestBulbReconnectsToFakeBulb(t *testing.T) {
+	fake := newFakeBulb(t, yeelighttest.Options{})
+	bulb := connectFakeBulb(t, fake)
+
+	states := bulb.ConnectionStates(t.Context())
+	require.Equal(t, yeelight.StateConnected, <-states)
+
+	fake.DropConnections()
+	assert.Equal(t, yeelight.StateReconnecting, <-states)
+	assert.Equal(t, yeelight.StateConnected, <-states)
+
+	require.NoError(t, bulb.TurnOn(t.Context(), yeelight.Sudden, 0))
+	assert.Equal(t, "set_power", lastCommand(t, fake).Method)
+}
+
+func TestEnableMusicModeWithFakeBulb(t *testing.T) {
+	fake := newFakeBulb(t, yeelighttest.Options{})
+	bulb := connectFakeBulb(t, fake)
+
+	err := bulb.EnableMusicMode(t.Context(), yeelight.MusicModeOptions{}, func(ctx context.Context, music *yeelight.MusicModeBulb) error {
+		require.NoError(t, music.SetBrightness(ctx, 33, yeelight.Sudden, 0))
+
+		assert.Eventually(t, func() bool {
+			cmd := lastCommand(t, fake)
+			return cmd.Music && cmd.Method == "set_bright"
+		}, time.Second, 10*time.Millisecond)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	cmd := lastCommand(t, fake)
+	assert.Equal(t, "set_music", cmd.Method)
+	assert.Equal(t, []any{float64(0)}, cmd.Params)
+	assert.Equal(t, "33", fake.Prop("bright"))
+}
+
+func TestEnableMusicModeFailsWhenFakeBulbNeverDialsBack(t *testing.T) {
+	fake := newFakeBulb(t, yeelighttest.Options{})
+	bulb := connectFakeBulb(t, fake)
+
+	fake.SetFaults(yeelighttest.Faults{IgnoreMusic: true})
+
+	called := false
+	err := bulb.EnableMusicMode(t.Context(), yeelight.MusicModeOptions{AcceptTimeout: 100 * time.Millisecond}, func(context.Context, *yeelight.MusicModeBulb) error {
+		called = true
+		return nil
+	})
+	assert.ErrorIs(t, err, yeelight.ErrMusicModeNoDialBack)
+	assert.False(t, called)
+}
+
+func TestSetHSVColorStrategies(t *testing.T) {
+	tests := []struct {
+		strategy yeelight.ColorStrategy
+		methods  []string
+	}{
+		{strategy: yeelight.ColorStrategyFlow, methods: []string{"start_cf"}},
+		{strategy: yeelight.ColorStrategyRGB, methods: []string{"set_rgb", "set_bright"}},
+		{strategy: yeelight.ColorStrategyHSV, methods: []string{"set_hsv", "set_bright"}},
+		{strategy: yeelight.ColorStrategyScene, methods: []string{"set_scene"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.strategy), func(t *testing.T) {
+			fake := newFakeBulb(t, yeelighttest.Options{})
+			bulb := connectFakeBulb(t, fake)
+			require.NoError(t, bulb.SetColorStrategy(tt.strategy))
+			sent := len(fake.Commands())
+
+			require.NoError(t, bulb.SetHSV(t.Context(), 240, 100, 40, yeelight.Smooth, 300))
+
+			var methods []string
+			for _, cmd := range fake.Commands()[sent:] {
+				methods = append(methods, cmd.Method)
+			}
+			assert.Equal(t, tt.methods, methods)
+			assert.Equal(t, "40", fake.Prop("bright"))
+			assert.Equal(t, uint8(40), bulb.Brightness())
+		})
+	}
+}
+
+func TestSetWhiteWithFakeBulb(t *testing.T) {
+	fake := newFakeBulb(t, yeelighttest.Options{})
+	bulb := connectFakeBulb(t, fake)
+
+	require.NoError(t, bulb.SetWhite(t.Context(), 2700, 60, yeelight.Smooth, 300))
+
+	assert.Equal(t, "start_cf", lastCommand(t, fake).Method)
+	assert.Equal(t, "2700", fake.Prop("ct"))
+	assert.Equal(t, "60", fake.Prop("bright"))
+	assert.Equal(t, "2", fake.Prop("color_mode"))
+	assert.Equal(t, yeelight.ColorModeTemperature, bulb.ColorMode())
+}
+
+func TestBulbReportsMethodsTheFakeBulbRejects(t *testing.T) {
+	fake := newFakeBulb(t, yeelighttest.Options{Support: []string{"get_prop", "set_power", "set_bright"}})
+	bulb := connectFakeBulb(t, fake)
+
+	// created from an address, the bulb does not know its support list and sends anyway
+	err := bulb.SetColorTemperature(t.Context(), 2700, yeelight.Sudden, 0)
+	assert.ErrorIs(t, err, yeelight.ErrUnsupported)
+	assert.Equal(t, "set_ct_abx", lastCommand(t, fake).Method)
+}
+
+func TestSubscribeSeesPhoneAppChanges(t *testing.T) {
+	fake := newFakeBulb(t, yeelighttest.Options{})
+	bulb := connectFakeBulb(t, fake)
+	changes := bulb.Subscribe(t.Context())
+
+	fake.SetProp("power", "off")
+
+	change := <-changes
+	assert.Equal(t, yeelight.PropertyPower, change.Property)
+	assert.Equal(t, yeelight.PowerOff, change.Info.Power())
+}
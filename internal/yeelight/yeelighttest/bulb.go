@@ -0,0 +1,620 @@
+// Package yeelighttest provides a simulated Yeelight bulb for tests and offline demos.
+// It answers SSDP searches, serves the JSON-over-TCP control protocol, pushes props
+// notifications and dials back for music mode, all on the addresses it is given
+// (loopback by default).
+package yeelighttest
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rotisserie/eris"
+)
+
+const lineEnding = "\r\n"
+
+// Options describes the simulated bulb.
+type Options struct {
+	// Address is where the control protocol is served. Empty picks a free loopback
+	// port; use ":55443" to stand in for a real bulb on the LAN.
+	Address string
+	// SSDPAddress is where M-SEARCH requests are answered. Empty picks a free loopback
+	// port. The bulb only answers unicast searches sent to this address.
+	SSDPAddress string
+
+	ID              string
+	Name            string
+	Model           string
+	FirmwareVersion string
+	// Support lists the methods the bulb accepts. Others are rejected the way a real
+	// bulb rejects them. Empty accepts every method the simulation knows.
+	Support []string
+	// Props overrides the initial property values, keyed by get_prop name.
+	Props map[string]string
+}
+
+// Faults makes the simulated bulb misbehave. Change them at any time with SetFaults.
+type Faults struct {
+	// Latency delays every reply and every command's effect.
+	Latency time.Duration
+	// QuotaExceeded rejects every control command with the bulb's quota error.
+	QuotaExceeded bool
+	// Malformed writes a line that is not JSON before every reply.
+	Malformed bool
+	// DropAfter closes a connection once it has received this many commands. Zero
+	// never drops.
+	DropAfter int
+	// IgnoreMusic accepts set_music but never dials back.
+	IgnoreMusic bool
+}
+
+// Command is a command received by the simulated bulb.
+type Command struct {
+	ID     int
+	Method string
+	Params []any
+	// Music reports whether the command arrived on the music mode connection.
+	Music    bool
+	Received time.Time
+}
+
+// Bulb is a simulated Yeelight bulb.
+type Bulb struct {
+	opts Options
+	ln   net.Listener
+	ssdp *net.UDPConn
+
+	mu       sync.Mutex
+	props    map[string]string
+	cron     int
+	faults   Faults
+	commands []Command
+	clients  map[*client]struct{}
+	music    *client
+
+	wg sync.WaitGroup
+}
+
+type client struct {
+	conn  net.Conn
+	music bool
+
+	mu sync.Mutex
+}
+
+func (c *client) writeLine(line string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, err := c.conn.Write([]byte(line + lineEnding))
+	return err
+}
+
+// NewBulb starts a simulated bulb. Close it when done.
+func NewBulb(opts Options) (*Bulb, error) {
+	if opts.Address == "" {
+		opts.Address = "127.0.0.1:0"
+	}
+	if opts.SSDPAddress == "" {
+		opts.SSDPAddress = "127.0.0.1:0"
+	}
+	if opts.ID == "" {
+		opts.ID = "0x000000000fake01"
+	}
+	if opts.Model == "" {
+		opts.Model = "color"
+	}
+	if opts.FirmwareVersion == "" {
+		opts.FirmwareVersion = "18"
+	}
+
+	ln, err := net.Listen("tcp", opts.Address)
+	if err != nil {
+		return nil, eris.Wrap(err, "failed to listen for bulb connections")
+	}
+
+	ssdpAddr, err := net.ResolveUDPAddr("udp4", opts.SSDPAddress)
+	if err != nil {
+		ln.Close()
+		return nil, eris.Wrap(err, "failed to resolve SSDP address")
+	}
+
+	ssdp, err := net.ListenUDP("udp4", ssdpAddr)
+	if err != nil {
+		ln.Close()
+		return nil, eris.Wrap(err, "failed to listen for SSDP searches")
+	}
+
+	b := &Bulb{
+		opts:    opts,
+		ln:      ln,
+		ssdp:    ssdp,
+		props:   defaultProps(opts.Name),
+		clients: make(map[*client]struct{}),
+	}
+	for name, value := range opts.Props {
+		b.props[name] = value
+	}
+
+	b.wg.Add(2)
+	go b.acceptLoop()
+	go b.ssdpLoop()
+
+	return b, nil
+}
+
+func defaultProps(name string) map[string]string {
+	return map[string]string{
+		"power":      "on",
+		"bright":     "100",
+		"color_mode": "2",
+		"ct":         "4000",
+		"rgb":        "16777215",
+		"hue":        "0",
+		"sat":        "0",
+		"name":       name,
+		"flowing":    "0",
+		"bg_power":   "off",
+		"bg_bright":  "100",
+		"bg_lmode":   "2",
+		"bg_ct":      "4000",
+		"bg_rgb":     "16777215",
+		"bg_hue":     "0",
+		"bg_sat":     "0",
+		"bg_flowing": "0",
+	}
+}
+
+// Addr is the address of the control protocol, as advertised over SSDP.
+func (b *Bulb) Addr() string {
+	return b.ln.Addr().String()
+}
+
+// SSDPAddr is the address to send M-SEARCH requests to.
+func (b *Bulb) SSDPAddr() string {
+	return b.ssdp.LocalAddr().String()
+}
+
+// SetFaults replaces the active faults.
+func (b *Bulb) SetFaults(faults Faults) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.faults = faults
+}
+
+// Commands returns every command received so far, in arrival order.
+func (b *Bulb) Commands() []Command {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return slices.Clone(b.commands)
+}
+
+// Prop returns the current value of a property, using get_prop names.
+func (b *Bulb) Prop(name string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.props[name]
+}
+
+// SetProp changes a property as if someone used the phone app, and notifies every
+// control connection.
+func (b *Bulb) SetProp(name, value string) {
+	b.mu.Lock()
+	b.props[name] = value
+	b.mu.Unlock()
+
+	b.notify(map[string]string{name: value})
+}
+
+// DropConnections closes every open connection, as a Wi-Fi hiccup would.
+func (b *Bulb) DropConnections() {
+	b.mu.Lock()
+	clients := make([]*client, 0, len(b.clients))
+	for c := range b.clients {
+		clients = append(clients, c)
+	}
+	b.mu.Unlock()
+
+	for _, c := range clients {
+		c.conn.Close()
+	}
+}
+
+// Close stops the bulb and closes every connection.
+func (b *Bulb) Close() error {
+	err := b.ln.Close()
+	b.ssdp.Close()
+	b.DropConnections()
+	b.wg.Wait()
+
+	return err
+}
+
+func (b *Bulb) acceptLoop() {
+	defer b.wg.Done()
+
+	for {
+		conn, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		b.serve(&client{conn: conn})
+	}
+}
+
+func (b *Bulb) serve(c *client) {
+	b.mu.Lock()
+	b.clients[c] = struct{}{}
+	b.mu.Unlock()
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		defer func() {
+			b.mu.Lock()
+			delete(b.clients, c)
+			if b.music == c {
+				b.music = nil
+			}
+			b.mu.Unlock()
+			c.conn.Close()
+		}()
+
+		received := 0
+		scanner := bufio.NewScanner(c.conn)
+		for scanner.Scan() {
+			var cmd struct {
+				ID     int    `json:"id"`
+				Method string `json:"method"`
+				Params []any  `json:"params"`
+			}
+			if err := json.Unmarshal(scanner.Bytes(), &cmd); err != nil {
+				continue
+			}
+
+			b.mu.Lock()
+			b.commands = append(b.commands, Command{
+				ID:       cmd.ID,
+				Method:   cmd.Method,
+				Params:   cmd.Params,
+				Music:    c.music,
+				Received: time.Now(),
+			})
+			faults := b.faults
+			b.mu.Unlock()
+
+			received++
+			if faults.DropAfter > 0 && received >= faults.DropAfter {
+				return
+			}
+
+			time.Sleep(faults.Latency)
+
+			if err := b.handle(c, faults, cmd.ID, cmd.Method, cmd.Params); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+type reply struct {
+	ID     int         `json:"id"`
+	Result []any       `json:"result,omitempty"`
+	Error  *replyError `json:"error,omitempty"`
+}
+
+type replyError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type notification struct {
+	Method string         `json:"method"`
+	Params map[string]any `json:"params"`
+}
+
+// handle applies one command and answers it. Music mode connections get no replies.
+func (b *Bulb) handle(c *client, faults Faults, id int, method string, params []any) error {
+	var (
+		result  []any
+		changes map[string]string
+		err     *replyError
+	)
+
+	switch {
+	case faults.QuotaExceeded && !c.music:
+		err = &replyError{Code: -1, Message: "client quota exceeded"}
+	case len(b.opts.Support) > 0 && !slices.Contains(b.opts.Support, method):
+		err = &replyError{Code: -1, Message: "method not supported"}
+	default:
+		result, changes, err = b.apply(c, faults, method, params)
+	}
+
+	if len(changes) > 0 {
+		b.notify(changes)
+	}
+
+	if c.music {
+		return nil
+	}
+
+	if faults.Malformed {
+		if err := c.writeLine(`{"id":` + strconv.Itoa(id) + `, garbage`); err != nil {
+			return err
+		}
+	}
+
+	line, marshalErr := json.Marshal(reply{ID: id, Result: result, Error: err})
+	if marshalErr != nil {
+		return marshalErr
+	}
+
+	return c.writeLine(string(line))
+}
+
+// apply runs a command against the simulated state and returns its result and the
+// properties it changed.
+func (b *Bulb) apply(c *client, faults Faults, method string, params []any) ([]any, map[string]string, *replyError) {
+	if method == "get_prop" {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		result := make([]any, len(params))
+		for i, param := range params {
+			name, _ := param.(string)
+			result[i] = b.props[name]
+		}
+		return result, nil, nil
+	}
+
+	if method == "set_music" {
+		return b.setMusic(faults, params)
+	}
+
+	prefix := ""
+	if trimmed, ok := strings.CutPrefix(method, "bg_"); ok {
+		prefix = "bg_"
+		method = trimmed
+	}
+	modeProp := prefix + "color_mode"
+	if prefix != "" {
+		modeProp = "bg_lmode"
+	}
+
+	changes := make(map[string]string)
+	set := func(name string, value any) {
+		changes[name] = fmt.Sprint(value)
+	}
+
+	switch method {
+	case "set_power":
+		set(prefix+"power", stringParam(params, 0))
+	case "toggle":
+		if b.Prop(prefix+"power") == "on" {
+			set(prefix+"power", "off")
+		} else {
+			set(prefix+"power", "on")
+		}
+	case "dev_toggle":
+		for _, name := range []string{"power", "bg_power"} {
+			if b.Prop(name) == "on" {
+				set(name, "off")
+			} else {
+				set(name, "on")
+			}
+		}
+	case "set_bright":
+		set(prefix+"bright", intParam(params, 0))
+	case "set_rgb":
+		set(prefix+"rgb", intParam(params, 0))
+		set(modeProp, 1)
+	case "set_ct_abx":
+		set(prefix+"ct", intParam(params, 0))
+		set(modeProp, 2)
+	case "set_hsv":
+		set(prefix+"hue", intParam(params, 0))
+		set(prefix+"sat", intParam(params, 1))
+		set(modeProp, 3)
+	case "set_scene":
+		set(prefix+"power", "on")
+		switch stringParam(params, 0) {
+		case "color":
+			set(prefix+"rgb", intParam(params, 1))
+			set(prefix+"bright", intParam(params, 2))
+			set(modeProp, 1)
+		case "hsv":
+			set(prefix+"hue", intParam(params, 1))
+			set(prefix+"sat", intParam(params, 2))
+			set(prefix+"bright", intParam(params, 3))
+			set(modeProp, 3)
+		case "ct":
+			set(prefix+"ct", intParam(params, 1))
+			set(prefix+"bright", intParam(params, 2))
+			set(modeProp, 2)
+		case "cf":
+			set(prefix+"flowing", 1)
+			flowEnd(params[1:], prefix, modeProp, set)
+		case "auto_delay_off":
+			set(prefix+"bright", intParam(params, 1))
+		}
+	case "start_cf":
+		set(prefix+"flowing", 1)
+		flowEnd(params, prefix, modeProp, set)
+	case "stop_cf":
+		set(prefix+"flowing", 0)
+	case "adjust_bright":
+		bright, _ := strconv.Atoi(b.Prop(prefix + "bright"))
+		set(prefix+"bright", min(max(bright+intParam(params, 0), 1), 100))
+	case "set_name":
+		if prefix != "" {
+			return nil, nil, &replyError{Code: -1, Message: "method not supported"}
+		}
+		set("name", stringParam(params, 0))
+	case "cron_add":
+		b.mu.Lock()
+		b.cron = intParam(params, 1)
+		b.mu.Unlock()
+	case "cron_get":
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.cron == 0 {
+			return []any{}, nil, nil
+		}
+		return []any{map[string]int{"type": 0, "delay": b.cron, "mix": 0}}, nil, nil
+	case "cron_del":
+		b.mu.Lock()
+		b.cron = 0
+		b.mu.Unlock()
+	case "set_default", "set_adjust", "adjust_ct", "adjust_color":
+	default:
+		return nil, nil, &replyError{Code: -1, Message: "method not supported"}
+	}
+
+	b.mu.Lock()
+	for name, value := range changes {
+		if b.props[name] == value {
+			delete(changes, name)
+			continue
+		}
+		b.props[name] = value
+	}
+	b.mu.Unlock()
+
+	return []any{"ok"}, changes, nil
+}
+
+// setMusic dials back to the address in a set_music command, or drops the music
+// connection when music mode is switched off.
+func (b *Bulb) setMusic(faults Faults, params []any) ([]any, map[string]string, *replyError) {
+	b.mu.Lock()
+	music := b.music
+	b.music = nil
+	b.mu.Unlock()
+
+	if music != nil {
+		music.conn.Close()
+	}
+
+	if intParam(params, 0) != 1 || faults.IgnoreMusic {
+		return []any{"ok"}, nil, nil
+	}
+
+	addr := net.JoinHostPort(stringParam(params, 1), strconv.Itoa(intParam(params, 2)))
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return nil, nil, &replyError{Code: -1, Message: "failed to connect music server"}
+	}
+
+	c := &client{conn: conn, music: true}
+	b.mu.Lock()
+	b.music = c
+	b.mu.Unlock()
+	b.serve(c)
+
+	return []any{"ok"}, nil, nil
+}
+
+// notify pushes a props notification to every control connection.
+func (b *Bulb) notify(changes map[string]string) {
+	params := make(map[string]any, len(changes))
+	for name, value := range changes {
+		params[name] = propValue(name, value)
+	}
+
+	line, err := json.Marshal(notification{Method: "props", Params: params})
+	if err != nil {
+		return
+	}
+
+	b.mu.Lock()
+	clients := make([]*client, 0, len(b.clients))
+	for c := range b.clients {
+		if !c.music {
+			clients = append(clients, c)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, c := range clients {
+		_ = c.writeLine(string(line))
+	}
+}
+
+// propValue encodes a property the way bulbs do in notifications: numbers as JSON
+// numbers, everything else as strings.
+func propValue(name, value string) any {
+	if n, err := strconv.Atoi(value); err == nil && name != "name" {
+		return n
+	}
+
+	return value
+}
+
+// flowEnd applies the last step of a flow that stays on its final state, given the
+// count, action and expression parameters of start_cf.
+func flowEnd(params []any, prefix, modeProp string, set func(string, any)) {
+	const (
+		flowStay     = 1
+		flowModeRGB  = 1
+		flowModeCT   = 2
+		fieldsInStep = 4
+	)
+
+	fields := strings.Split(stringParam(params, 2), ",")
+	if intParam(params, 1) != flowStay || len(fields) < fieldsInStep || len(fields)%fieldsInStep != 0 {
+		return
+	}
+
+	last := fields[len(fields)-fieldsInStep:]
+	mode, _ := strconv.Atoi(strings.TrimSpace(last[1]))
+	value, _ := strconv.Atoi(strings.TrimSpace(last[2]))
+	bright, _ := strconv.Atoi(strings.TrimSpace(last[3]))
+
+	switch mode {
+	case flowModeRGB:
+		set(prefix+"rgb", value)
+		set(modeProp, 1)
+	case flowModeCT:
+		set(prefix+"ct", value)
+		set(modeProp, 2)
+	}
+	if bright > 0 {
+		set(prefix+"bright", bright)
+	}
+}
+
+func stringParam(params []any, i int) string {
+	if i >= len(params) {
+		return ""
+	}
+
+	s, _ := params[i].(string)
+	return s
+}
+
+func intParam(params []any, i int) int {
+	if i >= len(params) {
+		return 0
+	}
+
+	switch v := params[i].(type) {
+	case float64:
+		return int(v)
+	case string:
+		n, _ := strconv.Atoi(v)
+		return n
+	default:
+		return 0
+	}
+}
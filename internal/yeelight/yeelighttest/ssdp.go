@@ -0,0 +1,47 @@
+package yeelighttest
+
+import (
+	"fmt"
+	"strings"
+)
+
+func (b *Bulb) ssdpLoop() {
+	defer b.wg.Done()
+
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := b.ssdp.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		if !strings.HasPrefix(string(buf[:n]), "M-SEARCH") {
+			continue
+		}
+
+		_, _ = b.ssdp.WriteToUDP([]byte(b.searchResponse()), from)
+	}
+}
+
+// searchResponse builds the reply to an M-SEARCH, advertising the current state like a
+// real bulb does.
+func (b *Bulb) searchResponse() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	headers := []string{
+		"HTTP/1.1 200 OK",
+		"Cache-Control: max-age=3600",
+		"Location: yeelight://" + b.Addr(),
+		"Server: POSIX UPnP/1.0 YGLC/1",
+		"id: " + b.opts.ID,
+		"model: " + b.opts.Model,
+		"fw_ver: " + b.opts.FirmwareVersion,
+		"support: " + strings.Join(b.opts.Support, " "),
+	}
+	for _, name := range []string{"power", "bright", "color_mode", "ct", "rgb", "hue", "sat", "name"} {
+		headers = append(headers, fmt.Sprintf("%s: %s", name, b.props[name]))
+	}
+
+	return strings.Join(headers, lineEnding) + lineEnding
+}